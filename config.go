@@ -3,45 +3,302 @@ package main
 import (
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"kage/core"
+	"kage/socks5"
+	"net"
+	"net/http"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 )
 
+var (
+	ErrUnknownProtocol = errors.New("config: unknown inbound type")
+	ErrInvalidPort     = errors.New("config: port out of range")
+	ErrUnknownPolicy   = errors.New("config: unknown bind policy")
+	ErrWeakKey         = errors.New("config: password decodes to a degenerate key")
+)
+
+const (
+	InboundSocks5 = "socks5"
+	InboundTunnel = "tunnel"
+	InboundHTTP   = "http"
+)
+
+// Bind policies decide what happens when some inbounds fail to bind.
+const (
+	BindBestEffort = "best_effort"
+	BindRequireAll = "require_all"
+)
+
+// inboundAliases maps every accepted inbound type name to its canonical form.
+var inboundAliases = map[string]string{
+	"socks5":  InboundSocks5,
+	"socks":   InboundSocks5,
+	"tunnel":  InboundTunnel,
+	"forward": InboundTunnel,
+	"http":    InboundHTTP,
+}
+
+// configTokenEnv names the environment variable holding an optional bearer
+// token sent when the config is fetched from an HTTP(S) URL.
+const configTokenEnv = "KAGE_CONFIG_TOKEN"
+
 type InboundConfig struct {
-	Type       string `json:"type"`
-	ListenAddr string `json:"listen"`
-	Target     string `json:"target"`
-	FastOpen   bool   `json:"fast_open"`
-	UDP        bool   `json:"udp"`
+	Type                   string            `json:"type"`
+	ListenAddr             string            `json:"listen"`
+	Target                 string            `json:"target"`
+	FastOpen               bool              `json:"fast_open"`
+	DelayInitialPayload    bool              `json:"delay_initial_payload"`
+	PadWithPayload         bool              `json:"pad_with_payload"`
+	CoalesceInitialPayload bool              `json:"coalesce_initial_payload"`
+	CompleteTLSRecord      bool              `json:"complete_tls_record"`
+	AbortOnPayloadError    bool              `json:"abort_on_payload_error"`
+	UDP                    bool              `json:"udp"`
+	UDPIdleTimeout         int               `json:"udp_idle_timeout"` // seconds
+	UDPRedials             int               `json:"udp_redials"`
+	UDPPacketRate          int               `json:"udp_packet_rate"` // packets per second
+	UDPSyncClock           bool              `json:"udp_sync_clock"`
+	UDPFragments           bool              `json:"udp_fragments"`
+	BlockQUIC              bool              `json:"block_quic"`
+	AuthMethods            []string          `json:"auth_methods"`
+	Users                  map[string]string `json:"users"`
+	MaxDomainLength        int               `json:"max_domain_length"`
+	Strict                 bool              `json:"strict"`
+	LogNegotiation         bool              `json:"log_negotiation"`
+	ShutdownNotice         bool              `json:"shutdown_notice"`
 }
 
 type Config struct {
-	Server   string          `json:"server"`
-	Method   string          `json:"method"`
-	Password string          `json:"password"`
-	LogLevel string          `json:"log_level"` // "debug", "info", "warn", "error"
-	Inbounds []InboundConfig `json:"inbounds"`
+	Tag              string          `json:"tag"`
+	Server           string          `json:"server"`
+	Method           string          `json:"method"`
+	Password         string          `json:"password"`
+	RejectWeakKey    bool            `json:"reject_weak_key"`
+	LogLevel         string          `json:"log_level"`        // "debug", "info", "warn", "error"
+	LogTarget        string          `json:"log_target"`       // "full", "domain", "none"
+	LogDedupWindow   int             `json:"log_dedup_window"` // seconds
+	LogSampleRate    int             `json:"log_sample_rate"`  // log 1 in N connections
+	NoPadding        bool            `json:"no_padding"`
+	ConnectTimeout   int             `json:"connect_timeout"`       // seconds
+	HandshakeTimeout int             `json:"handshake_timeout"`     // seconds
+	SetupTimeout     int             `json:"overall_setup_timeout"` // seconds
+	EarlyRetries     int             `json:"early_retries"`
+	ChunkSize        int             `json:"chunk_size"`
+	DSCP             int             `json:"dscp"`
+	WriteCoalesce    int             `json:"write_coalesce"` // milliseconds
+	PinServerIP      bool            `json:"pin_server_ip"`
+	PinResolver      string          `json:"pin_resolver"`   // host:port of a DNS server
+	RelayStrategy    string          `json:"relay_strategy"` // "buffered", "small"
+	AdaptiveNoDelay  bool            `json:"adaptive_nodelay"`
+	CloseGrace       int             `json:"close_grace"`       // seconds
+	MaxConnLifetime  int             `json:"max_conn_lifetime"` // seconds
+	BackoffJitter    string          `json:"backoff_jitter"`    // "none", "full", "decorrelated"
+	QuotaBytes       uint64          `json:"quota_bytes"`
+	QuotaCloseActive bool            `json:"quota_close_active"`
+	BindPolicy       string          `json:"bind_policy"` // "best_effort", "require_all"
+	PprofAddr        string          `json:"pprof_addr"`  // host:port, empty disables
+	Inbounds         []InboundConfig `json:"inbounds"`
 	
 	Key []byte `json:"-"`
 }
 
+// ShadowsocksConfig is the single-server config file format shared by the
+// other shadowsocks implementations.
+type ShadowsocksConfig struct {
+	Server       string `json:"server"`
+	ServerPort   int    `json:"server_port"`
+	Password     string `json:"password"`
+	Method       string `json:"method"`
+	LocalAddress string `json:"local_address"`
+	LocalPort    int    `json:"local_port"`
+	Mode         string `json:"mode"` // "tcp_only", "tcp_and_udp", "udp_only"
+}
+
 func LoadConfig(path string) (*Config, error) {
-	data, err := os.ReadFile(path)
+	data, err := readConfig(path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read config: %w", err)
+		return nil, err
 	}
-
+	
 	var cfg Config
 	if err = json.Unmarshal(data, &cfg); err != nil {
 		return nil, fmt.Errorf("failed to parse config: %w", err)
 	}
+	return finishConfig(&cfg)
+}
+
+// LoadShadowsocksJSON loads a config in the standard shadowsocks format and
+// maps it to a Config with a single SOCKS5 inbound on the local address.
+func LoadShadowsocksJSON(path string) (*Config, error) {
+	data, err := readConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	
+	var ss ShadowsocksConfig
+	if err = json.Unmarshal(data, &ss); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+	
+	localAddress := ss.LocalAddress
+	if localAddress == "" {
+		localAddress = "127.0.0.1"
+	}
+	cfg := Config{
+		Server:   net.JoinHostPort(ss.Server, strconv.Itoa(ss.ServerPort)),
+		Method:   ss.Method,
+		Password: ss.Password,
+		Inbounds: []InboundConfig{{
+			Type:       InboundSocks5,
+			ListenAddr: net.JoinHostPort(localAddress, strconv.Itoa(ss.LocalPort)),
+			UDP:        strings.Contains(ss.Mode, "udp"),
+		}},
+	}
+	return finishConfig(&cfg)
+}
+
+func readConfig(path string) ([]byte, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		data, err = fetchConfig(path)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	return data, nil
+}
 
+// finishConfig decodes the key and normalizes the inbound types.
+func finishConfig(cfg *Config) (*Config, error) {
 	key, err := base64.StdEncoding.DecodeString(cfg.Password)
 	if err != nil {
 		return nil, fmt.Errorf("failed to decode password: %w", err)
 	}
 	cfg.Key = key
+	
+	if err = checkPort(cfg.Server, 1); err != nil {
+		return nil, fmt.Errorf("invalid server %q: %w", cfg.Server, err)
+	}
+	
+	switch cfg.BindPolicy {
+	case "":
+		cfg.BindPolicy = BindBestEffort
+	case BindBestEffort, BindRequireAll:
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownPolicy, cfg.BindPolicy)
+	}
+	
+	for i := range cfg.Inbounds {
+		in := &cfg.Inbounds[i]
+		typ, ok := inboundAliases[strings.ToLower(in.Type)]
+		if !ok {
+			return nil, fmt.Errorf("%w: %q", ErrUnknownProtocol, in.Type)
+		}
+		in.Type = typ
+		
+		if in.Type == InboundSocks5 && slices.Contains(in.AuthMethods, "password") && len(in.Users) == 0 {
+			return nil, fmt.Errorf("invalid auth_methods: %w, set users", socks5.ErrNoAuthenticator)
+		}
+		
+		// Port 0 lets the system pick a listen port.
+		if err = checkPort(in.ListenAddr, 0); err != nil {
+			return nil, fmt.Errorf("invalid listen %q: %w", in.ListenAddr, err)
+		}
+		if in.Type == InboundTunnel {
+			if err = checkPort(in.Target, 1); err != nil {
+				return nil, fmt.Errorf("invalid target %q: %w", in.Target, err)
+			}
+			var target *core.Address
+			if target, err = core.ParseAddress(in.Target); err != nil {
+				return nil, fmt.Errorf("invalid target %q: %w", in.Target, err)
+			}
+			if core.IsSelfTarget(target, cfg.Server) {
+				return nil, fmt.Errorf("invalid target %q: %w, traffic would loop back into kage", in.Target, core.ErrSelfTarget)
+			}
+		}
+	}
+	
+	return cfg, nil
+}
 
-	return &cfg, nil
+// checkPort reports whether the port of a host:port address lies within
+// [minPort, 65535].
+func checkPort(addr string, minPort int) error {
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < minPort || port > 65535 {
+		return fmt.Errorf("%w: %q, want %d-65535", ErrInvalidPort, portStr, minPort)
+	}
+	return nil
+}
+
+// Redacted returns a copy of the config with the password and the SOCKS5
+// user passwords replaced, safe to print or log.
+func (c *Config) Redacted() Config {
+	r := *c
+	if r.Password != "" {
+		r.Password = redacted
+	}
+	r.Inbounds = make([]InboundConfig, len(c.Inbounds))
+	for i, in := range c.Inbounds {
+		if len(in.Users) > 0 {
+			users := make(map[string]string, len(in.Users))
+			for user := range in.Users {
+				users[user] = redacted
+			}
+			in.Users = users
+		}
+		r.Inbounds[i] = in
+	}
+	return r
 }
 
+const redacted = "REDACTED"
+
+// maxConfigSize limits the size of a config fetched from a URL.
+const maxConfigSize = 1 << 20
+
+// configFetchTimeout bounds fetching a config from a URL, as a variable for
+// tests.
+var configFetchTimeout = 10 * time.Second
+
+func fetchConfig(url string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := os.Getenv(configTokenEnv); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	
+	client := &http.Client{Timeout: configFetchTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxConfigSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxConfigSize {
+		return nil, fmt.Errorf("config larger than %d bytes", maxConfigSize)
+	}
+	return data, nil
+}
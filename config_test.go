@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"kage/core"
+	"kage/socks5"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testConfig(inbounds ...InboundConfig) *Config {
+	return &Config{
+		Server:   "203.0.113.1:8388",
+		Method:   "2022-blake3-aes-128-gcm",
+		Password: "AAAAAAAAAAAAAAAAAAAAAA==",
+		Inbounds: inbounds,
+	}
+}
+
+func TestFinishConfigInboundAliases(t *testing.T) {
+	tests := []struct {
+		typ  string
+		want string
+		err  error
+	}{
+		{"socks5", InboundSocks5, nil},
+		{"socks", InboundSocks5, nil},
+		{"SOCKS5", InboundSocks5, nil},
+		{"Socks", InboundSocks5, nil},
+		{"tunnel", InboundTunnel, nil},
+		{"forward", InboundTunnel, nil},
+		{"Forward", InboundTunnel, nil},
+		{"http", InboundHTTP, nil},
+		{"HTTP", InboundHTTP, nil},
+		{"socks4", "", ErrUnknownProtocol},
+		{"", "", ErrUnknownProtocol},
+		{" socks5", "", ErrUnknownProtocol},
+	}
+	for _, tt := range tests {
+		in := InboundConfig{Type: tt.typ, ListenAddr: "127.0.0.1:1080", Target: "203.0.113.2:53"}
+		cfg, err := finishConfig(testConfig(in))
+		if !errors.Is(err, tt.err) {
+			t.Errorf("type %q: finishConfig error = %v, want %v", tt.typ, err, tt.err)
+			continue
+		}
+		if err == nil && cfg.Inbounds[0].Type != tt.want {
+			t.Errorf("type %q normalized to %q, want %q", tt.typ, cfg.Inbounds[0].Type, tt.want)
+		}
+	}
+}
+
+func TestFinishConfigPasswordWithoutUsers(t *testing.T) {
+	in := InboundConfig{Type: "socks5", ListenAddr: "127.0.0.1:1080", AuthMethods: []string{"password"}}
+	if _, err := finishConfig(testConfig(in)); !errors.Is(err, socks5.ErrNoAuthenticator) {
+		t.Fatalf("finishConfig error = %v, want ErrNoAuthenticator", err)
+	}
+	
+	in.Users = map[string]string{"alice": "secret"}
+	if _, err := finishConfig(testConfig(in)); err != nil {
+		t.Fatalf("finishConfig with users: %v", err)
+	}
+}
+
+func TestFinishConfigPorts(t *testing.T) {
+	tests := []struct {
+		name   string
+		server string
+		in     InboundConfig
+		err    bool
+	}{
+		{"valid", "203.0.113.1:8388", InboundConfig{Type: "tunnel", ListenAddr: "127.0.0.1:1080", Target: "203.0.113.2:53"}, false},
+		{"highest ports", "203.0.113.1:65535", InboundConfig{Type: "tunnel", ListenAddr: "127.0.0.1:65535", Target: "203.0.113.2:65535"}, false},
+		{"listen port 0", "203.0.113.1:8388", InboundConfig{Type: "socks5", ListenAddr: "127.0.0.1:0"}, false},
+		{"server port 0", "203.0.113.1:0", InboundConfig{Type: "socks5", ListenAddr: "127.0.0.1:1080"}, true},
+		{"server port too large", "203.0.113.1:65536", InboundConfig{Type: "socks5", ListenAddr: "127.0.0.1:1080"}, true},
+		{"server port negative", "203.0.113.1:-1", InboundConfig{Type: "socks5", ListenAddr: "127.0.0.1:1080"}, true},
+		{"server port not a number", "203.0.113.1:ss", InboundConfig{Type: "socks5", ListenAddr: "127.0.0.1:1080"}, true},
+		{"listen port too large", "203.0.113.1:8388", InboundConfig{Type: "socks5", ListenAddr: "127.0.0.1:70000"}, true},
+		{"listen port negative", "203.0.113.1:8388", InboundConfig{Type: "http", ListenAddr: "127.0.0.1:-8080"}, true},
+		{"target port 0", "203.0.113.1:8388", InboundConfig{Type: "tunnel", ListenAddr: "127.0.0.1:1080", Target: "203.0.113.2:0"}, true},
+		{"target port too large", "203.0.113.1:8388", InboundConfig{Type: "tunnel", ListenAddr: "127.0.0.1:1080", Target: "203.0.113.2:65536"}, true},
+	}
+	for _, tt := range tests {
+		cfg := testConfig(tt.in)
+		cfg.Server = tt.server
+		_, err := finishConfig(cfg)
+		if tt.err && !errors.Is(err, ErrInvalidPort) {
+			t.Errorf("%s: finishConfig = %v, want ErrInvalidPort", tt.name, err)
+		}
+		if !tt.err && err != nil {
+			t.Errorf("%s: finishConfig = %v", tt.name, err)
+		}
+	}
+}
+
+func TestFinishConfigTunnelTarget(t *testing.T) {
+	in := InboundConfig{Type: "tunnel", ListenAddr: "127.0.0.1:1080", Target: "203.0.113.1:8388"}
+	if _, err := finishConfig(testConfig(in)); !errors.Is(err, core.ErrSelfTarget) {
+		t.Fatalf("finishConfig with the server as target = %v, want ErrSelfTarget", err)
+	}
+	
+	// Only the server address is refused, not the listener.
+	in.Target = "localhost:1080"
+	if _, err := finishConfig(testConfig(in)); err != nil {
+		t.Fatalf("finishConfig with the listener as target = %v", err)
+	}
+}
+
+func TestFinishConfigTunnelTargetTooLong(t *testing.T) {
+	target := strings.Repeat("a", 300) + ".example.com:443"
+	in := InboundConfig{Type: "tunnel", ListenAddr: "127.0.0.1:1080", Target: target}
+	_, err := finishConfig(testConfig(in))
+	if !errors.Is(err, core.ErrDomainTooLong) {
+		t.Fatalf("finishConfig with a %d byte target = %v, want ErrDomainTooLong", len(target), err)
+	}
+	if !strings.Contains(err.Error(), "invalid target") {
+		t.Errorf("error %q does not name the target", err)
+	}
+}
+
+func TestFetchConfig(t *testing.T) {
+	defer func(d time.Duration) { configFetchTimeout = d }(configFetchTimeout)
+	configFetchTimeout = 200 * time.Millisecond
+	t.Setenv(configTokenEnv, "s3cret")
+	
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/config.json":
+			if got := r.Header.Get("Authorization"); got != "Bearer s3cret" {
+				http.Error(w, "bad token "+got, http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"server":"203.0.113.1:8388"}`))
+		case "/limit.json":
+			w.Write(bytes.Repeat([]byte(" "), maxConfigSize))
+		case "/large.json":
+			w.Write(bytes.Repeat([]byte(" "), maxConfigSize+1))
+		case "/slow.json":
+			<-release
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+	
+	data, err := fetchConfig(srv.URL + "/config.json")
+	if err != nil {
+		t.Fatalf("fetchConfig: %v", err)
+	}
+	if string(data) != `{"server":"203.0.113.1:8388"}` {
+		t.Fatalf("fetchConfig = %q", data)
+	}
+	
+	if data, err = fetchConfig(srv.URL + "/limit.json"); err != nil || len(data) != maxConfigSize {
+		t.Fatalf("fetchConfig of %d bytes = %d bytes, %v", maxConfigSize, len(data), err)
+	}
+	if _, err = fetchConfig(srv.URL + "/large.json"); err == nil {
+		t.Fatal("fetchConfig of an oversized config succeeded")
+	}
+	if _, err = fetchConfig(srv.URL + "/missing.json"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("fetchConfig of a missing config = %v, want the status", err)
+	}
+	
+	start := time.Now()
+	if _, err = fetchConfig(srv.URL + "/slow.json"); err == nil {
+		t.Fatal("fetchConfig of a hanging server succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("fetchConfig gave up after %v", elapsed)
+	}
+}
+
+func TestLoadShadowsocksJSON(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		server string
+		listen string
+		udp    bool
+	}{
+		{
+			"standard",
+			`{"server":"203.0.113.1","server_port":8388,"password":"AAAAAAAAAAAAAAAAAAAAAA==","method":"2022-blake3-aes-128-gcm","local_address":"0.0.0.0","local_port":1080,"mode":"tcp_and_udp"}`,
+			"203.0.113.1:8388", "0.0.0.0:1080", true,
+		},
+		{
+			"defaults",
+			`{"server":"203.0.113.1","server_port":8388,"password":"AAAAAAAAAAAAAAAAAAAAAA==","method":"2022-blake3-aes-128-gcm","local_port":1080}`,
+			"203.0.113.1:8388", "127.0.0.1:1080", false,
+		},
+		{
+			"ipv6 server",
+			`{"server":"2001:db8::1","server_port":8388,"password":"AAAAAAAAAAAAAAAAAAAAAA==","method":"2022-blake3-aes-128-gcm","local_port":1080,"mode":"tcp_only"}`,
+			"[2001:db8::1]:8388", "127.0.0.1:1080", false,
+		},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "config.json")
+		if err := os.WriteFile(path, []byte(tt.config), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := LoadShadowsocksJSON(path)
+		if err != nil {
+			t.Fatalf("%s: LoadShadowsocksJSON: %v", tt.name, err)
+		}
+		
+		if cfg.Server != tt.server || cfg.Method != "2022-blake3-aes-128-gcm" || cfg.Password != "AAAAAAAAAAAAAAAAAAAAAA==" {
+			t.Errorf("%s: server %s, method %s, password %s", tt.name, cfg.Server, cfg.Method, cfg.Password)
+		}
+		if len(cfg.Key) != 16 {
+			t.Errorf("%s: %d byte key, want the password decoded to 16", tt.name, len(cfg.Key))
+		}
+		if len(cfg.Inbounds) != 1 {
+			t.Fatalf("%s: %d inbounds, want 1", tt.name, len(cfg.Inbounds))
+		}
+		in := cfg.Inbounds[0]
+		if in.Type != InboundSocks5 || in.ListenAddr != tt.listen || in.UDP != tt.udp {
+			t.Errorf("%s: inbound %s on %s with UDP %v, want socks5 on %s with UDP %v", tt.name, in.Type, in.ListenAddr, in.UDP, tt.listen, tt.udp)
+		}
+	}
+}
+
+func TestRedactedJSON(t *testing.T) {
+	cfg, err := finishConfig(testConfig(
+		InboundConfig{Type: "socks5", ListenAddr: "127.0.0.1:1080", Users: map[string]string{"alice": "alice-secret", "bob": "bob-secret"}},
+		InboundConfig{Type: "tunnel", ListenAddr: "127.0.0.1:5353", Target: "203.0.113.2:53"},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	// -print-config prints this line.
+	summary, err := json.Marshal(cfg.Redacted())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{cfg.Password, "alice-secret", "bob-secret"} {
+		if bytes.Contains(summary, []byte(secret)) {
+			t.Errorf("summary reveals %q: %s", secret, summary)
+		}
+	}
+	
+	var parsed struct {
+		Server   string `json:"server"`
+		Method   string `json:"method"`
+		Password string `json:"password"`
+		Inbounds []struct {
+			Type   string            `json:"type"`
+			Listen string            `json:"listen"`
+			Users  map[string]string `json:"users"`
+		} `json:"inbounds"`
+	}
+	if err := json.Unmarshal(summary, &parsed); err != nil {
+		t.Fatalf("summary is not JSON: %v: %s", err, summary)
+	}
+	if parsed.Server != cfg.Server || parsed.Method != cfg.Method || parsed.Password != redacted {
+		t.Errorf("server %q, method %q, password %q", parsed.Server, parsed.Method, parsed.Password)
+	}
+	if len(parsed.Inbounds) != 2 || parsed.Inbounds[0].Type != InboundSocks5 || parsed.Inbounds[1].Type != InboundTunnel {
+		t.Fatalf("inbounds %+v", parsed.Inbounds)
+	}
+	want := map[string]string{"alice": redacted, "bob": redacted}
+	if !maps.Equal(parsed.Inbounds[0].Users, want) {
+		t.Errorf("users %v, want the names with redacted passwords", parsed.Inbounds[0].Users)
+	}
+	
+	// The config itself keeps its secrets.
+	if cfg.Password == redacted || cfg.Inbounds[0].Users["alice"] != "alice-secret" {
+		t.Error("Redacted modified the config")
+	}
+}
@@ -1,8 +1,10 @@
 package core
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"strconv"
@@ -10,6 +12,7 @@ import (
 
 var (
 	ErrAddressTypeNotSupported = errors.New("address: type not supported")
+	ErrDomainTooLong           = errors.New("address: domain name too long")
 )
 
 type AddressType byte
@@ -76,7 +79,15 @@ func (a *Address) String() string {
 	return net.JoinHostPort(host, strconv.Itoa(int(a.Port)))
 }
 
+const MaxDomainLength = 255
+
 func ReadAddress(r io.Reader) (*Address, error) {
+	return ReadAddressLimit(r, MaxDomainLength)
+}
+
+// ReadAddressLimit is like ReadAddress but rejects domain names longer than
+// maxDomainLen before reading them.
+func ReadAddressLimit(r io.Reader, maxDomainLen int) (*Address, error) {
 	b := make([]byte, 1)
 	if _, err := io.ReadFull(r, b); err != nil {
 		return nil, err
@@ -101,6 +112,9 @@ func ReadAddress(r io.Reader) (*Address, error) {
 			return nil, err
 		}
 		domainLen := int(b[0])
+		if domainLen > maxDomainLen {
+			return nil, ErrDomainTooLong
+		}
 		host = make([]byte, domainLen)
 		if _, err := io.ReadFull(r, host); err != nil {
 			return nil, err
@@ -133,6 +147,10 @@ func ParseAddress(s string) (*Address, error) {
 	
 	ip := net.ParseIP(h)
 	if ip == nil {
+		// The length of a domain name is encoded in a single byte.
+		if len(h) > MaxDomainLength {
+			return nil, fmt.Errorf("%w: %d bytes, want at most %d", ErrDomainTooLong, len(h), MaxDomainLength)
+		}
 		host = []byte(h)
 		atyp = AtypDomainName
 	} else if ipv4 := ip.To4(); ipv4 != nil {
@@ -201,3 +219,21 @@ func ReadAddressFromBytes(b []byte) (*Address, error) {
 		Port: port,
 	}, nil
 }
+
+var ErrSelfTarget = errors.New("address: target is the proxy itself")
+
+// IsSelfTarget reports whether target is exactly the host:port server, the
+// shadowsocks server the proxy forwards to, so that relaying to it would
+// loop. Other names or addresses of the same host are not recognized, since
+// only the server knows what they reach.
+//
+// The listen address of the inbound is deliberately not compared: targets
+// are dialed by the server, so 127.0.0.1:5432 behind a listener on
+// 127.0.0.1:5432 is a service on the server host, not kage itself.
+func IsSelfTarget(target *Address, server string) bool {
+	addr, err := ParseAddress(server)
+	if err != nil {
+		return false
+	}
+	return addr.Type == target.Type && addr.Port == target.Port && bytes.EqualFold(addr.Host, target.Host)
+}
@@ -0,0 +1,58 @@
+package core
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestIsSelfTarget(t *testing.T) {
+	tests := []struct {
+		target, server string
+		want           bool
+	}{
+		{"203.0.113.7:8388", "203.0.113.7:8388", true},
+		{"Proxy.Example.com:8388", "proxy.example.com:8388", true},
+		{"[2001:db8::1]:8388", "[2001:db8::1]:8388", true},
+		{"203.0.113.7:443", "203.0.113.7:8388", false},
+		// Only the server can tell what other names and addresses reach.
+		{"127.0.0.1:8388", "localhost:8388", false},
+		{"localhost:8388", "0.0.0.0:8388", false},
+		{"203.0.113.7:8388", "proxy.example.com:8388", false},
+		// Loopback targets are on the server host, whatever kage listens on.
+		{"127.0.0.1:1080", "203.0.113.7:8388", false},
+	}
+	for _, tt := range tests {
+		target, err := ParseAddress(tt.target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := IsSelfTarget(target, tt.server); got != tt.want {
+			t.Errorf("IsSelfTarget(%s, %s) = %v, want %v", tt.target, tt.server, got, tt.want)
+		}
+	}
+}
+
+func TestParseAddressDomainLength(t *testing.T) {
+	for _, n := range []int{1, MaxDomainLength, MaxDomainLength + 1, 300} {
+		domain := strings.Repeat("a", n)
+		addr, err := ParseAddress(domain + ":443")
+		if n > MaxDomainLength {
+			if !errors.Is(err, ErrDomainTooLong) {
+				t.Errorf("%d byte domain: ParseAddress = %v, want ErrDomainTooLong", n, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%d byte domain: %v", n, err)
+		}
+		// The encoded address reads back whole.
+		back, err := ReadAddressFromBytes(addr.Bytes())
+		if err != nil {
+			t.Fatalf("%d byte domain: read back: %v", n, err)
+		}
+		if back.String() != addr.String() {
+			t.Errorf("%d byte domain: read back %q, want %q", n, back, addr)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package core
+
+import (
+	"errors"
+	"math/rand/v2"
+	"strings"
+	"time"
+)
+
+var ErrUnknownJitter = errors.New("backoff: unknown jitter mode")
+
+type Jitter int32
+
+const (
+	// JitterNone doubles the delay on every retry.
+	JitterNone Jitter = iota
+	// JitterFull waits a random time between Min and the doubled delay.
+	JitterFull
+	// JitterDecorrelated waits a random time between Min and three times the
+	// previous delay.
+	JitterDecorrelated
+)
+
+func ParseJitter(s string) (Jitter, error) {
+	switch strings.ToLower(s) {
+	case "", "none":
+		return JitterNone, nil
+	case "full":
+		return JitterFull, nil
+	case "decorrelated":
+		return JitterDecorrelated, nil
+	default:
+		return 0, ErrUnknownJitter
+	}
+}
+
+// Backoff computes exponentially growing retry delays between Min and Max.
+// The zero value must be given Min and Max before use.
+type Backoff struct {
+	Min, Max time.Duration
+	// Jitter randomizes the delays, so that clients losing the server at the
+	// same time do not retry in lockstep.
+	Jitter Jitter
+	
+	cur time.Duration
+}
+
+// Next returns the delay before the next retry.
+func (b *Backoff) Next() time.Duration {
+	switch b.Jitter {
+	case JitterFull:
+		b.cur = min(max(2*b.cur, b.Min), b.Max)
+		return b.Min + rand.N(b.cur-b.Min+1)
+	case JitterDecorrelated:
+		upper := min(max(3*b.cur, b.Min), b.Max)
+		b.cur = b.Min + rand.N(upper-b.Min+1)
+		return b.cur
+	default:
+		b.cur = min(max(2*b.cur, b.Min), b.Max)
+		return b.cur
+	}
+}
+
+// Reset starts the next series of retries from Min again.
+func (b *Backoff) Reset() {
+	b.cur = 0
+}
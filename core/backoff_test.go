@@ -0,0 +1,59 @@
+package core
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestBackoffNone(t *testing.T) {
+	b := Backoff{Min: time.Millisecond, Max: 10 * time.Millisecond}
+	want := []time.Duration{1, 2, 4, 8, 10, 10}
+	for range 2 {
+		var got []time.Duration
+		for range want {
+			got = append(got, b.Next()/time.Millisecond)
+		}
+		if !slices.Equal(got, want) {
+			t.Fatalf("delays %v ms, want %v ms", got, want)
+		}
+		// Reset restarts the sequence from Min.
+		b.Reset()
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	const lo, hi = time.Millisecond, 100 * time.Millisecond
+	for _, jitter := range []Jitter{JitterFull, JitterDecorrelated} {
+		b := Backoff{Min: lo, Max: hi, Jitter: jitter}
+		seen := make(map[time.Duration]bool)
+		for i := range 1000 {
+			d := b.Next()
+			if d < lo || d > hi {
+				t.Fatalf("jitter %d: delay %v out of [%v, %v]", jitter, d, lo, hi)
+			}
+			seen[d] = true
+			if i%20 == 19 {
+				b.Reset()
+				// The first delay after Reset starts from Min again.
+				if d := b.Next(); d != lo {
+					t.Fatalf("jitter %d: first delay after Reset %v, want %v", jitter, d, lo)
+				}
+			}
+		}
+		if len(seen) < 10 {
+			t.Errorf("jitter %d: only %d distinct delays in 1000 retries", jitter, len(seen))
+		}
+	}
+}
+
+func TestParseJitter(t *testing.T) {
+	for s, want := range map[string]Jitter{"": JitterNone, "none": JitterNone, "Full": JitterFull, "decorrelated": JitterDecorrelated} {
+		if got, err := ParseJitter(s); err != nil || got != want {
+			t.Errorf("ParseJitter(%q) = %v, %v, want %v", s, got, err, want)
+		}
+	}
+	if _, err := ParseJitter("random"); err != ErrUnknownJitter {
+		t.Errorf("ParseJitter of an unknown mode = %v, want ErrUnknownJitter", err)
+	}
+}
@@ -0,0 +1,21 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+var ErrPacketListener = errors.New("listener: not a stream listener")
+
+// CheckStreamListener reports a listener whose address belongs to a packet
+// network, such as udp or unixgram, which cannot carry the TCP inbounds.
+// Unknown networks, like those of in-memory listeners, are accepted.
+func CheckStreamListener(ln net.Listener) error {
+	network := ln.Addr().Network()
+	if strings.HasPrefix(network, "udp") || strings.HasPrefix(network, "ip") || network == "unixgram" {
+		return fmt.Errorf("%w: %s", ErrPacketListener, network)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrUnknownTargetLogMode = errors.New("log: unknown target log mode")
+
+type TargetLogMode int32
+
+const (
+	// TargetLogFull logs the target as given.
+	TargetLogFull TargetLogMode = iota
+	// TargetLogDomain logs only the last two labels of a domain name, which
+	// approximates the registrable domain. IP addresses are kept as is.
+	TargetLogDomain
+	// TargetLogNone logs a short hash of the target host instead of the host.
+	TargetLogNone
+)
+
+func ParseTargetLogMode(s string) (TargetLogMode, error) {
+	switch strings.ToLower(s) {
+	case "", "full":
+		return TargetLogFull, nil
+	case "domain":
+		return TargetLogDomain, nil
+	case "none":
+		return TargetLogNone, nil
+	default:
+		return 0, ErrUnknownTargetLogMode
+	}
+}
+
+// Attr returns the "target" log attribute for a host:port or URL, reduced
+// according to mode.
+func (mode TargetLogMode) Attr(target string) slog.Attr {
+	if mode == TargetLogFull {
+		return slog.String("target", target)
+	}
+	
+	host := target
+	if u, err := url.Parse(target); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	
+	if mode == TargetLogNone {
+		sum := sha256.Sum256([]byte(host))
+		return slog.String("target", hex.EncodeToString(sum[:4]))
+	}
+	
+	if net.ParseIP(host) == nil {
+		labels := strings.Split(strings.TrimSuffix(host, "."), ".")
+		if len(labels) > 2 {
+			host = strings.Join(labels[len(labels)-2:], ".")
+		}
+	}
+	return slog.String("target", host)
+}
+
+// TargetAttr returns the "target" log attribute for target, reduced
+// according to the TargetLog mode of r. A nil r logs it in full.
+func (r *Relayer) TargetAttr(target string) slog.Attr {
+	return r.TargetLogMode().Attr(target)
+}
+
+// TargetLogMode returns the TargetLog mode of r, TargetLogFull for a nil r.
+func (r *Relayer) TargetLogMode() TargetLogMode {
+	if r == nil {
+		return TargetLogFull
+	}
+	return r.TargetLog
+}
+
+// SampleConn reports whether the summary lines of a new connection should be
+// logged, picking one connection out of every LogSampleRate. Errors are not
+// subject to sampling and are always logged. A nil r logs every connection.
+func (r *Relayer) SampleConn() bool {
+	if r == nil || r.LogSampleRate <= 1 {
+		return true
+	}
+	return r.connLogCount.Add(1)%uint64(r.LogSampleRate) == 1
+}
+
+const defaultLogLimitInterval = 10 * time.Second
+
+// LogLimiter lets one log record through per Interval and counts the ones
+// it holds back, for errors that would otherwise repeat once per connection
+// or packet. Zero Interval means 10 seconds. The zero value is ready to use.
+type LogLimiter struct {
+	Interval time.Duration
+	
+	mu         sync.Mutex
+	next       time.Time
+	suppressed int
+}
+
+// Allow reports whether a record may be logged at now and, if so, how many
+// were held back since the previous one.
+func (l *LogLimiter) Allow(now time.Time) (bool, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Before(l.next) {
+		l.suppressed++
+		return false, 0
+	}
+	interval := l.Interval
+	if interval <= 0 {
+		interval = defaultLogLimitInterval
+	}
+	l.next = now.Add(interval)
+	suppressed := l.suppressed
+	l.suppressed = 0
+	return true, suppressed
+}
@@ -0,0 +1,95 @@
+package core
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestLogLimiter(t *testing.T) {
+	l := &LogLimiter{Interval: time.Minute}
+	start := time.Now()
+	
+	if ok, _ := l.Allow(start); !ok {
+		t.Fatal("first record held back")
+	}
+	for i := 1; i <= 5; i++ {
+		if ok, _ := l.Allow(start.Add(time.Duration(i) * time.Second)); ok {
+			t.Fatalf("record %d within the interval let through", i)
+		}
+	}
+	ok, suppressed := l.Allow(start.Add(time.Minute))
+	if !ok || suppressed != 5 {
+		t.Fatalf("Allow after the interval = %v, %d, want true, 5", ok, suppressed)
+	}
+	if ok, _ := l.Allow(start.Add(time.Minute + time.Second)); ok {
+		t.Fatal("interval not restarted")
+	}
+}
+
+func TestTargetAttr(t *testing.T) {
+	tests := []struct {
+		mode   TargetLogMode
+		target string
+		want   string
+	}{
+		{TargetLogFull, "www.example.com:443", "www.example.com:443"},
+		{TargetLogDomain, "www.example.com:443", "example.com"},
+		{TargetLogDomain, "a.b.example.com.:443", "example.com"},
+		{TargetLogDomain, "example.com:443", "example.com"},
+		{TargetLogDomain, "203.0.113.1:443", "203.0.113.1"},
+		{TargetLogDomain, "[2001:db8::1]:443", "2001:db8::1"},
+		{TargetLogDomain, "http://www.example.com/path?q=1", "example.com"},
+		{TargetLogNone, "www.example.com:443", "80fc0fb9"},
+		// Only the host is hashed, so every port of a host logs the same.
+		{TargetLogNone, "www.example.com:80", "80fc0fb9"},
+	}
+	for _, tt := range tests {
+		r := &Relayer{TargetLog: tt.mode}
+		if got := r.TargetAttr(tt.target); got.Key != "target" || got.Value.String() != tt.want {
+			t.Errorf("mode %d: TargetAttr(%q) = %v, want target=%s", tt.mode, tt.target, got, tt.want)
+		}
+	}
+	
+	var r *Relayer
+	if got := r.TargetAttr("www.example.com:443"); got.Value.String() != "www.example.com:443" {
+		t.Errorf("nil Relayer: TargetAttr = %v, want the full target", got)
+	}
+}
+
+func TestSampleConn(t *testing.T) {
+	count := func(r *Relayer, n int) int {
+		sampled := 0
+		for range n {
+			if r.SampleConn() {
+				sampled++
+			}
+		}
+		return sampled
+	}
+	
+	if n := count(nil, 10); n != 10 {
+		t.Errorf("nil Relayer: %d of 10 connections sampled, want all", n)
+	}
+	for _, rate := range []int{0, 1, -5} {
+		if n := count(&Relayer{LogSampleRate: rate}, 10); n != 10 {
+			t.Errorf("LogSampleRate %d: %d of 10 connections sampled, want all", rate, n)
+		}
+	}
+	
+	// The first connection is always logged, then one in every rate.
+	r := &Relayer{LogSampleRate: 3}
+	var got []bool
+	for range 7 {
+		got = append(got, r.SampleConn())
+	}
+	if want := []bool{true, false, false, true, false, false, true}; !slices.Equal(got, want) {
+		t.Fatalf("SampleConn with rate 3 = %v, want %v", got, want)
+	}
+	
+	// Relayers sample independently.
+	a, b := &Relayer{LogSampleRate: 2}, &Relayer{LogSampleRate: 2}
+	if !a.SampleConn() || !b.SampleConn() {
+		t.Fatal("first connection of each Relayer not sampled")
+	}
+}
@@ -0,0 +1,37 @@
+package core
+
+import "io"
+
+// interactiveWriteSize is the average write size below which a connection is
+// taken for interactive traffic.
+const interactiveWriteSize = 1024
+
+type noDelaySetter interface {
+	SetNoDelay(noDelay bool) error
+}
+
+// adaptiveWriter tracks a moving average of the write sizes and sets the
+// no-delay option of conn when the average crosses interactiveWriteSize.
+type adaptiveWriter struct {
+	io.Writer
+	conn    noDelaySetter
+	avg     int
+	noDelay bool
+}
+
+func newAdaptiveWriter(w io.Writer, conn any) io.Writer {
+	s, ok := conn.(noDelaySetter)
+	if !ok {
+		return w
+	}
+	return &adaptiveWriter{Writer: w, conn: s, noDelay: true}
+}
+
+func (w *adaptiveWriter) Write(p []byte) (int, error) {
+	w.avg = (7*w.avg + len(p)) / 8
+	if noDelay := w.avg < interactiveWriteSize; noDelay != w.noDelay {
+		w.noDelay = noDelay
+		w.conn.SetNoDelay(noDelay)
+	}
+	return w.Writer.Write(p)
+}
@@ -0,0 +1,86 @@
+package core
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// noDelayConn records the no-delay option, which Go turns on for every TCP
+// connection.
+type noDelayConn struct {
+	noDelay bool
+	sets    int
+}
+
+func (c *noDelayConn) SetNoDelay(noDelay bool) error {
+	c.noDelay = noDelay
+	c.sets++
+	return nil
+}
+
+// sizes returns count write sizes of n bytes.
+func sizes(count, n int) []int {
+	s := make([]int, count)
+	for i := range s {
+		s[i] = n
+	}
+	return s
+}
+
+func TestAdaptiveWriter(t *testing.T) {
+	tests := []struct {
+		name    string
+		writes  []int
+		noDelay bool
+	}{
+		{"interactive", []int{1, 64, 200, 3, 512, 80}, true},
+		{"bulk", sizes(4, 32<<10), false},
+		{"bulk then interactive", append(sizes(2, 32<<10), sizes(40, 100)...), true},
+		{"interactive then bulk", append(sizes(40, 100), sizes(4, 32<<10)...), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &noDelayConn{noDelay: true}
+			var buf bytes.Buffer
+			w := newAdaptiveWriter(&buf, conn)
+			total := 0
+			for _, n := range tt.writes {
+				if _, err := w.Write(make([]byte, n)); err != nil {
+					t.Fatal(err)
+				}
+				total += n
+			}
+			if conn.noDelay != tt.noDelay {
+				t.Errorf("no-delay = %v, want %v", conn.noDelay, tt.noDelay)
+			}
+			if buf.Len() != total {
+				t.Errorf("wrote %d bytes, want %d", buf.Len(), total)
+			}
+		})
+	}
+}
+
+func TestAdaptiveWriterSetsOnChange(t *testing.T) {
+	conn := &noDelayConn{noDelay: true}
+	w := newAdaptiveWriter(io.Discard, conn)
+	for range 100 {
+		w.Write(make([]byte, 16))
+	}
+	if conn.sets != 0 {
+		t.Fatalf("interactive traffic set the option %d times, want none", conn.sets)
+	}
+	for range 100 {
+		w.Write(make([]byte, 16<<10))
+	}
+	if conn.sets != 1 || conn.noDelay {
+		t.Fatalf("bulk traffic set the option %d times to %v, want once to false", conn.sets, conn.noDelay)
+	}
+}
+
+func TestAdaptiveWriterNoSetter(t *testing.T) {
+	var buf bytes.Buffer
+	if w := newAdaptiveWriter(&buf, &buf); w != io.Writer(&buf) {
+		t.Fatalf("newAdaptiveWriter wrapped a connection without SetNoDelay: %T", w)
+	}
+}
@@ -0,0 +1,59 @@
+package core
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"sync/atomic"
+)
+
+var ErrQuotaExceeded = errors.New("quota: data quota exceeded")
+
+// Quota limits the bytes relayed in both directions over the lifetime of a
+// proxy instance, whose inbounds share it. A nil *Quota imposes no limit.
+type Quota struct {
+	// Limit is the number of bytes. Zero disables the limit.
+	Limit uint64
+	// CloseActive stops connections that are already relaying as soon as
+	// the quota is reached; otherwise only new connections are refused.
+	CloseActive bool
+	
+	used     atomic.Uint64
+	reported atomic.Bool
+}
+
+// Exceeded reports whether new connections have to be refused.
+func (q *Quota) Exceeded() bool {
+	return q != nil && q.Limit > 0 && q.used.Load() >= q.Limit
+}
+
+// Count adds n relayed bytes to the quota. It returns ErrQuotaExceeded once
+// active connections have to stop.
+func (q *Quota) Count(n int) error {
+	if q == nil || q.Limit == 0 {
+		return nil
+	}
+	if q.used.Add(uint64(n)) < q.Limit {
+		return nil
+	}
+	if q.reported.CompareAndSwap(false, true) {
+		slog.Warn("data quota exceeded, refusing new connections", "quota", q.Limit)
+	}
+	if q.CloseActive {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+type quotaWriter struct {
+	io.Writer
+	quota *Quota
+}
+
+func (w quotaWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if err == nil {
+		err = w.quota.Count(n)
+	}
+	return n, err
+}
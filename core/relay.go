@@ -2,8 +2,16 @@ package core
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"kage/internal/bufpool"
+	"log/slog"
 	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 	
 	"golang.org/x/sync/errgroup"
 )
@@ -12,22 +20,236 @@ type HalfCloser interface {
 	CloseWrite() error
 }
 
-func TCPRelay(ctx context.Context, client, server net.Conn) error {
+var ErrUnknownRelayStrategy = errors.New("relay: unknown strategy")
+
+// errMaxLifetime is the cancel cause of a relay stopped by MaxConnLifetime.
+var errMaxLifetime = errors.New("relay: max connection lifetime reached")
+
+// CloseReason tells why a relay ended.
+type CloseReason int
+
+const (
+	// CloseReasonEOF means both sides finished sending.
+	CloseReasonEOF CloseReason = iota
+	// CloseReasonTimeout means a read or write deadline expired.
+	CloseReasonTimeout
+	// CloseReasonCanceled means the context of the relay was cancelled,
+	// usually by shutdown.
+	CloseReasonCanceled
+	// CloseReasonError means a read or write failed on either side, for
+	// example because the peer reset the connection.
+	CloseReasonError
+	// CloseReasonQuota means the data quota was exceeded, see Quota.
+	CloseReasonQuota
+	// CloseReasonLifetime means the connection reached
+	// Relayer.MaxConnLifetime.
+	CloseReasonLifetime
+)
+
+func (r CloseReason) String() string {
+	switch r {
+	case CloseReasonEOF:
+		return "eof"
+	case CloseReasonTimeout:
+		return "timeout"
+	case CloseReasonCanceled:
+		return "canceled"
+	case CloseReasonError:
+		return "error"
+	case CloseReasonQuota:
+		return "quota"
+	case CloseReasonLifetime:
+		return "lifetime"
+	default:
+		return fmt.Sprintf("CloseReason(%d)", int(r))
+	}
+}
+
+// RelayResult describes a finished relay.
+type RelayResult struct {
+	// Up and Down are the bytes relayed to the server and to the client.
+	Up   int64
+	Down int64
+	// Reason is why the relay ended, Err the error TCPRelay returns.
+	Reason CloseReason
+	Err    error
+}
+
+type RelayStrategy int32
+
+const (
+	// RelayBuffered copies with io.Copy and its default 32 KiB buffer.
+	RelayBuffered RelayStrategy = iota
+	// RelaySmall copies through a 4 KiB buffer, which keeps chunks small for
+	// interactive traffic.
+	RelaySmall
+)
+
+const smallRelayBufferSize = 4 * 1024
+
+func ParseRelayStrategy(s string) (RelayStrategy, error) {
+	switch s {
+	case "", "buffered":
+		return RelayBuffered, nil
+	case "small":
+		return RelaySmall, nil
+	default:
+		return 0, fmt.Errorf("%w: %q", ErrUnknownRelayStrategy, s)
+	}
+}
+
+// Relayer relays the TCP connections of one proxy instance with its
+// settings, and keeps track of them for Wait. The inbounds of an instance
+// share one Relayer. A nil *Relayer relays with the zero settings.
+type Relayer struct {
+	// Strategy selects how data is copied.
+	Strategy RelayStrategy
+	// CloseGrace delays the forced close of relayed connections by up to
+	// this long when their context is cancelled, so that transfers in
+	// flight can finish. Zero closes them immediately.
+	CloseGrace time.Duration
+	// MaxConnLifetime closes relayed connections this long after they
+	// started, even while data is still flowing, so that clients have to
+	// reconnect and pick up a fresh handshake and route. Zero disables the
+	// limit.
+	MaxConnLifetime time.Duration
+	// AdaptiveNoDelay switches Nagle's algorithm per connection: off while
+	// writes are small, as for interactive sessions, and on while they are
+	// large, as for bulk transfers. When disabled, Go's default of no delay
+	// is kept.
+	AdaptiveNoDelay bool
+	// Quota, when set, counts the relayed bytes, see Quota.CloseActive.
+	Quota *Quota
+	// Tracer, when set, traces every connection, see StartConnSpan.
+	Tracer Tracer
+	// TargetLog reduces the targets the inbounds log and set on spans, see
+	// TargetAttr.
+	TargetLog TargetLogMode
+	// LogSampleRate makes the inbounds log the summary lines of one
+	// connection out of every LogSampleRate, see SampleConn. Values below 2
+	// log every connection.
+	LogSampleRate int
+	connLogCount  atomic.Uint64
+	
+	// mu orders the relays.Add of a starting relay against the relays.Wait
+	// of Wait, which a WaitGroup requires.
+	mu     sync.Mutex
+	closed bool
+	relays sync.WaitGroup
+}
+
+// QuotaExceeded reports whether new connections have to be refused.
+func (r *Relayer) QuotaExceeded() bool {
+	return r != nil && r.Quota.Exceeded()
+}
+
+func (r *Relayer) copy(dst io.Writer, src io.Reader) (int64, error) {
+	if r.Strategy == RelaySmall {
+		buf := bufpool.Get(smallRelayBufferSize)
+		defer bufpool.Put(buf)
+		// Hide ReaderFrom and WriterTo so that the buffer is actually used.
+		return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, buf)
+	}
+	return io.Copy(dst, src)
+}
+
+// Wait blocks until every running relay has returned. Relays that would
+// start afterwards, e.g. from a handshake that was still in progress, close
+// their connections at once instead.
+func (r *Relayer) Wait() {
+	r.mu.Lock()
+	r.closed = true
+	r.mu.Unlock()
+	r.relays.Wait()
+}
+
+// start registers a relay with Wait. It reports false once Wait was called.
+func (r *Relayer) start() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return false
+	}
+	r.relays.Add(1)
+	return true
+}
+
+// TCPRelay copies data between client and server until both directions are
+// done or ctx is cancelled, and closes both connections.
+func (r *Relayer) TCPRelay(ctx context.Context, client, server net.Conn) error {
+	return r.Relay(ctx, client, server).Err
+}
+
+// Relay is TCPRelay, but also reports the relayed bytes and why the relay
+// ended. The reason is recorded on the connection span as well.
+func (r *Relayer) Relay(ctx context.Context, client, server net.Conn) RelayResult {
+	if r == nil {
+		r = new(Relayer)
+	}
+	if !r.start() {
+		client.Close()
+		server.Close()
+		return RelayResult{Reason: CloseReasonCanceled, Err: context.Canceled}
+	}
+	defer r.relays.Done()
+	
 	var errGroup errgroup.Group
+	parent := ctx
+	span := connSpanFromContext(ctx)
+	
+	var toClient, toServer io.Writer = client, server
+	if r.Quota != nil && r.Quota.Limit > 0 {
+		toClient, toServer = quotaWriter{client, r.Quota}, quotaWriter{server, r.Quota}
+	}
+	if r.AdaptiveNoDelay {
+		toClient, toServer = newAdaptiveWriter(toClient, client), newAdaptiveWriter(toServer, server)
+	}
 	
-	ctx, cancel := context.WithCancel(ctx)
+	ctx, cancelCause := context.WithCancelCause(ctx)
+	cancel := func() { cancelCause(nil) }
 	defer cancel()
 	
+	if lifetime := r.MaxConnLifetime; lifetime > 0 {
+		timer := time.AfterFunc(lifetime, func() {
+			slog.Debug("closing connection at max_conn_lifetime", "client", client.RemoteAddr(), "lifetime", lifetime)
+			cancelCause(errMaxLifetime)
+		})
+		defer timer.Stop()
+	}
+	
 	halfClosed := make(chan struct{}, 2)
 	defer close(halfClosed)
+	copiesDone := make(chan struct{})
 	go func() {
 		<-halfClosed
 		<-halfClosed
+		close(copiesDone)
 		cancel()
 	}()
 	
+	// failure keeps the first copy error that happened before the relay
+	// was stopped; errors after that come from closing the connections.
+	var (
+		failureOnce sync.Once
+		failure     error
+	)
+	fail := func(err error) {
+		if err != nil && ctx.Err() == nil {
+			failureOnce.Do(func() { failure = err })
+		}
+	}
+	var result RelayResult
+	
 	errGroup.Go(func() error {
 		<-ctx.Done()
+		if grace := r.CloseGrace; grace > 0 && parent.Err() != nil {
+			timer := time.NewTimer(grace)
+			select {
+			case <-timer.C:
+			case <-copiesDone:
+			}
+			timer.Stop()
+		}
 		client.Close()
 		server.Close()
 		return ctx.Err()
@@ -35,7 +257,10 @@ func TCPRelay(ctx context.Context, client, server net.Conn) error {
 	
 	// server → client
 	errGroup.Go(func() error {
-		_, err := io.Copy(client, server)
+		n, err := r.copy(toClient, server)
+		span.addDown(n)
+		result.Down = n
+		fail(err)
 		if conn, ok := client.(HalfCloser); ok {
 			conn.CloseWrite()
 		} else {
@@ -47,7 +272,10 @@ func TCPRelay(ctx context.Context, client, server net.Conn) error {
 	
 	// client → server
 	errGroup.Go(func() error {
-		_, err := io.Copy(server, client)
+		n, err := r.copy(toServer, client)
+		span.addUp(n)
+		result.Up = n
+		fail(err)
 		if conn, ok := server.(HalfCloser); ok {
 			conn.CloseWrite()
 		} else {
@@ -57,5 +285,29 @@ func TCPRelay(ctx context.Context, client, server net.Conn) error {
 		return err
 	})
 	
-	return errGroup.Wait()
+	result.Err = errGroup.Wait()
+	switch {
+	case context.Cause(ctx) == errMaxLifetime:
+		result.Reason = CloseReasonLifetime
+	case parent.Err() != nil:
+		result.Reason = CloseReasonCanceled
+	case failure != nil:
+		result.Reason = failureReason(failure)
+	default:
+		result.Reason = CloseReasonEOF
+	}
+	span.SetAttributes(slog.String("close_reason", result.Reason.String()))
+	return result
+}
+
+func failureReason(err error) CloseReason {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrQuotaExceeded):
+		return CloseReasonQuota
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return CloseReasonTimeout
+	default:
+		return CloseReasonError
+	}
 }
@@ -0,0 +1,338 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// tcpPair returns the two ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	a, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := <-accepted
+	if b == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return a, b
+}
+
+// relayPair starts a relay by r between two connections and returns the
+// peers of its client and server side, and the channel its result arrives
+// on.
+func relayPair(t *testing.T, ctx context.Context, r *Relayer) (net.Conn, net.Conn, <-chan RelayResult) {
+	t.Helper()
+	client, clientPeer := tcpPair(t)
+	server, serverPeer := tcpPair(t)
+	done := make(chan RelayResult, 1)
+	go func() { done <- r.Relay(ctx, client, server) }()
+	return clientPeer, serverPeer, done
+}
+
+func TestRelayCloseGrace(t *testing.T) {
+	const grace = 300 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	clientPeer, serverPeer, done := relayPair(t, ctx, &Relayer{CloseGrace: grace})
+	cancel()
+	start := time.Now()
+	
+	// The transfer still goes through while the grace period runs.
+	time.Sleep(grace / 3)
+	if _, err := clientPeer.Write([]byte("late")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	serverPeer.SetReadDeadline(time.Now().Add(grace))
+	if _, err := io.ReadFull(serverPeer, buf); err != nil {
+		t.Fatalf("write during the grace period was not relayed: %v", err)
+	}
+	
+	select {
+	case result := <-done:
+		if elapsed := time.Since(start); elapsed < grace {
+			t.Fatalf("relay closed after %v, before the %v grace period", elapsed, grace)
+		}
+		if result.Reason != CloseReasonCanceled {
+			t.Fatalf("Reason = %v, want %v", result.Reason, CloseReasonCanceled)
+		}
+	case <-time.After(grace + time.Second):
+		t.Fatal("relay not closed after the grace period")
+	}
+}
+
+func TestRelayCloseGraceCopiesDone(t *testing.T) {
+	const grace = 5 * time.Second
+	ctx, cancel := context.WithCancel(context.Background())
+	clientPeer, serverPeer, done := relayPair(t, ctx, &Relayer{CloseGrace: grace})
+	cancel()
+	
+	// Both sides finishing ends the relay without waiting out the grace.
+	clientPeer.(*net.TCPConn).CloseWrite()
+	serverPeer.(*net.TCPConn).CloseWrite()
+	select {
+	case <-done:
+	case <-time.After(grace / 2):
+		t.Fatal("relay waited for the grace period after both sides finished")
+	}
+}
+
+func TestRelayMaxConnLifetime(t *testing.T) {
+	const lifetime = 300 * time.Millisecond
+	clientPeer, serverPeer, done := relayPair(t, context.Background(), &Relayer{MaxConnLifetime: lifetime})
+	start := time.Now()
+	
+	// Data keeps flowing until the relay closes the connections.
+	go func() {
+		chunk := make([]byte, 1024)
+		for {
+			if _, err := clientPeer.Write(chunk); err != nil {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	go io.Copy(io.Discard, serverPeer)
+	
+	select {
+	case result := <-done:
+		if elapsed := time.Since(start); elapsed < lifetime {
+			t.Fatalf("relay closed after %v, before the %v lifetime", elapsed, lifetime)
+		}
+		if result.Reason != CloseReasonLifetime {
+			t.Fatalf("Reason = %v, want %v", result.Reason, CloseReasonLifetime)
+		}
+		if result.Up == 0 {
+			t.Fatal("nothing was relayed before the lifetime")
+		}
+	case <-time.After(lifetime + time.Second):
+		t.Fatal("active relay not closed at its lifetime")
+	}
+	clientPeer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := clientPeer.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("client connection not closed: %v", err)
+	}
+}
+
+func TestRelayAfterWait(t *testing.T) {
+	r := &Relayer{}
+	r.Wait()
+	
+	_, serverPeer, done := relayPair(t, context.Background(), r)
+	select {
+	case result := <-done:
+		if result.Reason != CloseReasonCanceled {
+			t.Fatalf("Reason = %v, want %v", result.Reason, CloseReasonCanceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("relay started after Wait")
+	}
+	serverPeer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := serverPeer.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("server connection not closed: %v", err)
+	}
+}
+
+func TestRelayerQuotaPerInstance(t *testing.T) {
+	limited := &Relayer{Quota: &Quota{Limit: 4, CloseActive: true}}
+	clientPeer, serverPeer, done := relayPair(t, context.Background(), limited)
+	go func() {
+		// The server finishes once the client side is half-closed.
+		io.Copy(io.Discard, serverPeer)
+		serverPeer.Close()
+	}()
+	clientPeer.Write([]byte("0123456789"))
+	select {
+	case result := <-done:
+		if result.Reason != CloseReasonQuota {
+			t.Fatalf("Reason = %v, want %v", result.Reason, CloseReasonQuota)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay not stopped by the quota")
+	}
+	if !limited.QuotaExceeded() {
+		t.Error("QuotaExceeded = false after the quota was used up")
+	}
+	
+	// Another instance in the same process has its own quota.
+	var other Relayer
+	if other.QuotaExceeded() {
+		t.Error("the quota of one Relayer applies to another")
+	}
+	otherClient, otherServer, _ := relayPair(t, context.Background(), &other)
+	otherClient.Write([]byte("0123456789"))
+	otherServer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(otherServer, make([]byte, 10)); err != nil {
+		t.Fatalf("relay of another Relayer stopped: %v", err)
+	}
+}
+
+// relayResult waits for the result of a relay.
+func relayResult(t *testing.T, done <-chan RelayResult) RelayResult {
+	t.Helper()
+	select {
+	case result := <-done:
+		return result
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay did not end")
+		return RelayResult{}
+	}
+}
+
+func TestRelayerTimeoutsPerInstance(t *testing.T) {
+	const short, long = 100 * time.Millisecond, 600 * time.Millisecond
+	start := time.Now()
+	_, _, shortDone := relayPair(t, context.Background(), &Relayer{MaxConnLifetime: short})
+	_, _, longDone := relayPair(t, context.Background(), &Relayer{MaxConnLifetime: long})
+	
+	if result := relayResult(t, shortDone); result.Reason != CloseReasonLifetime {
+		t.Fatalf("short relay Reason = %v, want %v", result.Reason, CloseReasonLifetime)
+	}
+	if elapsed := time.Since(start); elapsed >= long {
+		t.Fatalf("short relay ended after %v, not at its own %v lifetime", elapsed, short)
+	}
+	select {
+	case result := <-longDone:
+		t.Fatalf("long relay ended with the short one: %v", result.Reason)
+	default:
+	}
+	
+	if result := relayResult(t, longDone); result.Reason != CloseReasonLifetime {
+		t.Fatalf("long relay Reason = %v, want %v", result.Reason, CloseReasonLifetime)
+	}
+	if elapsed := time.Since(start); elapsed < long {
+		t.Fatalf("long relay ended after %v, before its %v lifetime", elapsed, long)
+	}
+}
+
+func TestRelayCloseReasonTimeout(t *testing.T) {
+	client, _ := tcpPair(t)
+	server, serverPeer := tcpPair(t)
+	// The client never sends, so reading from it runs into its deadline.
+	client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	done := make(chan RelayResult, 1)
+	go func() { done <- (&Relayer{}).Relay(context.Background(), client, server) }()
+	go func() {
+		io.Copy(io.Discard, serverPeer)
+		serverPeer.Close()
+	}()
+	
+	result := relayResult(t, done)
+	if result.Reason != CloseReasonTimeout {
+		t.Fatalf("Reason = %v, want %v", result.Reason, CloseReasonTimeout)
+	}
+	if result.Reason.String() != "timeout" {
+		t.Errorf("String() = %q, want %q", result.Reason.String(), "timeout")
+	}
+}
+
+func TestRelayCloseReason(t *testing.T) {
+	t.Run("eof", func(t *testing.T) {
+		clientPeer, serverPeer, done := relayPair(t, context.Background(), nil)
+		clientPeer.(*net.TCPConn).CloseWrite()
+		serverPeer.(*net.TCPConn).CloseWrite()
+		if result := relayResult(t, done); result.Reason != CloseReasonEOF {
+			t.Fatalf("Reason = %v, want %v", result.Reason, CloseReasonEOF)
+		}
+	})
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		_, _, done := relayPair(t, ctx, nil)
+		cancel()
+		if result := relayResult(t, done); result.Reason != CloseReasonCanceled {
+			t.Fatalf("Reason = %v, want %v", result.Reason, CloseReasonCanceled)
+		}
+	})
+	t.Run("lifetime", func(t *testing.T) {
+		_, _, done := relayPair(t, context.Background(), &Relayer{MaxConnLifetime: 50 * time.Millisecond})
+		if result := relayResult(t, done); result.Reason != CloseReasonLifetime {
+			t.Fatalf("Reason = %v, want %v", result.Reason, CloseReasonLifetime)
+		}
+	})
+}
+
+func TestParseRelayStrategy(t *testing.T) {
+	tests := []struct {
+		in   string
+		want RelayStrategy
+		err  error
+	}{
+		{"", RelayBuffered, nil},
+		{"buffered", RelayBuffered, nil},
+		{"small", RelaySmall, nil},
+		{"splice", 0, ErrUnknownRelayStrategy},
+		{"Small", 0, ErrUnknownRelayStrategy},
+	}
+	for _, tt := range tests {
+		got, err := ParseRelayStrategy(tt.in)
+		if !errors.Is(err, tt.err) || got != tt.want {
+			t.Errorf("ParseRelayStrategy(%q) = %v, %v, want %v, %v", tt.in, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestRelayStrategies(t *testing.T) {
+	up := bytes.Repeat([]byte("client to server "), 20000)
+	down := bytes.Repeat([]byte("server to client "), 30000)
+	for _, name := range []string{"buffered", "small"} {
+		t.Run(name, func(t *testing.T) {
+			strategy, err := ParseRelayStrategy(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			clientPeer, serverPeer, done := relayPair(t, context.Background(), &Relayer{Strategy: strategy})
+			
+			// Each peer sends its data and reads what the other one sent.
+			exchange := func(conn net.Conn, send []byte) <-chan []byte {
+				got := make(chan []byte, 1)
+				go func() {
+					conn.Write(send)
+					conn.(*net.TCPConn).CloseWrite()
+				}()
+				go func() {
+					data, _ := io.ReadAll(conn)
+					got <- data
+				}()
+				return got
+			}
+			gotUp := exchange(serverPeer, down)
+			gotDown := exchange(clientPeer, up)
+			
+			if data := <-gotUp; !bytes.Equal(data, up) {
+				t.Errorf("server got %d bytes, want the %d sent", len(data), len(up))
+			}
+			if data := <-gotDown; !bytes.Equal(data, down) {
+				t.Errorf("client got %d bytes, want the %d sent", len(data), len(down))
+			}
+			result := relayResult(t, done)
+			if result.Up != int64(len(up)) || result.Down != int64(len(down)) {
+				t.Errorf("relayed %d up and %d down, want %d and %d", result.Up, result.Down, len(up), len(down))
+			}
+			if result.Reason != CloseReasonEOF {
+				t.Errorf("Reason = %v, want %v", result.Reason, CloseReasonEOF)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package core
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+)
+
+// Tracer creates a span for every proxied connection. An implementation can
+// forward the spans to a tracing system such as OpenTelemetry.
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a single traced connection. SetAttributes may be called several
+// times before End.
+type Span interface {
+	SetAttributes(attrs ...slog.Attr)
+	End(err error)
+}
+
+type connSpanKey struct{}
+
+// ConnSpan wraps the Span of one connection and counts the bytes relayed by
+// Relayer.TCPRelay. A nil *ConnSpan is valid and does nothing.
+type ConnSpan struct {
+	span Span
+	up   atomic.Int64
+	down atomic.Int64
+}
+
+// StartConnSpan starts a span for a connection to target with the Tracer of
+// r. It returns a nil span and the unchanged ctx when r has no Tracer.
+func (r *Relayer) StartConnSpan(ctx context.Context, inbound, target string) (context.Context, *ConnSpan) {
+	if r == nil || r.Tracer == nil {
+		return ctx, nil
+	}
+	
+	ctx, span := r.Tracer.Start(ctx, inbound+" connection")
+	span.SetAttributes(slog.String("inbound", inbound), r.TargetAttr(target))
+	s := &ConnSpan{span: span}
+	return context.WithValue(ctx, connSpanKey{}, s), s
+}
+
+func connSpanFromContext(ctx context.Context) *ConnSpan {
+	s, _ := ctx.Value(connSpanKey{}).(*ConnSpan)
+	return s
+}
+
+func (s *ConnSpan) addUp(n int64) {
+	if s != nil {
+		s.up.Add(n)
+	}
+}
+
+func (s *ConnSpan) addDown(n int64) {
+	if s != nil {
+		s.down.Add(n)
+	}
+}
+
+// SetAttributes adds attrs to the span.
+func (s *ConnSpan) SetAttributes(attrs ...slog.Attr) {
+	if s != nil {
+		s.span.SetAttributes(attrs...)
+	}
+}
+
+// End records the relayed byte counts and ends the span.
+func (s *ConnSpan) End(err error) {
+	if s == nil {
+		return
+	}
+	s.span.SetAttributes(slog.Int64("bytes_up", s.up.Load()), slog.Int64("bytes_down", s.down.Load()))
+	s.span.End(err)
+}
@@ -0,0 +1,102 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+)
+
+// recordingTracer records the spans it starts.
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordedSpan struct {
+	name  string
+	attrs map[string]slog.Value
+	ended bool
+	err   error
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := &recordedSpan{name: name, attrs: make(map[string]slog.Value)}
+	t.spans = append(t.spans, s)
+	return ctx, &recordingSpan{t, s}
+}
+
+type recordingSpan struct {
+	t *recordingTracer
+	s *recordedSpan
+}
+
+func (s *recordingSpan) SetAttributes(attrs ...slog.Attr) {
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+	for _, a := range attrs {
+		s.s.attrs[a.Key] = a.Value
+	}
+}
+
+func (s *recordingSpan) End(err error) {
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+	s.s.ended = true
+	s.s.err = err
+}
+
+func TestStartConnSpanNoTracer(t *testing.T) {
+	for _, r := range []*Relayer{nil, {}} {
+		ctx, span := r.StartConnSpan(context.Background(), "tunnel", "example.com:443")
+		if span != nil || ctx != context.Background() {
+			t.Fatalf("StartConnSpan without a tracer = %v, %v, want the context unchanged and no span", ctx, span)
+		}
+		// A nil span is safe to use.
+		span.SetAttributes(slog.Int("n", 1))
+		span.End(errors.New("failed"))
+	}
+}
+
+func TestConnSpan(t *testing.T) {
+	tracer := &recordingTracer{}
+	r := &Relayer{Tracer: tracer, TargetLog: TargetLogDomain}
+	ctx, span := r.StartConnSpan(context.Background(), "socks5", "www.example.com:443")
+	
+	client, clientPeer := tcpPair(t)
+	server, serverPeer := tcpPair(t)
+	done := make(chan RelayResult, 1)
+	go func() { done <- r.Relay(ctx, client, server) }()
+	clientPeer.Write([]byte("hello"))
+	clientPeer.(*net.TCPConn).CloseWrite()
+	serverPeer.Write([]byte("hi"))
+	serverPeer.(*net.TCPConn).CloseWrite()
+	relayResult(t, done)
+	
+	failure := errors.New("dial failed")
+	span.End(failure)
+	
+	if len(tracer.spans) != 1 {
+		t.Fatalf("%d spans started, want 1", len(tracer.spans))
+	}
+	s := tracer.spans[0]
+	if s.name != "socks5 connection" || !s.ended || s.err != failure {
+		t.Fatalf("span %q ended %v with %v, want %q ended with %v", s.name, s.ended, s.err, "socks5 connection", failure)
+	}
+	want := map[string]string{
+		"inbound":      "socks5",
+		"target":       "example.com",
+		"bytes_up":     "5",
+		"bytes_down":   "2",
+		"close_reason": "eof",
+	}
+	for key, value := range want {
+		if got, ok := s.attrs[key]; !ok || got.String() != value {
+			t.Errorf("attribute %s = %v, want %s", key, got, value)
+		}
+	}
+}
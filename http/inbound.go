@@ -3,6 +3,7 @@ package http
 import (
 	"context"
 	"errors"
+	"fmt"
 	"kage/core"
 	"kage/shadowsocks"
 	"log/slog"
@@ -17,21 +18,85 @@ type Inbound struct {
 	ListenAddr string
 	ServerAddr string
 	Method     string
+	NoPadding  bool
 
 	Key []byte
 
+	ConnectTimeout   time.Duration
+	HandshakeTimeout time.Duration
+	ChunkSize        int
+	DSCP             int
+	CoalesceDelay    time.Duration
+	// HandshakeDump logs the first server handshakes in hex, see
+	// shadowsocks.HandshakeDump.
+	HandshakeDump *shadowsocks.HandshakeDump
+	// TapLimit logs up to this many bytes of plaintext per direction of
+	// each connection, see shadowsocks.Dialer.TapLimit.
+	TapLimit int
+
+	// ShutdownNotice answers requests that arrive on open connections after
+	// shutdown started with 503 Service Unavailable and closes the
+	// connection, instead of failing to reach the server.
+	ShutdownNotice bool
+
+	// Relayer relays the connections with the settings this inbound shares
+	// with the others of the instance, such as the quota. Nil relays with
+	// the defaults.
+	Relayer *core.Relayer
+
 	ctx       context.Context
+	ln        net.Listener
 	proxy     *httputil.ReverseProxy
 	proxyOnce sync.Once
 }
 
-func (p *Inbound) Listen(ctx context.Context) error {
-	p.ctx = ctx
+// Bind opens the listener ahead of Listen, so that Addr is known before
+// serving starts. Listen binds by itself when Bind was not called.
+func (p *Inbound) Bind() error {
 	ln, err := net.Listen("tcp", p.ListenAddr)
 	if err != nil {
 		return err
 	}
+	p.ln = ln
+	return nil
+}
+
+// SetListener makes Listen serve ln, e.g. one wrapped with TLS or rate
+// limiting, instead of binding ListenAddr.
+func (p *Inbound) SetListener(ln net.Listener) error {
+	if err := core.CheckStreamListener(ln); err != nil {
+		return err
+	}
+	p.ln = ln
+	return nil
+}
+
+// Addr returns the address the listener is bound to, which differs from
+// ListenAddr when its port is 0. It is nil before binding.
+func (p *Inbound) Addr() net.Addr {
+	if p.ln == nil {
+		return nil
+	}
+	return p.ln.Addr()
+}
+
+func (p *Inbound) Listen(ctx context.Context) error {
+	p.ctx = ctx
+	if p.ln == nil {
+		if err := p.Bind(); err != nil {
+			return err
+		}
+	}
+	ln := p.ln
 	
+	srv := &http.Server{
+		Addr:    p.ListenAddr,
+		Handler: p,
+	}
+	
+	// Open keep-alive connections are left to the server, so that with
+	// ShutdownNotice their next request is answered with 503 and closes
+	// them. Disabling keep-alives here would close the idle ones before.
 	go func() {
 		<-ctx.Done()
 		ln.Close()
@@ -39,11 +104,6 @@ func (p *Inbound) Listen(ctx context.Context) error {
 	
 	slog.Info("HTTP inbound listening", "addr", p.ListenAddr)
 	
-	srv := &http.Server{
-		Addr:    p.ListenAddr,
-		Handler: p,
-	}
-	
 	return srv.Serve(ln)
 }
 
@@ -54,7 +114,20 @@ func (p *Inbound) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		target = "https://" + target
 	}
 	
-	slog.Info("HTTP proxying", "method", method, "target", target, "client", req.RemoteAddr)
+	if p.ShutdownNotice && p.ctx.Err() != nil {
+		w.Header().Set("Connection", "close")
+		http.Error(w, "Proxy error: shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	
+	if p.Relayer.QuotaExceeded() {
+		http.Error(w, "Proxy error: data quota exceeded", http.StatusServiceUnavailable)
+		return
+	}
+	
+	if p.Relayer.SampleConn() {
+		slog.Info("HTTP proxying", "method", method, p.Relayer.TargetAttr(target), "client", req.RemoteAddr)
+	}
 	
 	if method == http.MethodConnect {
 		p.handleCONNECT(w, req)
@@ -65,6 +138,10 @@ func (p *Inbound) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 }
 
 func (p *Inbound) handleCONNECT(w http.ResponseWriter, req *http.Request) {
+	var err error
+	ctx, span := p.Relayer.StartConnSpan(p.ctx, "http", req.Host)
+	defer func() { span.End(err) }()
+	
 	targetAddr, err := core.ParseAddress(req.Host)
 	if err != nil {
 		slog.Error("Parse target address failed", "host", req.Host, "error", err)
@@ -72,7 +149,7 @@ func (p *Inbound) handleCONNECT(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 	
-	shadowConn, err := p.dialShadowsocks(targetAddr, nil)
+	shadowConn, err := p.dialShadowsocks(req.Context(), targetAddr, nil)
 	if err != nil {
 		slog.Error("Dial Shadowsocks failed", "error", err)
 		http.Error(w, "Proxy error: connection failed", http.StatusBadGateway)
@@ -82,6 +159,7 @@ func (p *Inbound) handleCONNECT(w http.ResponseWriter, req *http.Request) {
 	
 	hj, ok := w.(http.Hijacker)
 	if !ok {
+		err = errors.New("http.ResponseWriter is not a hijacker")
 		slog.Error("Hijack failed: http.ResponseWriter is not a hijacker")
 		http.Error(w, "Proxy error: hijacking not supported", http.StatusInternalServerError)
 		return
@@ -99,7 +177,7 @@ func (p *Inbound) handleCONNECT(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 	
-	core.TCPRelay(p.ctx, clientConn, shadowConn)
+	err = p.Relayer.TCPRelay(ctx, clientConn, shadowConn)
 }
 
 func (p *Inbound) initProxy() {
@@ -115,7 +193,7 @@ func (p *Inbound) initProxy() {
 				if err != nil {
 					return nil, err
 				}
-				shadowConn, err := p.dialShadowsocks(targetAddr, nil)
+				shadowConn, err := p.dialShadowsocks(ctx, targetAddr, nil)
 				if err != nil {
 					return nil, err
 				}
@@ -139,11 +217,24 @@ func (p *Inbound) initProxy() {
 	}
 }
 
-func (p *Inbound) dialShadowsocks(targetAddr *core.Address, initialPayload []byte) (*shadowsocks.Conn, error) {
-	serverConn, err := net.DialTimeout("tcp", p.ServerAddr, time.Second*3)
-	if err != nil {
-		return nil, err
+func (p *Inbound) dialShadowsocks(ctx context.Context, targetAddr *core.Address, initialPayload []byte) (*shadowsocks.Conn, error) {
+	if core.IsSelfTarget(targetAddr, p.ServerAddr) {
+		return nil, fmt.Errorf("%w: %v", core.ErrSelfTarget, targetAddr)
 	}
 	
-	return shadowsocks.NewConn(serverConn, p.Method, p.Key, targetAddr, initialPayload)
+	dialer := &shadowsocks.Dialer{
+		ServerAddr:       p.ServerAddr,
+		Method:           p.Method,
+		Key:              p.Key,
+		NoPadding:        p.NoPadding,
+		ChunkSize:        p.ChunkSize,
+		DSCP:             p.DSCP,
+		CoalesceDelay:    p.CoalesceDelay,
+		ConnectTimeout:   p.ConnectTimeout,
+		HandshakeTimeout: p.HandshakeTimeout,
+		TargetLog:        p.Relayer.TargetLogMode(),
+		HandshakeDump:    p.HandshakeDump,
+		TapLimit:         p.TapLimit,
+	}
+	return dialer.Dial(ctx, targetAddr, initialPayload)
 }
@@ -0,0 +1,79 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// serverAddr is the shadowsocks server of the test inbounds. Requests for
+// it are refused as self targets, so they fail without any network.
+const serverAddr = "127.0.0.1:1"
+
+func TestShutdownNotice(t *testing.T) {
+	for _, tc := range []struct {
+		notice bool
+		want   int
+	}{
+		{true, http.StatusServiceUnavailable},
+		{false, http.StatusBadGateway},
+	} {
+		p := &Inbound{ListenAddr: "127.0.0.1:0", ServerAddr: serverAddr, ShutdownNotice: tc.notice}
+		if err := p.Bind(); err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() { done <- p.Listen(ctx) }()
+		
+		conn, err := net.Dial("tcp", p.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		r := bufio.NewReader(conn)
+		get := func() *http.Response {
+			t.Helper()
+			if _, err := io.WriteString(conn, "GET http://"+serverAddr+"/ HTTP/1.1\r\nHost: "+serverAddr+"\r\n\r\n"); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.ReadResponse(r, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			return resp
+		}
+		
+		if resp := get(); resp.StatusCode != http.StatusBadGateway || resp.Close {
+			t.Fatalf("notice %v: before shutdown got %d (close %v), want %d on a kept-alive connection", tc.notice, resp.StatusCode, resp.Close, http.StatusBadGateway)
+		}
+		
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Listen did not return after cancellation")
+		}
+		
+		// The connection was idle when shutdown started.
+		resp := get()
+		if resp.StatusCode != tc.want {
+			t.Errorf("notice %v: after shutdown got %d, want %d", tc.notice, resp.StatusCode, tc.want)
+		}
+		if tc.notice {
+			if !resp.Close {
+				t.Error("503 response does not close the connection")
+			}
+			if _, err := r.ReadByte(); err != io.EOF {
+				t.Errorf("read after 503 = %v, want EOF", err)
+			}
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"kage/shadowsocks"
+	"os"
+	"strings"
+)
+
+// runInfo implements "kage info": it prints the framing overhead of the
+// configured method, to help debugging MTU and throughput issues, and the
+// optional features of this build.
+func runInfo(args []string) int {
+	fs := flag.NewFlagSet("info", flag.ExitOnError)
+	configPath := fs.String("c", "config.json", "Config file path")
+	ssConfig := fs.Bool("ss", false, "Read the config file in the standard shadowsocks format")
+	fs.Parse(args)
+	
+	load := LoadConfig
+	if *ssConfig {
+		load = LoadShadowsocksJSON
+	}
+	cfg, err := load(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to load config:", err)
+		return 1
+	}
+	
+	framing, err := shadowsocks.MethodFraming(cfg.Method)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	printFraming(os.Stdout, framing, cfg.ChunkSize)
+	fmt.Fprintf(os.Stdout, "features              %s\n", strings.Join(shadowsocks.Features(), " "))
+	return 0
+}
+
+func printFraming(w io.Writer, f shadowsocks.Framing, chunkSize int) {
+	maxPayload := f.MaxPayload
+	if chunkSize > 0 && chunkSize < maxPayload {
+		maxPayload = chunkSize
+	}
+	
+	fmt.Fprintf(w, "method                %s\n", f.Method)
+	fmt.Fprintf(w, "key size              %d bytes\n", f.KeySize)
+	fmt.Fprintf(w, "AEAD overhead         %d bytes\n", f.AEADOverhead)
+	fmt.Fprintf(w, "max payload per chunk %d bytes\n", maxPayload)
+	fmt.Fprintf(w, "TCP chunk overhead    %d bytes\n", f.ChunkOverhead)
+	fmt.Fprintf(w, "TCP request header    %d bytes + address + padding (0-%d)\n", f.RequestOverhead, shadowsocks.MaxPaddingLength-1)
+	fmt.Fprintf(w, "TCP response header   %d bytes\n", f.ResponseOverhead)
+	fmt.Fprintf(w, "UDP separate header   %d bytes\n", f.UDPSeparateHeader)
+	fmt.Fprintf(w, "UDP packet overhead   %d bytes + address, + padding on the first packet\n", f.UDPOverhead)
+}
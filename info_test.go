@@ -0,0 +1,69 @@
+package main
+
+import (
+	"kage/shadowsocks"
+	"strings"
+	"testing"
+)
+
+func TestPrintFraming(t *testing.T) {
+	tests := []struct {
+		method    string
+		chunkSize int
+		want      string
+	}{
+		{"2022-blake3-aes-128-gcm", 0, `method                2022-blake3-aes-128-gcm
+key size              16 bytes
+AEAD overhead         16 bytes
+max payload per chunk 65535 bytes
+TCP chunk overhead    34 bytes
+TCP request header    61 bytes + address + padding (0-899)
+TCP response header   75 bytes
+UDP separate header   16 bytes
+UDP packet overhead   43 bytes + address, + padding on the first packet
+`},
+		{"2022-blake3-aes-256-gcm", 0, `method                2022-blake3-aes-256-gcm
+key size              32 bytes
+AEAD overhead         16 bytes
+max payload per chunk 65535 bytes
+TCP chunk overhead    34 bytes
+TCP request header    77 bytes + address + padding (0-899)
+TCP response header   107 bytes
+UDP separate header   16 bytes
+UDP packet overhead   43 bytes + address, + padding on the first packet
+`},
+		// The separate header of chacha20 packets includes the 24-byte nonce.
+		{"2022-blake3-chacha20-poly1305", 0, `method                2022-blake3-chacha20-poly1305
+key size              32 bytes
+AEAD overhead         16 bytes
+max payload per chunk 65535 bytes
+TCP chunk overhead    34 bytes
+TCP request header    77 bytes + address + padding (0-899)
+TCP response header   107 bytes
+UDP separate header   40 bytes
+UDP packet overhead   67 bytes + address, + padding on the first packet
+`},
+		// A configured chunk_size lowers the payload per chunk.
+		{"2022-blake3-aes-128-gcm", 16 * 1024, `method                2022-blake3-aes-128-gcm
+key size              16 bytes
+AEAD overhead         16 bytes
+max payload per chunk 16384 bytes
+TCP chunk overhead    34 bytes
+TCP request header    61 bytes + address + padding (0-899)
+TCP response header   75 bytes
+UDP separate header   16 bytes
+UDP packet overhead   43 bytes + address, + padding on the first packet
+`},
+	}
+	for _, tt := range tests {
+		framing, err := shadowsocks.MethodFraming(tt.method)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.method, err)
+		}
+		var b strings.Builder
+		printFraming(&b, framing, tt.chunkSize)
+		if b.String() != tt.want {
+			t.Errorf("%s, chunk size %d: printed\n%s\nwant\n%s", tt.method, tt.chunkSize, b.String(), tt.want)
+		}
+	}
+}
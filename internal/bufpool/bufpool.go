@@ -0,0 +1,36 @@
+// Package bufpool is a size-classed pool of byte slices shared by the TCP and
+// UDP paths, so that memory freed by one path can serve the other.
+package bufpool
+
+import "sync"
+
+// classes are the buffer capacities kept in the pool. The largest fits a full
+// TCP chunk (a 0xFFFF-byte payload and its tag) as well as any UDP packet.
+var classes = [...]int{4 << 10, 16 << 10, 64<<10 + 64}
+
+var pools [len(classes)]sync.Pool
+
+// Get returns a buffer of length n. Buffers larger than every class are
+// allocated directly and not pooled.
+func Get(n int) []byte {
+	for i, size := range classes {
+		if n <= size {
+			if b, ok := pools[i].Get().(*[]byte); ok {
+				return (*b)[:n]
+			}
+			return make([]byte, n, size)
+		}
+	}
+	return make([]byte, n)
+}
+
+// Put returns b to the pool. b must not be used afterwards.
+func Put(b []byte) {
+	for i, size := range classes {
+		if cap(b) == size {
+			b = b[:size]
+			pools[i].Put(&b)
+			return
+		}
+	}
+}
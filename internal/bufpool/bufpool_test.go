@@ -0,0 +1,85 @@
+package bufpool
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func TestGetPut(t *testing.T) {
+	for _, n := range []int{0, 1, 1500, 4 << 10, 4<<10 + 1, 0xFFFF + 16, 64<<10 + 64, 64<<10 + 65} {
+		b := Get(n)
+		if len(b) != n {
+			t.Fatalf("Get(%d) returned %d bytes", n, len(b))
+		}
+		if n <= classes[len(classes)-1] && cap(b) < n {
+			t.Fatalf("Get(%d) has capacity %d", n, cap(b))
+		}
+		Put(b)
+	}
+	// Foreign slices are not pooled, so Get never hands out a smaller one.
+	Put(make([]byte, 10))
+	if b := Get(4 << 10); cap(b) < 4<<10 {
+		t.Fatalf("Get returned a foreign slice of capacity %d", cap(b))
+	}
+}
+
+// writeChunks seals p in chunks of at most 0xFFFF bytes into a buffer from
+// get, as shadowsocks.Conn does for every Write, and hands it to w.
+func writeChunks(w io.Writer, aead cipher.AEAD, nonce, p []byte, get func(int) []byte, put func([]byte)) {
+	const chunkSize = 0xFFFF
+	chunks := (len(p) + chunkSize - 1) / chunkSize
+	buf := get(len(p) + chunks*(2+2*aead.Overhead()))[:0]
+	for rest := p; len(rest) > 0; {
+		chunk := rest[:min(len(rest), chunkSize)]
+		rest = rest[len(chunk):]
+		
+		var size [2]byte
+		binary.BigEndian.PutUint16(size[:], uint16(len(chunk)))
+		buf = aead.Seal(buf, nonce, size[:], nil)
+		buf = aead.Seal(buf, nonce, chunk, nil)
+	}
+	w.Write(buf)
+	put(buf)
+}
+
+// BenchmarkWriteChunks writes TCP chunks of several sizes while UDP packets
+// are packed alongside, with buffers from the pool and freshly allocated.
+func BenchmarkWriteChunks(b *testing.B) {
+	block, err := aes.NewCipher(make([]byte, 16))
+	if err != nil {
+		b.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		b.Fatal(err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	payloads := [][]byte{make([]byte, 512), make([]byte, 16<<10), make([]byte, 0xFFFF)}
+	packet := make([]byte, 1400)
+	
+	for _, bench := range []struct {
+		name string
+		get  func(int) []byte
+		put  func([]byte)
+	}{
+		{"pooled", Get, Put},
+		{"unpooled", func(n int) []byte { return make([]byte, n) }, func([]byte) {}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					writeChunks(io.Discard, aead, nonce, payloads[i%len(payloads)], bench.get, bench.put)
+					
+					// A UDP packet sealed in place, as UDPClient does.
+					buf := bench.get(len(packet) + aead.Overhead())
+					aead.Seal(buf[:0], nonce, packet, nil)
+					bench.put(buf)
+				}
+			})
+		})
+	}
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"log/slog"
 	"os"
 	"strings"
+	"sync"
+	"time"
 )
 
-func SetLogLevel(level string) {
+func SetLogLevel(level string, dedupWindow time.Duration) {
 	var l slog.Level
 	switch strings.ToLower(level) {
 	case "debug":
@@ -19,5 +22,85 @@ func SetLogLevel(level string) {
 		l = slog.LevelInfo
 	}
 	
-	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: l})))
+	var h slog.Handler = slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: l})
+	if dedupWindow > 0 {
+		h = &dedupHandler{
+			Handler: h,
+			window:  dedupWindow,
+			state:   &dedupState{seen: make(map[string]*dedupEntry)},
+		}
+	}
+	slog.SetDefault(slog.New(h))
+}
+
+// SetLogTag attaches tag to every record of the default logger, so that the
+// logs of several instances on one host can be told apart.
+func SetLogTag(tag string) {
+	if tag != "" {
+		slog.SetDefault(slog.Default().With("tag", tag))
+	}
+}
+
+// dedupHandler drops records repeating the level, message and error of a
+// record logged less than window ago. The next record that gets through
+// carries the number of dropped ones in a "suppressed" attribute.
+type dedupHandler struct {
+	slog.Handler
+	window time.Duration
+	state  *dedupState
+}
+
+type dedupState struct {
+	mu   sync.Mutex
+	seen map[string]*dedupEntry
+}
+
+type dedupEntry struct {
+	first      time.Time
+	suppressed int
+}
+
+func (h *dedupHandler) Handle(ctx context.Context, r slog.Record) error {
+	key := r.Level.String() + "|" + r.Message
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == "err" || a.Key == "error" {
+			key += "|" + a.Value.String()
+			return false
+		}
+		return true
+	})
+	
+	h.state.mu.Lock()
+	e, ok := h.state.seen[key]
+	if ok && r.Time.Sub(e.first) < h.window {
+		e.suppressed++
+		h.state.mu.Unlock()
+		return nil
+	}
+	suppressed := 0
+	if ok {
+		suppressed = e.suppressed
+	}
+	h.state.seen[key] = &dedupEntry{first: r.Time}
+	if len(h.state.seen) > 1024 {
+		for k, e := range h.state.seen {
+			if r.Time.Sub(e.first) >= h.window {
+				delete(h.state.seen, k)
+			}
+		}
+	}
+	h.state.mu.Unlock()
+	
+	if suppressed > 0 {
+		r.AddAttrs(slog.Int("suppressed", suppressed))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *dedupHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &dedupHandler{Handler: h.Handler.WithAttrs(attrs), window: h.window, state: h.state}
+}
+
+func (h *dedupHandler) WithGroup(name string) slog.Handler {
+	return &dedupHandler{Handler: h.Handler.WithGroup(name), window: h.window, state: h.state}
 }
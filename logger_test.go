@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"kage/socks5"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+)
+
+// captureHandler keeps the records it handles.
+type captureHandler struct {
+	records []slog.Record
+}
+
+func (h *captureHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *captureHandler) Handle(_ context.Context, r slog.Record) error {
+	h.records = append(h.records, r)
+	return nil
+}
+
+func (h *captureHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *captureHandler) WithGroup(string) slog.Handler      { return h }
+
+func suppressedAttr(r slog.Record) int64 {
+	var n int64
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == "suppressed" {
+			n = a.Value.Int64()
+			return false
+		}
+		return true
+	})
+	return n
+}
+
+func TestDedupHandler(t *testing.T) {
+	capture := &captureHandler{}
+	h := &dedupHandler{Handler: capture, window: time.Minute, state: &dedupState{seen: make(map[string]*dedupEntry)}}
+	start := time.Now()
+	
+	logAt := func(d time.Duration, msg, err string) {
+		r := slog.NewRecord(start.Add(d), slog.LevelError, msg, 0)
+		r.AddAttrs(slog.String("err", err))
+		h.Handle(context.Background(), r)
+	}
+	
+	logAt(0, "dial failed", "connection refused")
+	for i := range 5 {
+		logAt(time.Duration(i+1)*time.Second, "dial failed", "connection refused")
+	}
+	// Another error or message is not a repeat.
+	logAt(time.Second, "dial failed", "timeout")
+	logAt(time.Second, "handshake failed", "connection refused")
+	if len(capture.records) != 3 {
+		t.Fatalf("%d records passed within the window, want 3", len(capture.records))
+	}
+	
+	// The first repeat after the window carries the count of dropped ones.
+	logAt(time.Minute, "dial failed", "connection refused")
+	if len(capture.records) != 4 {
+		t.Fatalf("repeat after the window dropped")
+	}
+	if n := suppressedAttr(capture.records[3]); n != 5 {
+		t.Fatalf("suppressed = %d, want 5", n)
+	}
+	logAt(time.Minute+time.Second, "dial failed", "connection refused")
+	logAt(2*time.Minute, "dial failed", "connection refused")
+	if n := suppressedAttr(capture.records[len(capture.records)-1]); n != 1 {
+		t.Fatalf("suppressed after the second window = %d, want 1", n)
+	}
+}
+
+func TestDedupHandlerEviction(t *testing.T) {
+	h := &dedupHandler{Handler: &captureHandler{}, window: time.Minute, state: &dedupState{seen: make(map[string]*dedupEntry)}}
+	start := time.Now()
+	for i := range 1024 {
+		h.Handle(context.Background(), slog.NewRecord(start, slog.LevelError, fmt.Sprint("error ", i), 0))
+	}
+	if n := len(h.state.seen); n != 1024 {
+		t.Fatalf("%d entries tracked, want 1024", n)
+	}
+	
+	// Past the limit, the entries whose window is over are dropped.
+	h.Handle(context.Background(), slog.NewRecord(start.Add(time.Minute), slog.LevelError, "one more", 0))
+	if n := len(h.state.seen); n != 1 {
+		t.Fatalf("%d entries tracked after eviction, want 1", n)
+	}
+	
+	// Entries still within their window are kept.
+	for i := range 1024 {
+		h.Handle(context.Background(), slog.NewRecord(start.Add(time.Minute), slog.LevelError, fmt.Sprint("error ", i), 0))
+	}
+	if n := len(h.state.seen); n != 1025 {
+		t.Fatalf("%d entries tracked, want 1025 within the window", n)
+	}
+}
+
+// lineWriter passes each write, one JSON record for a slog.JSONHandler, on
+// to a channel.
+type lineWriter chan []byte
+
+func (w lineWriter) Write(p []byte) (int, error) {
+	w <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func TestSetLogTag(t *testing.T) {
+	old := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(old) })
+	lines := make(lineWriter, 16)
+	slog.SetDefault(slog.New(slog.NewJSONHandler(lines, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	SetLogTag("work-proxy")
+	
+	c := &socks5.Client{ListenAddr: "127.0.0.1:0"}
+	if err := c.Bind(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	
+	// A client speaking SOCKS4 gets its connection logged by the inbound.
+	conn, err := net.Dial("tcp", c.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{0x04, 0x01, 0x00, 0x50, 127, 0, 0, 1, 0x00})
+	
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case line := <-lines:
+			var record map[string]any
+			if err := json.Unmarshal(line, &record); err != nil {
+				t.Fatalf("log line %q: %v", line, err)
+			}
+			if record["msg"] != "[SOCKS5] handshake failed" {
+				continue
+			}
+			if record["tag"] != "work-proxy" {
+				t.Fatalf("tag = %v, want %q in %s", record["tag"], "work-proxy", line)
+			}
+			if record["client"] == nil {
+				t.Errorf("connection attributes missing from %s", line)
+			}
+			return
+		case <-timeout:
+			t.Fatal("connection not logged")
+		}
+	}
+}
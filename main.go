@@ -2,28 +2,115 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"kage/core"
 	"kage/http"
+	"kage/shadowsocks"
 	"kage/socks5"
 	"kage/tunnel"
 	"log/slog"
+	"net"
 	"os"
 	"os/signal"
+	"runtime"
 	"sync"
 	"syscall"
+	"time"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "info" {
+		os.Exit(runInfo(os.Args[2:]))
+	}
+	
 	configPath := flag.String("c", "config.json", "Config file path")
+	ssConfig := flag.Bool("ss", false, "Read the config file in the standard shadowsocks format")
+	printConfig := flag.Bool("print-config", false, "Print the effective config as a JSON line on startup, without passwords")
+	tapBytes := flag.Int("tap", 0, "Log up to N bytes of plaintext per direction of each connection at debug level (exposes traffic contents)")
+	dumpHandshake := flag.Int("dump-handshake", 0, "Log the raw handshake bytes of the first N connections")
 	flag.Parse()
 	
-	SetLogLevel("")
-	cfg, err := LoadConfig(*configPath)
+	SetLogLevel("", 0)
+	load := LoadConfig
+	if *ssConfig {
+		load = LoadShadowsocksJSON
+	}
+	cfg, err := load(*configPath)
 	if err != nil {
 		slog.Error("failed to load config", "error", err)
 		os.Exit(1)
 	}
-	SetLogLevel(cfg.LogLevel)
+	SetLogLevel(cfg.LogLevel, time.Duration(cfg.LogDedupWindow)*time.Second)
+	SetLogTag(cfg.Tag)
+	
+	targetLogMode, err := core.ParseTargetLogMode(cfg.LogTarget)
+	if err != nil {
+		slog.Error("invalid log_target", "value", cfg.LogTarget, "error", err)
+		os.Exit(1)
+	}
+	
+	relayStrategy, err := core.ParseRelayStrategy(cfg.RelayStrategy)
+	if err != nil {
+		slog.Error("invalid relay_strategy", "value", cfg.RelayStrategy, "error", err)
+		os.Exit(1)
+	}
+	relayer := &core.Relayer{
+		Strategy:        relayStrategy,
+		CloseGrace:      time.Duration(cfg.CloseGrace) * time.Second,
+		MaxConnLifetime: time.Duration(cfg.MaxConnLifetime) * time.Second,
+		AdaptiveNoDelay: cfg.AdaptiveNoDelay,
+		TargetLog:       targetLogMode,
+		LogSampleRate:   cfg.LogSampleRate,
+	}
+	if cfg.QuotaBytes > 0 {
+		relayer.Quota = &core.Quota{Limit: cfg.QuotaBytes, CloseActive: cfg.QuotaCloseActive}
+	}
+	
+	backoffJitter, err := core.ParseJitter(cfg.BackoffJitter)
+	if err != nil {
+		slog.Error("invalid backoff_jitter", "value", cfg.BackoffJitter, "error", err)
+		os.Exit(1)
+	}
+	
+	if err := shadowsocks.ValidateDSCP(cfg.DSCP); err != nil {
+		slog.Error("invalid dscp", "value", cfg.DSCP, "error", err)
+		os.Exit(1)
+	}
+	if err := checkPlatform(cfg); err != nil {
+		slog.Error("unsupported option", "os", runtime.GOOS, "error", err)
+		os.Exit(1)
+	}
+	
+	if err := checkKey(cfg); err != nil {
+		slog.Error("refusing to start", "error", err)
+		os.Exit(1)
+	}
+	handshakeDump := shadowsocks.NewHandshakeDump(*dumpHandshake)
+	if *tapBytes > 0 {
+		slog.Warn("plaintext tap enabled, traffic contents are logged at debug level", "bytes", *tapBytes)
+	}
+	
+	if cfg.PinServerIP {
+		pinned, err := pinServerAddr(cfg.Server, cfg.PinResolver)
+		if err != nil {
+			slog.Error("failed to resolve server", "server", cfg.Server, "error", err)
+			os.Exit(1)
+		}
+		slog.Info("server address pinned", "server", cfg.Server, "addr", pinned)
+		cfg.Server = pinned
+	}
+	
+	if *printConfig {
+		summary, err := json.Marshal(cfg.Redacted())
+		if err != nil {
+			slog.Error("failed to encode config", "error", err)
+			os.Exit(1)
+		}
+		fmt.Println(string(summary))
+	}
 	
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -36,52 +123,120 @@ func main() {
 		cancel()
 	}()
 	
+	connectTimeout := time.Duration(cfg.ConnectTimeout) * time.Second
+	handshakeTimeout := time.Duration(cfg.HandshakeTimeout) * time.Second
+	setupTimeout := time.Duration(cfg.SetupTimeout) * time.Second
+	writeCoalesce := time.Duration(cfg.WriteCoalesce) * time.Millisecond
+	
+	if cfg.PprofAddr != "" {
+		go servePprof(ctx, cfg.PprofAddr)
+	}
+	
 	slog.Info("kage started", "inbounds", len(cfg.Inbounds), "method", cfg.Method)
-
-	var wg sync.WaitGroup
+	
+	var inbounds []inbound
 	for _, in := range cfg.Inbounds {
+		switch in.Type {
+		case InboundSocks5:
+			s := &socks5.Client{
+				ListenAddr: in.ListenAddr,
+				ServerAddr: cfg.Server,
+				Method:     cfg.Method,
+				Key:        cfg.Key,
+				FastOpen:   in.FastOpen,
+				NoPadding:  cfg.NoPadding,
+				UDP:        in.UDP,
+				
+				Authenticator:          authenticator(in.Users),
+				DelayInitialPayload:    in.DelayInitialPayload,
+				PadWithPayload:         in.PadWithPayload,
+				CoalesceInitialPayload: in.CoalesceInitialPayload,
+				CompleteTLSRecord:      in.CompleteTLSRecord,
+				AbortOnPayloadError:    in.AbortOnPayloadError,
+				AuthMethods:            in.AuthMethods,
+				MaxDomainLength:        in.MaxDomainLength,
+				Strict:                 in.Strict,
+				LogNegotiation:         in.LogNegotiation,
+				UDPIdleTimeout:         time.Duration(in.UDPIdleTimeout) * time.Second,
+				UDPRedials:             in.UDPRedials,
+				UDPPacketRate:          in.UDPPacketRate,
+				UDPSyncClock:           in.UDPSyncClock,
+				UDPFragments:           in.UDPFragments,
+				BlockQUIC:              in.BlockQUIC,
+				ConnectTimeout:         connectTimeout,
+				HandshakeTimeout:       handshakeTimeout,
+				SetupTimeout:           setupTimeout,
+				EarlyRetries:           cfg.EarlyRetries,
+				ChunkSize:              cfg.ChunkSize,
+				DSCP:                   cfg.DSCP,
+				CoalesceDelay:          writeCoalesce,
+				HandshakeDump:          handshakeDump,
+				TapLimit:               *tapBytes,
+				Relayer:                relayer,
+				BackoffJitter:          backoffJitter,
+			}
+			inbounds = append(inbounds, inbound{in, s.Bind, s.Run, "[SOCKS5] started", nil})
+		case InboundTunnel:
+			t := &tunnel.Client{
+				ListenAddr: in.ListenAddr,
+				ServerAddr: cfg.Server,
+				Method:     cfg.Method,
+				TargetAddr: in.Target,
+				NoPadding:  cfg.NoPadding,
+				Key:        cfg.Key,
+				
+				ConnectTimeout:   connectTimeout,
+				HandshakeTimeout: handshakeTimeout,
+				ChunkSize:        cfg.ChunkSize,
+				DSCP:             cfg.DSCP,
+				CoalesceDelay:    writeCoalesce,
+				HandshakeDump:    handshakeDump,
+				TapLimit:         *tapBytes,
+				EarlyRetries:     cfg.EarlyRetries,
+				Relayer:          relayer,
+				BackoffJitter:    backoffJitter,
+			}
+			inbounds = append(inbounds, inbound{in, t.Bind, t.Run, "[Tunnel] started", []any{"target", in.Target}})
+		case InboundHTTP:
+			h := &http.Inbound{
+				ListenAddr: in.ListenAddr,
+				ServerAddr: cfg.Server,
+				Method:     cfg.Method,
+				NoPadding:  cfg.NoPadding,
+				Key:        cfg.Key,
+				
+				ConnectTimeout:   connectTimeout,
+				HandshakeTimeout: handshakeTimeout,
+				ChunkSize:        cfg.ChunkSize,
+				DSCP:             cfg.DSCP,
+				CoalesceDelay:    writeCoalesce,
+				HandshakeDump:    handshakeDump,
+				TapLimit:         *tapBytes,
+				ShutdownNotice:   in.ShutdownNotice,
+				Relayer:          relayer,
+			}
+			inbounds = append(inbounds, inbound{in, h.Bind, h.Listen, "[HTTP] started", nil})
+		default:
+			slog.Warn("unknown inbound type", "type", in.Type)
+		}
+	}
+	
+	bound, err := bindInbounds(inbounds, cfg.BindPolicy)
+	if err != nil {
+		slog.Error("failed to bind inbounds", "err", err)
+		os.Exit(1)
+	}
+	
+	var wg sync.WaitGroup
+	for _, in := range bound {
 		wg.Add(1)
-
-		go func(in InboundConfig) {
+		
+		go func(in inbound) {
 			defer wg.Done()
-
-			var err error
-			switch in.Type {
-			case "socks5":
-				s := &socks5.Client{
-					ListenAddr: in.ListenAddr,
-					ServerAddr: cfg.Server,
-					Method:     cfg.Method,
-					Key:        cfg.Key,
-					FastOpen:   in.FastOpen,
-					UDP:        in.UDP,
-				}
-				slog.Info("[SOCKS5] started", "listen", in.ListenAddr, "server", cfg.Server)
-				err = s.Run(ctx)
-			case "tunnel":
-				t := &tunnel.Client{
-					ListenAddr: in.ListenAddr,
-					ServerAddr: cfg.Server,
-					Method:     cfg.Method,
-					TargetAddr: in.Target,
-					Key:        cfg.Key,
-				}
-				slog.Info("[Tunnel] started", "listen", in.ListenAddr, "server", cfg.Server, "target", in.Target)
-				err = t.Run(ctx)
-			case "http":
-				h := &http.Inbound{
-					ListenAddr: in.ListenAddr,
-					ServerAddr: cfg.Server,
-					Method:     cfg.Method,
-					Key:        cfg.Key,
-				}
-				slog.Info("[HTTP] started", "listen", in.ListenAddr, "server", cfg.Server)
-				err = h.Listen(ctx)
-			default:
-				slog.Warn("unknown inbound type", "type", in.Type)
-				return
-			}
-
+			
+			slog.Info(in.started, append([]any{"listen", in.ListenAddr, "server", cfg.Server}, in.attrs...)...)
+			err := in.run(ctx)
+			
 			if err == nil {
 				slog.Info("inbound stopped", "type", in.Type, "listen", in.ListenAddr)
 			} else {
@@ -89,7 +244,118 @@ func main() {
 			}
 		}(in)
 	}
-
+	
 	wg.Wait()
+	relayer.Wait()
 	slog.Info("kage exit")
 }
+
+// inbound is a configured listener with the functions that bind it and
+// serve it, and the message and attributes logged when it starts.
+type inbound struct {
+	InboundConfig
+	bind    func() error
+	run     func(context.Context) error
+	started string
+	attrs   []any
+}
+
+// errNoneBound means every inbound failed to bind.
+var errNoneBound = errors.New("no inbound could bind")
+
+// bindInbounds binds every inbound before any starts serving, so that with
+// require_all nothing is accepted when one of them fails. With best_effort
+// the inbounds that failed are left out of the returned ones.
+func bindInbounds(inbounds []inbound, policy string) ([]inbound, error) {
+	var bound []inbound
+	for _, in := range inbounds {
+		if err := in.bind(); err != nil {
+			if policy == BindRequireAll {
+				return nil, fmt.Errorf("%s inbound on %s: %w", in.Type, in.ListenAddr, err)
+			}
+			slog.Warn("inbound failed to bind, continuing without it", "type", in.Type, "listen", in.ListenAddr, "err", err)
+			continue
+		}
+		bound = append(bound, in)
+	}
+	if len(bound) == 0 && len(inbounds) > 0 {
+		return nil, errNoneBound
+	}
+	return bound, nil
+}
+
+func authenticator(users map[string]string) socks5.Authenticator {
+	if len(users) == 0 {
+		return nil
+	}
+	return socks5.StaticAuthenticator(users)
+}
+
+// pinServerAddr resolves the host of server once and returns it as ip:port,
+// so that no connection depends on a later DNS answer. A non-empty resolver
+// is queried instead of the system resolver.
+func pinServerAddr(server, resolver string) (string, error) {
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		return "", err
+	}
+	if net.ParseIP(host) != nil {
+		return server, nil
+	}
+	
+	r := net.DefaultResolver
+	if resolver != "" {
+		r = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, resolver)
+			},
+		}
+	}
+	
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	
+	addrs, err := r.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(addrs[0].IP.String(), port), nil
+}
+
+// dscpSupported is shadowsocks.DSCPSupported, as a variable for tests.
+var dscpSupported = shadowsocks.DSCPSupported
+
+// checkPlatform rejects configured options that do not work on this
+// platform, which would otherwise only show up as failing connections.
+func checkPlatform(cfg *Config) error {
+	if cfg.DSCP != 0 && !dscpSupported {
+		return fmt.Errorf("invalid dscp %d: %w", cfg.DSCP, shadowsocks.ErrDSCPUnsupported)
+	}
+	return nil
+}
+
+// checkKey warns about a degenerate key, or rejects it with
+// reject_weak_key.
+func checkKey(cfg *Config) error {
+	if !weakKey(cfg.Key) {
+		return nil
+	}
+	if cfg.RejectWeakKey {
+		return ErrWeakKey
+	}
+	slog.Warn("password decodes to a degenerate key, generate one with: openssl rand -base64 <key size>")
+	return nil
+}
+
+// weakKey reports whether every byte of key is the same, as in the all-zero
+// keys of copied examples.
+func weakKey(key []byte) bool {
+	for _, b := range key {
+		if b != key[0] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"kage/shadowsocks"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCheckPlatformDSCP(t *testing.T) {
+	defer func(supported bool) { dscpSupported = supported }(dscpSupported)
+	cfg := testConfig()
+	cfg.DSCP = 46
+	
+	dscpSupported = false
+	if err := checkPlatform(cfg); !errors.Is(err, shadowsocks.ErrDSCPUnsupported) {
+		t.Fatalf("checkPlatform without DSCP support = %v, want ErrDSCPUnsupported", err)
+	}
+	cfg.DSCP = 0
+	if err := checkPlatform(cfg); err != nil {
+		t.Fatalf("checkPlatform with dscp 0 = %v", err)
+	}
+	
+	dscpSupported = true
+	cfg.DSCP = 46
+	if err := checkPlatform(cfg); err != nil {
+		t.Fatalf("checkPlatform with DSCP support = %v", err)
+	}
+}
+
+func TestCheckKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		key    []byte
+		reject bool
+		err    error
+		warned bool
+	}{
+		{"random", []byte{0x3f, 0xa2, 0x91, 0x07, 0xc4, 0x5e, 0x18, 0xd0}, false, nil, false},
+		{"all zero", make([]byte, 16), false, nil, true},
+		{"all zero rejected", make([]byte, 16), true, ErrWeakKey, false},
+		{"repeated byte rejected", bytes.Repeat([]byte{0x41}, 32), true, ErrWeakKey, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			capture := &captureHandler{}
+			old := slog.Default()
+			slog.SetDefault(slog.New(capture))
+			defer slog.SetDefault(old)
+			
+			cfg := testConfig()
+			cfg.Key, cfg.RejectWeakKey = tt.key, tt.reject
+			if err := checkKey(cfg); !errors.Is(err, tt.err) {
+				t.Fatalf("checkKey = %v, want %v", err, tt.err)
+			}
+			warned := slices.ContainsFunc(capture.records, func(r slog.Record) bool { return r.Level == slog.LevelWarn })
+			if warned != tt.warned {
+				t.Errorf("warned = %v, want %v", warned, tt.warned)
+			}
+		})
+	}
+}
+
+func TestBindInbounds(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	
+	// One listener on a free port and one on a port already in use.
+	newInbounds := func() []inbound {
+		bind := func(addr string) func() error {
+			return func() error {
+				ln, err := net.Listen("tcp", addr)
+				if err == nil {
+					t.Cleanup(func() { ln.Close() })
+				}
+				return err
+			}
+		}
+		return []inbound{
+			{InboundConfig: InboundConfig{Type: "socks5", ListenAddr: "127.0.0.1:0"}, bind: bind("127.0.0.1:0")},
+			{InboundConfig: InboundConfig{Type: "http", ListenAddr: taken.Addr().String()}, bind: bind(taken.Addr().String())},
+		}
+	}
+	
+	inbounds := newInbounds()
+	bound, err := bindInbounds(inbounds, BindBestEffort)
+	if err != nil {
+		t.Fatalf("best_effort: %v", err)
+	}
+	if len(bound) != 1 || bound[0].Type != "socks5" {
+		t.Fatalf("best_effort bound %d inbounds, want only the socks5 one", len(bound))
+	}
+	
+	inbounds = newInbounds()
+	if bound, err := bindInbounds(inbounds, BindRequireAll); err == nil || bound != nil {
+		t.Fatalf("require_all = %d inbounds, %v, want an error", len(bound), err)
+	} else if !strings.Contains(err.Error(), taken.Addr().String()) {
+		t.Errorf("require_all error %q does not name the failed listener", err)
+	}
+	
+	// Without any listener left, best_effort fails too.
+	if _, err := bindInbounds(inbounds[1:], BindBestEffort); !errors.Is(err, errNoneBound) {
+		t.Fatalf("best_effort with every bind failing = %v, want errNoneBound", err)
+	}
+}
+
+// rotatingResolver answers every A query with the next address of 192.0.2.0/24
+// and returns its address and the number of A queries answered.
+func rotatingResolver(t *testing.T) (string, *atomic.Int32) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	
+	var queries atomic.Int32
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			// The question follows the 12-byte header: a name, then the
+			// type and class.
+			end := 12
+			for end < n && buf[end] != 0 {
+				end += int(buf[end]) + 1
+			}
+			end += 5
+			if end > n {
+				continue
+			}
+			qtype := binary.BigEndian.Uint16(buf[end-4:])
+			
+			reply := append([]byte{}, buf[:end]...)
+			binary.BigEndian.PutUint16(reply[2:], 0x8180)
+			binary.BigEndian.PutUint16(reply[6:], 0)
+			binary.BigEndian.PutUint16(reply[8:], 0)
+			binary.BigEndian.PutUint16(reply[10:], 0)
+			if qtype == 1 {
+				i := queries.Add(1)
+				binary.BigEndian.PutUint16(reply[6:], 1)
+				reply = append(reply, 0xC0, 0x0C, 0, 1, 0, 1, 0, 0, 0, 0, 0, 4, 192, 0, 2, byte(i))
+			}
+			pc.WriteTo(reply, addr)
+		}
+	}()
+	return pc.LocalAddr().String(), &queries
+}
+
+func TestPinServerAddr(t *testing.T) {
+	resolver, queries := rotatingResolver(t)
+	
+	pinned, err := pinServerAddr("proxy.test:8388", resolver)
+	if err != nil {
+		t.Fatalf("pinServerAddr: %v", err)
+	}
+	if pinned != "192.0.2.1:8388" {
+		t.Fatalf("pinned %s, want 192.0.2.1:8388", pinned)
+	}
+	
+	// The resolver now answers differently, but the pinned address is an IP
+	// and is used as is, without another query.
+	for range 3 {
+		again, err := pinServerAddr(pinned, resolver)
+		if err != nil || again != pinned {
+			t.Fatalf("pinServerAddr(%s) = %s, %v, want it unchanged", pinned, again, err)
+		}
+	}
+	if n := queries.Load(); n != 1 {
+		t.Fatalf("resolver queried %d times, want once", n)
+	}
+	
+	// Only a new pin picks up the new answer.
+	if repinned, err := pinServerAddr("proxy.test:8388", resolver); err != nil || repinned != "192.0.2.2:8388" {
+		t.Fatalf("pinServerAddr again = %s, %v, want 192.0.2.2:8388", repinned, err)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+)
+
+// servePprof serves the net/http/pprof handlers on addr until ctx is done.
+// They get their own mux, so nothing else registered on the default one is
+// exposed with them.
+func servePprof(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	
+	srv := &http.Server{Addr: addr, Handler: mux}
+	context.AfterFunc(ctx, func() {
+		srv.Close()
+	})
+	
+	slog.Warn("pprof endpoint enabled, do not expose it publicly", "addr", addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("pprof endpoint stopped", "addr", addr, "err", err)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// A handler on the default mux must not be reachable through the pprof
+// endpoint.
+func init() {
+	http.HandleFunc("/kage-test-default-mux", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "exposed")
+	})
+}
+
+func TestServePprof(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		servePprof(ctx, addr)
+		close(done)
+	}()
+	
+	client := &http.Client{Timeout: 5 * time.Second}
+	get := func(path string) (int, error) {
+		resp, err := client.Get("http://" + addr + path)
+		if err != nil {
+			return 0, err
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode, nil
+	}
+	
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		code, err := get("/debug/pprof/")
+		if err == nil {
+			if code != http.StatusOK {
+				t.Fatalf("GET /debug/pprof/ = %d, want %d", code, http.StatusOK)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pprof endpoint never came up: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	
+	for _, tc := range []struct {
+		path string
+		want int
+	}{
+		{"/debug/pprof/cmdline", http.StatusOK},
+		{"/debug/pprof/symbol", http.StatusOK},
+		{"/debug/pprof/goroutine", http.StatusOK},
+		{"/kage-test-default-mux", http.StatusNotFound},
+		{"/", http.StatusNotFound},
+	} {
+		code, err := get(tc.path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", tc.path, err)
+		}
+		if code != tc.want {
+			t.Errorf("GET %s = %d, want %d", tc.path, code, tc.want)
+		}
+	}
+	
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("servePprof did not return after cancellation")
+	}
+	if _, err := get("/debug/pprof/"); err == nil {
+		t.Error("pprof endpoint still serving after cancellation")
+	}
+}
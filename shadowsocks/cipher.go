@@ -6,6 +6,7 @@ import (
 	"crypto/rand"
 	"errors"
 	"fmt"
+	"io"
 	"sync"
 	
 	"github.com/zeebo/blake3"
@@ -20,7 +21,10 @@ type Counter struct {
 func (c *Counter) Count() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	
+	c.increment()
+}
+
+func (c *Counter) increment() {
 	for i := 0; i < 12; i++ {
 		c.buf[i]++
 		if c.buf[i] != 0 {
@@ -38,20 +42,70 @@ func (c *Counter) Nonce() []byte {
 	return nonce
 }
 
+// Next returns the current nonce and advances the counter in one step, so
+// that concurrent callers never get the same nonce.
+func (c *Counter) Next() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	
+	nonce := make([]byte, 12)
+	copy(nonce, c.buf[:])
+	c.increment()
+	return nonce
+}
+
 type Cipher struct {
-	Method      string
-	Key         []byte
-	Salt        []byte
+	Method string
+	Key    []byte
+	Salt   []byte
+	// Counter is the nonce of this Cipher alone. The sending and receiving
+	// Cipher of a connection advance their nonces independently, so a
+	// Counter must never be shared; newCipher always allocates one.
 	Counter     *Counter
 	AEAD        cipher.AEAD
 	BlockCipher cipher.Block // For Shadowsocks 2022 UDPClient separate header
 }
 
+var (
+	ErrInvalidSaltSize = errors.New("shadowsocks: invalid salt size")
+	ErrInvalidKeySize  = errors.New("shadowsocks: invalid key size")
+)
+
+// NewCipherWithSalt returns the TCP cipher for salt, which must be as long
+// as the method's key.
 func NewCipherWithSalt(method string, key, salt []byte) (*Cipher, error) {
-	sessionSubkey, err := Blake3DeriveKey(key, salt)
+	saltSize, err := SaltSize(method)
+	if err != nil {
+		return nil, err
+	}
+	if len(salt) != saltSize {
+		return nil, fmt.Errorf("%w: %d bytes for %s, want %d", ErrInvalidSaltSize, len(salt), method, saltSize)
+	}
+	return newCipher(method, key, salt)
+}
+
+// NewSessionCipher returns the UDP cipher of a session, whose subkey is
+// derived from the session ID instead of a salt.
+func NewSessionCipher(method string, key, sessionID []byte) (*Cipher, error) {
+	if len(sessionID) != SessionIDSize {
+		return nil, fmt.Errorf("%w: %d bytes for a session ID, want %d", ErrInvalidSaltSize, len(sessionID), SessionIDSize)
+	}
+	return newCipher(method, key, sessionID)
+}
+
+func newCipher(method string, key, salt []byte) (*Cipher, error) {
+	keySize, err := SaltSize(method)
 	if err != nil {
 		return nil, err
 	}
+	if len(key) != keySize {
+		return nil, fmt.Errorf("%w: %d bytes for %s, want %d", ErrInvalidKeySize, len(key), method, keySize)
+	}
+	
+	sessionSubkey, err := Blake3DeriveKey(key, salt)
+	if err != nil {
+		return nil, fmt.Errorf("derive session subkey for %s: %w", method, err)
+	}
 	
 	var aead cipher.AEAD
 	var block cipher.Block
@@ -86,48 +140,72 @@ func NewCipherWithSalt(method string, key, salt []byte) (*Cipher, error) {
 	}, nil
 }
 
-func NewCipher(method string, key []byte) (*Cipher, error) {
-	var saltSize int
+// SaltSize returns the TCP salt size of a method, which is also its key size.
+func SaltSize(method string) (int, error) {
 	switch method {
 	case "2022-blake3-aes-128-gcm":
-		saltSize = 16
+		return 16, nil
 	case "2022-blake3-aes-256-gcm":
-		saltSize = 32
+		return 32, nil
 	case "2022-blake3-chacha20-poly1305":
-		saltSize = 32
+		return 32, nil
 	default:
-		return nil, fmt.Errorf("unsupported method: %s", method)
+		return 0, fmt.Errorf("unsupported method: %s", method)
+	}
+}
+
+func NewCipher(method string, key []byte) (*Cipher, error) {
+	return NewCipherFrom(method, key, rand.Reader)
+}
+
+// NewCipherFrom is like NewCipher, but reads the salt from src instead of
+// crypto/rand, for deployments that must use a specific entropy source.
+func NewCipherFrom(method string, key []byte, src io.Reader) (*Cipher, error) {
+	saltSize, err := SaltSize(method)
+	if err != nil {
+		return nil, err
 	}
 	
 	if len(key) != saltSize {
-		return nil, errors.New("invalid key length for shadowsocks 2022")
+		return nil, fmt.Errorf("%w: %d bytes for %s, want %d", ErrInvalidKeySize, len(key), method, saltSize)
 	}
 	
 	salt := make([]byte, saltSize)
-	if _, err := rand.Read(salt); err != nil {
-		return nil, err
+	if _, err := io.ReadFull(src, salt); err != nil {
+		return nil, fmt.Errorf("generate salt: %w", err)
 	}
 	return NewCipherWithSalt(method, key, salt)
 }
 
 func (c *Cipher) Seal(dst []byte, plaintext []byte) []byte {
-	nonce := c.Counter.Nonce()
-	c.Counter.Count()
-	return c.AEAD.Seal(dst, nonce, plaintext, nil)
+	return c.AEAD.Seal(dst, c.Counter.Next(), plaintext, nil)
 }
 
 func (c *Cipher) Open(dst []byte, ciphertext []byte) ([]byte, error) {
-	nonce := c.Counter.Nonce()
-	c.Counter.Count()
-	return c.AEAD.Open(dst, nonce, ciphertext, nil)
+	return c.AEAD.Open(dst, c.Counter.Next(), ciphertext, nil)
 }
 
+// NewBlockCipher returns the AES cipher of the UDP separate header. SIP022
+// keys it with the PSK itself rather than a derived subkey: the receiver
+// has to decrypt the session ID before it can derive the session subkey.
 func NewBlockCipher(key []byte) (cipher.Block, error) {
 	return aes.NewCipher(key)
 }
 
+// Blake3DeriveKey derives the session subkey from the PSK and a salt or
+// session ID. The subkey is as long as key, which must be a 128 or 256 bit
+// key; an empty salt would make every session share one subkey.
 func Blake3DeriveKey(key, salt []byte) ([]byte, error) {
+	if len(key) != 16 && len(key) != 32 {
+		return nil, fmt.Errorf("%w: %d bytes, want 16 or 32", ErrInvalidKeySize, len(key))
+	}
+	if len(salt) == 0 {
+		return nil, fmt.Errorf("%w: empty salt", ErrInvalidSaltSize)
+	}
+	
+	material := make([]byte, 0, len(key)+len(salt))
+	material = append(append(material, key...), salt...)
 	deriveKey := make([]byte, len(key))
-	blake3.DeriveKey("shadowsocks 2022 session subkey", append(key, salt...), deriveKey)
+	blake3.DeriveKey("shadowsocks 2022 session subkey", material, deriveKey)
 	return deriveKey, nil
 }
@@ -0,0 +1,184 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSaltSize(t *testing.T) {
+	tests := []struct {
+		method string
+		size   int
+	}{
+		{"2022-blake3-aes-128-gcm", 16},
+		{"2022-blake3-aes-256-gcm", 32},
+		{"2022-blake3-chacha20-poly1305", 32},
+	}
+	for _, tt := range tests {
+		size, err := SaltSize(tt.method)
+		if err != nil || size != tt.size {
+			t.Errorf("SaltSize(%s) = %d, %v, want %d", tt.method, size, err, tt.size)
+			continue
+		}
+		
+		key := bytes.Repeat([]byte{0x42}, tt.size)
+		c, err := NewCipher(tt.method, key)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.method, err)
+		}
+		if len(c.Salt) != tt.size {
+			t.Errorf("%s: TCP salt of %d bytes, want %d", tt.method, len(c.Salt), tt.size)
+		}
+		
+		// UDP sessions are keyed by a session ID of the same size for
+		// every method, unrelated to the salt size.
+		session, err := NewUDPSession(tt.method, key)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.method, err)
+		}
+		if len(session.ID) != SessionIDSize {
+			t.Errorf("%s: session ID of %d bytes, want %d", tt.method, len(session.ID), SessionIDSize)
+		}
+	}
+	
+	if _, err := SaltSize("aes-128-gcm"); err == nil {
+		t.Error("SaltSize of a method without 2022 framing succeeded")
+	}
+}
+
+func TestCipherCountersIndependent(t *testing.T) {
+	for _, method := range testMethods {
+		key := testKey(t, method)
+		enCipher, err := NewCipher(method, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The peer of enCipher, and another cipher with the same salt.
+		deCipher, err := NewCipherWithSalt(method, key, enCipher.Salt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		twin, err := NewCipherWithSalt(method, key, enCipher.Salt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if enCipher.Counter == deCipher.Counter || deCipher.Counter == twin.Counter {
+			t.Fatalf("%s: ciphers share a Counter", method)
+		}
+		
+		// Sealing advances only the sealing cipher.
+		var sealed [][]byte
+		for _, msg := range []string{"one", "two", "three"} {
+			sealed = append(sealed, enCipher.Seal(nil, []byte(msg)))
+		}
+		if !bytes.Equal(deCipher.Counter.Nonce(), make([]byte, 12)) {
+			t.Fatalf("%s: sealing advanced the nonce of the peer", method)
+		}
+		for i, msg := range []string{"one", "two", "three"} {
+			plain, err := deCipher.Open(nil, sealed[i])
+			if err != nil || string(plain) != msg {
+				t.Fatalf("%s: Open %d = %q, %v, want %q", method, i, plain, err, msg)
+			}
+		}
+		if !bytes.Equal(enCipher.Counter.Nonce(), deCipher.Counter.Nonce()) {
+			t.Fatalf("%s: nonces out of step after as many seals as opens", method)
+		}
+		if !bytes.Equal(twin.Counter.Nonce(), make([]byte, 12)) {
+			t.Fatalf("%s: opening advanced the nonce of another cipher", method)
+		}
+	}
+}
+
+func TestConnCiphersIndependent(t *testing.T) {
+	method := testMethods[0]
+	enCipher, err := NewCipher(method, testKey(t, method))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, _ := responseHeader(t, enCipher, []byte("hello"))
+	conn := newConn(&scriptConn{r: bytes.NewReader(stream)}, enCipher, testTarget(t), nil)
+	if _, err := conn.Read(make([]byte, 16)); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if conn.deCipher == nil || conn.deCipher.Counter == conn.enCipher.Counter {
+		t.Fatal("the response cipher shares the Counter of the request cipher")
+	}
+}
+
+func TestCipherSaltSizeValidated(t *testing.T) {
+	for _, method := range testMethods {
+		key := testKey(t, method)
+		size, err := SaltSize(method)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, n := range []int{0, SessionIDSize, size - 1, size, size + 1, 2 * size} {
+			_, err := NewCipherWithSalt(method, key, make([]byte, n))
+			if valid := n == size; (err == nil) != valid {
+				t.Errorf("%s: NewCipherWithSalt with a %d byte salt = %v, want success %v", method, n, err, valid)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidSaltSize) {
+				t.Errorf("%s: error %v is not ErrInvalidSaltSize", method, err)
+			}
+			
+			// Session ciphers take a session ID instead.
+			_, err = NewSessionCipher(method, key, make([]byte, n))
+			if valid := n == SessionIDSize; (err == nil) != valid {
+				t.Errorf("%s: NewSessionCipher with a %d byte session ID = %v, want success %v", method, n, err, valid)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidSaltSize) {
+				t.Errorf("%s: error %v is not ErrInvalidSaltSize", method, err)
+			}
+		}
+	}
+}
+
+func TestBlake3DeriveKeyValidated(t *testing.T) {
+	tests := []struct {
+		name      string
+		key, salt []byte
+		err       error
+		message   string
+	}{
+		{"empty key", nil, make([]byte, 16), ErrInvalidKeySize, "0 bytes, want 16 or 32"},
+		{"short key", make([]byte, 8), make([]byte, 16), ErrInvalidKeySize, "8 bytes, want 16 or 32"},
+		{"empty salt", make([]byte, 16), nil, ErrInvalidSaltSize, "empty salt"},
+	}
+	for _, tt := range tests {
+		subkey, err := Blake3DeriveKey(tt.key, tt.salt)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.message) {
+			t.Errorf("%s: error %q does not say %q", tt.name, err, tt.message)
+		}
+		if subkey != nil {
+			t.Errorf("%s: returned a %d byte subkey along with the error", tt.name, len(subkey))
+		}
+	}
+	
+	// The errors surface through the cipher constructors.
+	for _, method := range testMethods {
+		if _, err := NewCipher(method, nil); !errors.Is(err, ErrInvalidKeySize) {
+			t.Errorf("%s: NewCipher with an empty key = %v, want ErrInvalidKeySize", method, err)
+		}
+		if _, err := NewSessionCipher(method, nil, make([]byte, SessionIDSize)); !errors.Is(err, ErrInvalidKeySize) {
+			t.Errorf("%s: NewSessionCipher with an empty key = %v, want ErrInvalidKeySize", method, err)
+		}
+	}
+}
+
+func TestBlake3DeriveKeyKeepsKey(t *testing.T) {
+	// A key with spare capacity must not get the salt appended in place.
+	buf := bytes.Repeat([]byte{0xaa}, 48)
+	key := buf[:16]
+	if _, err := Blake3DeriveKey(key, bytes.Repeat([]byte{0x55}, 16)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, bytes.Repeat([]byte{0xaa}, 48)) {
+		t.Fatalf("key buffer changed to % x", buf)
+	}
+}
@@ -0,0 +1,96 @@
+package shadowsocks
+
+import (
+	"context"
+	"crypto/rand"
+	"io"
+	"kage/core"
+	"net"
+	"time"
+)
+
+const DefaultConnectTimeout = 3 * time.Second
+
+// DefaultHandshakeTimeout bounds the wait for the response header after the
+// first payload was sent, when no HandshakeTimeout is set. It is generous,
+// since servers send the header along with the first reply of the target,
+// which may take a while.
+const DefaultHandshakeTimeout = 60 * time.Second
+
+// Dialer opens shadowsocks connections through a single server.
+type Dialer struct {
+	ServerAddr string
+	Method     string
+	Key        []byte
+	NoPadding  bool
+	Padder     Padder
+	// PadWithPayload pads requests with an initial payload too, see
+	// Conn.PadWithPayload.
+	PadWithPayload bool
+	// ChunkSize limits the payload of each chunk written, see Conn.MaxChunkSize.
+	ChunkSize int
+	
+	// ConnectTimeout bounds the TCP dial to the server.
+	// DefaultConnectTimeout is used when it is zero.
+	ConnectTimeout time.Duration
+	// HandshakeTimeout bounds the wait for the server response header, see
+	// Conn.HandshakeTimeout.
+	HandshakeTimeout time.Duration
+	// HandshakeDeadline also bounds that wait when set.
+	HandshakeDeadline time.Time
+	// CoalesceDelay holds small writes to batch them, see Conn.CoalesceDelay.
+	CoalesceDelay time.Duration
+	// DSCP marks the packets sent to the server with this code point.
+	// Zero leaves the marking unchanged.
+	DSCP int
+	// SaltSource provides the connection salts. Nil means crypto/rand.
+	SaltSource io.Reader
+	// TargetLog reduces the targets logged by the connections.
+	TargetLog core.TargetLogMode
+	// HandshakeDump logs the handshakes of the first connections in hex.
+	// Nil dumps none.
+	HandshakeDump *HandshakeDump
+	// TapLimit installs a LogTap on every connection that logs up to this
+	// many bytes of plaintext in each direction. Zero disables it.
+	TapLimit int
+}
+
+// Dial connects to the server and returns a Conn to targetAddr. The request
+// header is not sent before the first Write.
+func (d *Dialer) Dial(ctx context.Context, targetAddr *core.Address, initialPayload []byte) (*Conn, error) {
+	timeout := d.ConnectTimeout
+	if timeout == 0 {
+		timeout = DefaultConnectTimeout
+	}
+	
+	nd := &net.Dialer{Timeout: timeout, Control: dscpControl(d.DSCP)}
+	serverConn, err := nd.DialContext(ctx, "tcp", d.ServerAddr)
+	if err != nil {
+		return nil, err
+	}
+	
+	src := d.SaltSource
+	if src == nil {
+		src = rand.Reader
+	}
+	enCipher, err := NewCipherFrom(d.Method, d.Key, src)
+	if err != nil {
+		serverConn.Close()
+		return nil, err
+	}
+	conn := newConn(serverConn, enCipher, targetAddr, initialPayload)
+	conn.NoPadding = d.NoPadding
+	conn.Padder = d.Padder
+	conn.PadWithPayload = d.PadWithPayload
+	conn.MaxChunkSize = d.ChunkSize
+	conn.HandshakeTimeout = d.HandshakeTimeout
+	conn.HandshakeDeadline = d.HandshakeDeadline
+	conn.CoalesceDelay = d.CoalesceDelay
+	conn.targetLog = d.TargetLog
+	conn.handshakeDump = d.HandshakeDump
+	if d.TapLimit > 0 {
+		conn.Tap = &LogTap{Target: targetAddr.String(), Limit: d.TapLimit, TargetLog: d.TargetLog}
+		conn.Tap.Sent(initialPayload)
+	}
+	return conn, nil
+}
@@ -0,0 +1,67 @@
+//go:build linux
+
+package shadowsocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fullBacklogServer returns the address of a listener whose accept queue is
+// full, so that further connection attempts hang as with an unreachable
+// server.
+func fullBacklogServer(t testing.TB) string {
+	t.Helper()
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { syscall.Close(fd) })
+	if err = syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = syscall.Listen(fd, 0); err != nil {
+		t.Fatal(err)
+	}
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := fmt.Sprintf("127.0.0.1:%d", sa.(*syscall.SockaddrInet4).Port)
+	
+	// The one connection the backlog holds; it is never accepted.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return addr
+}
+
+func TestDialerConnectTimeout(t *testing.T) {
+	d := &Dialer{
+		ServerAddr:       fullBacklogServer(t),
+		Method:           testMethods[0],
+		Key:              testKey(t, testMethods[0]),
+		ConnectTimeout:   100 * time.Millisecond,
+		HandshakeTimeout: time.Minute,
+	}
+	start := time.Now()
+	conn, err := d.Dial(context.Background(), testTarget(t), nil)
+	if err == nil {
+		conn.Close()
+		t.Fatal("Dial to a server that never accepts succeeded")
+	}
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("Dial error = %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Dial gave up after %v, want about the 100ms connect timeout", elapsed)
+	}
+}
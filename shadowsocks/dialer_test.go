@@ -0,0 +1,330 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// silentServer accepts connections and never answers, until the test ends.
+func silentServer(t testing.TB) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		mu    sync.Mutex
+		conns []net.Conn
+	)
+	t.Cleanup(func() {
+		ln.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestDialerHandshakeTimeout(t *testing.T) {
+	d := &Dialer{
+		ServerAddr:       silentServer(t),
+		Method:           testMethods[0],
+		Key:              testKey(t, testMethods[0]),
+		ConnectTimeout:   time.Second,
+		HandshakeTimeout: 100 * time.Millisecond,
+	}
+	conn, err := d.Dial(context.Background(), testTarget(t), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	
+	start := time.Now()
+	_, err = conn.Read(make([]byte, 16))
+	if !errors.Is(err, ErrHandshakeTimeout) {
+		t.Fatalf("Read error = %v, want ErrHandshakeTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Read gave up after %v, want about the 100ms handshake timeout", elapsed)
+	}
+}
+
+func TestDialerHandshakeTimeoutInitialPayload(t *testing.T) {
+	d := &Dialer{
+		ServerAddr:       silentServer(t),
+		Method:           testMethods[0],
+		Key:              testKey(t, testMethods[0]),
+		HandshakeTimeout: 100 * time.Millisecond,
+	}
+	conn, err := d.Dial(context.Background(), testTarget(t), []byte("GET / HTTP/1.1\r\n\r\n"))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	// The request header carries the payload, so sending it starts the wait.
+	if _, err := conn.Write(nil); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	
+	start := time.Now()
+	if _, err = conn.Read(make([]byte, 16)); !errors.Is(err, ErrHandshakeTimeout) {
+		t.Fatalf("Read error = %v, want ErrHandshakeTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Read gave up after %v, want about the 100ms handshake timeout", elapsed)
+	}
+}
+
+func TestDialerIdleConnNoHandshakeTimeout(t *testing.T) {
+	d := &Dialer{
+		ServerAddr:       silentServer(t),
+		Method:           testMethods[0],
+		Key:              testKey(t, testMethods[0]),
+		HandshakeTimeout: 50 * time.Millisecond,
+	}
+	conn, err := d.Dial(context.Background(), testTarget(t), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(nil); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	
+	// A client-first protocol that has sent nothing yet gets no answer
+	// either, and must not be cut off for it.
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 16))
+		readErr <- err
+	}()
+	select {
+	case err := <-readErr:
+		t.Fatalf("Read on an idle connection returned %v", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+	
+	// Once the client sends its request, the timeout applies.
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	select {
+	case err := <-readErr:
+		if !errors.Is(err, ErrHandshakeTimeout) {
+			t.Fatalf("Read error = %v, want ErrHandshakeTimeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Read not timed out after the request was sent")
+	}
+}
+
+// countingHandler counts the records whose message has a prefix.
+type countingHandler struct {
+	prefix string
+	mu     sync.Mutex
+	n      int
+	hex    []string
+}
+
+func (h *countingHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *countingHandler) Handle(_ context.Context, r slog.Record) error {
+	if strings.HasPrefix(r.Message, h.prefix) {
+		h.mu.Lock()
+		h.n++
+		r.Attrs(func(a slog.Attr) bool {
+			if a.Key == "hex" {
+				h.hex = append(h.hex, a.Value.String())
+			}
+			return true
+		})
+		h.mu.Unlock()
+	}
+	return nil
+}
+
+func (h *countingHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *countingHandler) WithGroup(string) slog.Handler      { return h }
+
+func (h *countingHandler) count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.n
+}
+
+// hexDumps returns the hex attributes of the records counted so far.
+func (h *countingHandler) hexDumps() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return slices.Clone(h.hex)
+}
+
+func TestDialerHandshakeDump(t *testing.T) {
+	h := &countingHandler{prefix: "[Shadowsocks] client handshake"}
+	old := slog.Default()
+	slog.SetDefault(slog.New(h))
+	t.Cleanup(func() { slog.SetDefault(old) })
+	
+	server := silentServer(t)
+	dial := func(dump *HandshakeDump) {
+		t.Helper()
+		d := &Dialer{
+			ServerAddr:    server,
+			Method:        testMethods[0],
+			Key:           testKey(t, testMethods[0]),
+			HandshakeDump: dump,
+		}
+		conn, err := d.Dial(context.Background(), testTarget(t), nil)
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		defer conn.Close()
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	
+	for range 3 {
+		dial(nil)
+	}
+	if n := h.count(); n != 0 {
+		t.Fatalf("%d handshakes dumped without a HandshakeDump, want none", n)
+	}
+	
+	// Dialers sharing a dump count against the same budget.
+	dump := NewHandshakeDump(2)
+	for range 4 {
+		dial(dump)
+	}
+	if n := h.count(); n != 2 {
+		t.Fatalf("%d handshakes dumped, want the first 2", n)
+	}
+	
+	// Other dumps keep their own budget.
+	dial(NewHandshakeDump(1))
+	if n := h.count(); n != 3 {
+		t.Fatalf("%d handshakes dumped, want 3 with a second dump", n)
+	}
+}
+
+func TestDialerTapLimit(t *testing.T) {
+	h := &countingHandler{prefix: "[Shadowsocks] tap"}
+	old := slog.Default()
+	slog.SetDefault(slog.New(h))
+	t.Cleanup(func() { slog.SetDefault(old) })
+	
+	server := silentServer(t)
+	dial := func(limit int, writes ...string) {
+		t.Helper()
+		d := &Dialer{
+			ServerAddr: server,
+			Method:     testMethods[0],
+			Key:        testKey(t, testMethods[0]),
+			TapLimit:   limit,
+		}
+		conn, err := d.Dial(context.Background(), testTarget(t), nil)
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		defer conn.Close()
+		for _, w := range writes {
+			if _, err := conn.Write([]byte(w)); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+		}
+	}
+	
+	dial(0, "hello")
+	if n := h.count(); n != 0 {
+		t.Fatalf("%d tap records without a TapLimit, want none", n)
+	}
+	
+	// Each Dialer applies its own limit, to each connection anew.
+	dial(4, "hello", "world")
+	dial(8, "hello", "world")
+	want := []string{hex.EncodeToString([]byte("hell")), hex.EncodeToString([]byte("hello")), hex.EncodeToString([]byte("wor"))}
+	if got := h.hexDumps(); !slices.Equal(got, want) {
+		t.Fatalf("tapped %q, want %q", got, want)
+	}
+}
+
+func TestDialerSaltSource(t *testing.T) {
+	method := testMethods[0]
+	saltSize, err := SaltSize(method)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	salts := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		salt := make([]byte, saltSize)
+		if _, err := io.ReadFull(conn, salt); err != nil {
+			salt = nil
+		}
+		salts <- salt
+	}()
+	
+	want := bytes.Repeat([]byte{0x5a}, saltSize)
+	d := &Dialer{
+		ServerAddr: ln.Addr().String(),
+		Method:     method,
+		Key:        testKey(t, method),
+		SaltSource: bytes.NewReader(want),
+	}
+	conn, err := d.Dial(context.Background(), testTarget(t), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	select {
+	case got := <-salts:
+		if !bytes.Equal(got, want) {
+			t.Fatalf("server got salt % x, want % x from SaltSource", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no salt arrived at the server")
+	}
+	
+	// The source is drained now, so the next connection cannot get a salt.
+	if _, err := d.Dial(context.Background(), testTarget(t), nil); !errors.Is(err, io.EOF) {
+		t.Fatalf("Dial with a drained SaltSource = %v, want EOF", err)
+	}
+}
@@ -0,0 +1,19 @@
+package shadowsocks
+
+// Features lists the optional features available in this build, for
+// compatibility checks by operators and embedding applications:
+//
+//   - "fast_open": an initial payload sent in the request header. This is
+//     the SIP022 mechanism, not the kernel's TCP Fast Open.
+//   - "udp": UDP relay through the server.
+//   - "dscp": DSCP marking of packets to the server, see DSCPSupported.
+//
+// Kernel TCP Fast Open, splice, multiplexing, TLS camouflage and the legacy
+// AEAD methods are not implemented and never listed.
+func Features() []string {
+	features := []string{"fast_open", "udp"}
+	if DSCPSupported {
+		features = append(features, "dscp")
+	}
+	return features
+}
@@ -0,0 +1,29 @@
+package shadowsocks
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestFeatures(t *testing.T) {
+	features := Features()
+	for _, f := range []string{"fast_open", "udp"} {
+		if !slices.Contains(features, f) {
+			t.Errorf("Features() = %q, missing baseline %q", features, f)
+		}
+	}
+	if got := slices.Contains(features, "dscp"); got != DSCPSupported {
+		t.Errorf("Features() lists dscp: %v, want %v as DSCPSupported", got, DSCPSupported)
+	}
+	for _, f := range []string{"tcp_fast_open", "splice", "mux", "tls", "legacy_ciphers"} {
+		if slices.Contains(features, f) {
+			t.Errorf("Features() = %q, lists unimplemented %q", features, f)
+		}
+	}
+	
+	sorted := slices.Clone(features)
+	slices.Sort(sorted)
+	if len(slices.Compact(sorted)) != len(features) {
+		t.Errorf("Features() = %q, has duplicates", features)
+	}
+}
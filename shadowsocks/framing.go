@@ -0,0 +1,63 @@
+package shadowsocks
+
+import "fmt"
+
+// Framing lists the bytes a method adds around the payload, in the units
+// needed to reason about MTU and throughput. Sizes that depend on the target
+// address or on padding exclude both.
+type Framing struct {
+	Method       string
+	KeySize      int
+	AEADOverhead int
+	// MaxPayload is the largest payload of one TCP chunk.
+	MaxPayload int
+	// ChunkOverhead is added to every TCP chunk: the sealed length and the
+	// tag of the payload.
+	ChunkOverhead int
+	// RequestOverhead is the request header of a TCP connection: salt,
+	// sealed fixed-length header and the padding length and tag of the
+	// variable-length header.
+	RequestOverhead int
+	// ResponseOverhead is the response header of a TCP connection, whose
+	// variable-length part carries the first payload.
+	ResponseOverhead int
+	// UDPSeparateHeader is the session and packet ID block, including the
+	// nonce that precedes it with chacha20.
+	UDPSeparateHeader int
+	// UDPOverhead is everything a client packet adds to its payload.
+	UDPOverhead int
+}
+
+// fixedHeaderLen is the type, timestamp and length of a request
+// fixed-length header.
+const fixedHeaderLen = 1 + 8 + 2
+
+// MethodFraming returns the Framing of method.
+func MethodFraming(method string) (Framing, error) {
+	keySize, err := SaltSize(method)
+	if err != nil {
+		return Framing{}, err
+	}
+	c, err := newCipher(method, make([]byte, keySize), make([]byte, keySize))
+	if err != nil {
+		return Framing{}, fmt.Errorf("framing of %s: %w", method, err)
+	}
+	overhead := c.AEAD.Overhead()
+	
+	separateHeader := 16
+	if method == "2022-blake3-chacha20-poly1305" {
+		separateHeader += 24 // XChaCha20-Poly1305 nonce
+	}
+	
+	return Framing{
+		Method:            method,
+		KeySize:           keySize,
+		AEADOverhead:      overhead,
+		MaxPayload:        MaxPayloadSize,
+		ChunkOverhead:     2 + 2*overhead,
+		RequestOverhead:   keySize + fixedHeaderLen + overhead + 2 + overhead,
+		ResponseOverhead:  keySize + fixedHeaderLen + keySize + 2*overhead,
+		UDPSeparateHeader: separateHeader,
+		UDPOverhead:       separateHeader + fixedHeaderLen + overhead,
+	}, nil
+}
@@ -4,15 +4,20 @@ import (
 	crand "crypto/rand"
 	"encoding/binary"
 	"kage/core"
-	"math/rand/v2"
 	"time"
 )
 
-func PackRequestHeader(targetAddr *core.Address, initialPayload []byte) (fixedLenHeader, varLenHeader []byte, err error) {
+const MaxPaddingLength = 900
+
+// RandomPaddingLength returns a padding length in [1, MaxPaddingLength).
+func RandomPaddingLength() int {
+	return RandomPadder{}.PaddingLength(MaxPaddingLength)
+}
+
+func PackRequestHeader(targetAddr *core.Address, initialPayload []byte, paddingSize int) (fixedLenHeader, varLenHeader []byte, err error) {
 	addr := targetAddr.Bytes()
 	
-	n := rand.IntN(899) + 1
-	padding := make([]byte, n)
+	padding := make([]byte, paddingSize)
 	_, err = crand.Read(padding)
 	if err != nil {
 		return nil, nil, err
@@ -26,7 +31,7 @@ func PackRequestHeader(targetAddr *core.Address, initialPayload []byte) (fixedLe
 	vlHeader = append(vlHeader, padding...)
 	vlHeader = append(vlHeader, initialPayload...)
 	
-	flHeader := make([]byte, 0, 11)
+	flHeader := make([]byte, 0, fixedHeaderLen)
 	flHeader = append(flHeader, 0)
 	flHeader = binary.BigEndian.AppendUint64(flHeader, uint64(time.Now().Unix()))
 	flHeader = binary.BigEndian.AppendUint16(flHeader, uint16(len(vlHeader)))
@@ -0,0 +1,119 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"kage/core"
+	"testing"
+)
+
+var errRequestHeader = errors.New("invalid request header")
+
+// readRequestHeader is the server side of BuildClientHandshake: it reads the
+// salt and both request headers from r and returns the receiving cipher, the
+// target and the initial payload.
+func readRequestHeader(r io.Reader, method string, key []byte) (*Cipher, *core.Address, []byte, error) {
+	c, addr, padding, rest, err := readRequestFields(r, method, key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return c, addr, rest[padding:], nil
+}
+
+// readRequestFields is readRequestHeader, but returns the padding length and
+// the rest of the variable-length header, padding first.
+func readRequestFields(r io.Reader, method string, key []byte) (c *Cipher, addr *core.Address, padding int, rest []byte, err error) {
+	salt := make([]byte, len(key))
+	if _, err = io.ReadFull(r, salt); err != nil {
+		return
+	}
+	c, err = NewCipherWithSalt(method, key, salt)
+	if err != nil {
+		return
+	}
+	
+	fixed := make([]byte, fixedHeaderLen+c.AEAD.Overhead())
+	if _, err = io.ReadFull(r, fixed); err != nil {
+		return
+	}
+	fixed, err = c.Open(fixed[:0], fixed)
+	if err != nil {
+		return
+	}
+	if fixed[0] != 0 {
+		err = errRequestHeader
+		return
+	}
+	
+	variable := make([]byte, int(binary.BigEndian.Uint16(fixed[9:]))+c.AEAD.Overhead())
+	if _, err = io.ReadFull(r, variable); err != nil {
+		return
+	}
+	variable, err = c.Open(variable[:0], variable)
+	if err != nil {
+		return
+	}
+	
+	addr, err = core.ReadAddressFromBytes(variable)
+	if err != nil {
+		return
+	}
+	rest = variable[len(addr.Bytes()):]
+	if len(rest) < 2 {
+		err = errRequestHeader
+		return
+	}
+	padding = int(binary.BigEndian.Uint16(rest))
+	rest = rest[2:]
+	if padding > len(rest) {
+		err = errRequestHeader
+	}
+	return
+}
+
+func FuzzBuildClientHandshake(f *testing.F) {
+	f.Add("example.com", uint16(443), []byte("GET / HTTP/1.1\r\n\r\n"), 0)
+	f.Add("a", uint16(0), []byte{}, 40)
+	f.Add("localhost", uint16(65535), bytes.Repeat([]byte{0xff}, 1400), -1)
+	
+	method := testMethods[0]
+	key := bytes.Repeat([]byte{0x42}, 16)
+	f.Fuzz(func(t *testing.T, domain string, port uint16, payload []byte, flip int) {
+		if len(domain) == 0 || len(domain) > core.MaxDomainLength || len(payload) > 60000 {
+			t.Skip()
+		}
+		target := &core.Address{Type: core.AtypDomainName, Host: []byte(domain), Port: port}
+		c, err := NewCipher(method, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handshake, err := BuildClientHandshake(target, payload, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		
+		_, addr, got, err := readRequestHeader(bytes.NewReader(handshake), method, key)
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if addr.String() != target.String() {
+			t.Fatalf("target = %s, want %s", addr, target)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Fatalf("payload = %x, want %x", got, payload)
+		}
+		
+		// Every byte is covered by the salt or an AEAD tag, so any flipped
+		// bit has to be rejected, never parsed into something else.
+		if flip < 0 {
+			return
+		}
+		mutated := bytes.Clone(handshake)
+		mutated[flip%len(mutated)] ^= 0x01
+		if _, _, _, err := readRequestHeader(bytes.NewReader(mutated), method, key); err == nil {
+			t.Fatalf("mutated handshake at byte %d accepted", flip%len(mutated))
+		}
+	})
+}
@@ -0,0 +1,83 @@
+package shadowsocks
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
+
+type memPacket struct {
+	data []byte
+	from net.Addr
+}
+
+// memPacketConn is one end of an in-memory datagram pipe. It serves both as
+// a net.PacketConn and, for the server side of a UDPClient, as a connected
+// net.Conn. Packets written to one end arrive whole at the other, whatever
+// address they are sent to.
+type memPacketConn struct {
+	local net.Addr
+	peer  *memPacketConn
+	in    chan memPacket
+	
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// newMemPacketPair returns the two connected ends named a and b.
+func newMemPacketPair(a, b string) (*memPacketConn, *memPacketConn) {
+	ca := &memPacketConn{local: memAddr(a), in: make(chan memPacket, 64), closed: make(chan struct{})}
+	cb := &memPacketConn{local: memAddr(b), in: make(chan memPacket, 64), closed: make(chan struct{})}
+	ca.peer, cb.peer = cb, ca
+	return ca, cb
+}
+
+func (c *memPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case pkt := <-c.in:
+		return copy(p, pkt.data), pkt.from, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *memPacketConn) WriteTo(p []byte, _ net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	select {
+	case c.peer.in <- memPacket{data: append([]byte(nil), p...), from: c.local}:
+	case <-c.peer.closed:
+		// Like UDP, datagrams to a closed end are lost silently.
+	}
+	return len(p), nil
+}
+
+func (c *memPacketConn) Read(p []byte) (int, error) {
+	n, _, err := c.ReadFrom(p)
+	return n, err
+}
+
+func (c *memPacketConn) Write(p []byte) (int, error) {
+	return c.WriteTo(p, c.peer.local)
+}
+
+func (c *memPacketConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *memPacketConn) LocalAddr() net.Addr  { return c.local }
+func (c *memPacketConn) RemoteAddr() net.Addr { return c.peer.local }
+
+func (c *memPacketConn) SetDeadline(t time.Time) error      { return os.ErrNoDeadline }
+func (c *memPacketConn) SetReadDeadline(t time.Time) error  { return os.ErrNoDeadline }
+func (c *memPacketConn) SetWriteDeadline(t time.Time) error { return os.ErrNoDeadline }
@@ -0,0 +1,43 @@
+package shadowsocks
+
+import "math/rand/v2"
+
+// Padder picks the padding length of a request header. max is the exclusive
+// upper bound the header allows; results outside [0, max) are clamped.
+type Padder interface {
+	PaddingLength(max int) int
+}
+
+// RandomPadder picks a uniformly random length in [1, max). It is used when
+// no Padder is set.
+type RandomPadder struct{}
+
+func (RandomPadder) PaddingLength(max int) int {
+	return rand.IntN(max-1) + 1
+}
+
+// FixedPadder always pads to the same length.
+type FixedPadder int
+
+func (f FixedPadder) PaddingLength(int) int {
+	return int(f)
+}
+
+// RangePadder picks a uniformly random length in [Min, Max].
+type RangePadder struct {
+	Min, Max int
+}
+
+func (r RangePadder) PaddingLength(int) int {
+	if r.Max <= r.Min {
+		return r.Min
+	}
+	return r.Min + rand.IntN(r.Max-r.Min+1)
+}
+
+func choosePadding(p Padder, limit int) int {
+	if p == nil {
+		p = RandomPadder{}
+	}
+	return min(max(p.PaddingLength(limit), 0), limit-1)
+}
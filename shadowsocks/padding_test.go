@@ -0,0 +1,93 @@
+package shadowsocks
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestChoosePadding(t *testing.T) {
+	const limit = 100
+	tests := []struct {
+		name     string
+		padder   Padder
+		min, max int
+	}{
+		{"default", nil, 1, limit - 1},
+		{"fixed", FixedPadder(37), 37, 37},
+		{"fixed zero", FixedPadder(0), 0, 0},
+		{"fixed negative", FixedPadder(-5), 0, 0},
+		{"fixed at limit", FixedPadder(limit), limit - 1, limit - 1},
+		{"fixed above limit", FixedPadder(5000), limit - 1, limit - 1},
+		{"range", RangePadder{Min: 10, Max: 20}, 10, 20},
+		{"range single", RangePadder{Min: 5, Max: 5}, 5, 5},
+		{"range reversed", RangePadder{Min: 8, Max: 3}, 8, 8},
+		{"range negative", RangePadder{Min: -10, Max: -5}, 0, 0},
+		{"range across zero", RangePadder{Min: -10, Max: 10}, 0, 10},
+		{"range across limit", RangePadder{Min: 90, Max: 200}, 90, limit - 1},
+		{"range above limit", RangePadder{Min: 200, Max: 300}, limit - 1, limit - 1},
+	}
+	for _, tt := range tests {
+		for range 200 {
+			if got := choosePadding(tt.padder, limit); got < tt.min || got > tt.max {
+				t.Errorf("%s: padding %d, want within [%d, %d]", tt.name, got, tt.min, tt.max)
+				break
+			}
+		}
+	}
+}
+
+func TestConnFixedPadder(t *testing.T) {
+	method := testMethods[0]
+	key := testKey(t, method)
+	target := testTarget(t)
+	tests := []struct {
+		padder FixedPadder
+		want   int
+	}{
+		{37, 37},
+		{MaxPaddingLength + 100, MaxPaddingLength - 1},
+		// Without an initial payload the header must carry some padding.
+		{0, 1},
+		{-3, 1},
+	}
+	for _, tt := range tests {
+		padder := tt.padder
+		enCipher, err := NewCipher(method, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := &scriptConn{}
+		conn := newConn(rec, enCipher, target, nil)
+		conn.Padder = padder
+		if _, err := conn.Write(nil); err != nil {
+			t.Fatal(err)
+		}
+		
+		// The exact length on the wire: salt, sealed fixed-length header and
+		// sealed address, padding length and padding.
+		padding := tt.want
+		overhead := enCipher.AEAD.Overhead()
+		want := len(key) + fixedHeaderLen + overhead + len(target.Bytes()) + 2 + padding + overhead
+		if rec.w.Len() != want {
+			t.Errorf("FixedPadder(%d): %d bytes written, want %d", padder, rec.w.Len(), want)
+		}
+		if _, _, got, _, err := readRequestFields(&rec.w, method, key); err != nil || got != padding {
+			t.Errorf("FixedPadder(%d): padding %d, %v, want %d", padder, got, err, padding)
+		}
+	}
+}
+
+func TestUDPFixedPadder(t *testing.T) {
+	for _, method := range testMethods {
+		c := newTestUDPClient(t, method)
+		c.Padder = FixedPadder(42)
+		packet, err := c.EncryptPacket(benchClient, append(testTarget(t).Bytes(), "ping"...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, body := openClientPacket(t, c, packet)
+		if got := binary.BigEndian.Uint16(body[9:11]); got != 42 {
+			t.Errorf("%s: padding %d, want 42", method, got)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"io"
+	"kage/core"
+	"net"
+	"testing"
+	"time"
+)
+
+// testServer is the server end of a Conn over net.Pipe. It decodes what the
+// client sends and answers with sealed chunks, so that tests can push data
+// through the whole encrypt, frame and decrypt pipeline without a socket.
+type testServer struct {
+	t      testing.TB
+	conn   net.Conn
+	method string
+	key    []byte
+	
+	deCipher *Cipher
+	enCipher *Cipher
+	
+	target         *core.Address
+	initialPayload []byte
+}
+
+// newTestPair returns a client Conn to testTarget and the server end it
+// talks to. Both ends are closed when the test ends.
+func newTestPair(t testing.TB, method string, initialPayload []byte) (*Conn, *testServer) {
+	t.Helper()
+	key := testKey(t, method)
+	clientEnd, serverEnd := net.Pipe()
+	t.Cleanup(func() {
+		clientEnd.Close()
+		serverEnd.Close()
+	})
+	
+	client, err := NewConn(clientEnd, method, key, testTarget(t), initialPayload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, &testServer{t: t, conn: serverEnd, method: method, key: key}
+}
+
+// accept reads the request header.
+func (s *testServer) accept() error {
+	c, target, payload, err := readRequestHeader(s.conn, s.method, s.key)
+	if err != nil {
+		return err
+	}
+	s.deCipher, s.target, s.initialPayload = c, target, payload
+	return nil
+}
+
+// readChunk reads and opens the next chunk.
+func (s *testServer) readChunk() ([]byte, error) {
+	return openChunk(s.conn, s.deCipher)
+}
+
+// readFull reads chunks until n bytes of payload arrived.
+func (s *testServer) readFull(n int) ([]byte, error) {
+	var data []byte
+	for len(data) < n {
+		chunk, err := s.readChunk()
+		if err != nil {
+			return data, err
+		}
+		data = append(data, chunk...)
+	}
+	return data, nil
+}
+
+// respond sends the response header carrying payload, then data split into
+// chunks.
+func (s *testServer) respond(payload, data []byte) error {
+	header, enCipher := responseHeader(s.t, s.deCipher, payload)
+	s.enCipher = enCipher
+	out := header
+	for len(data) > 0 {
+		n := min(len(data), MaxPayloadSize)
+		out = sealChunk(out, s.enCipher, data[:n])
+		data = data[n:]
+	}
+	_, err := s.conn.Write(out)
+	return err
+}
+
+func TestConnRoundTrip(t *testing.T) {
+	sizes := []int{1, 100, 16 * 1024, MaxPayloadSize, MaxPayloadSize + 1, 200000}
+	for _, method := range testMethods {
+		for _, size := range sizes {
+			client, server := newTestPair(t, method, []byte("initial"))
+			data := bytes.Repeat([]byte("0123456789abcdef"), size/16+1)[:size]
+			
+			errc := make(chan error, 1)
+			go func() {
+				if err := server.accept(); err != nil {
+					errc <- err
+					return
+				}
+				got, err := server.readFull(size)
+				if err != nil {
+					errc <- err
+					return
+				}
+				if !bytes.Equal(got, data) {
+					t.Errorf("%s/%d: server got %d bytes that differ from the %d sent", method, size, len(got), size)
+				}
+				errc <- server.respond([]byte("reply:"), got)
+			}()
+			
+			if _, err := client.Write(data); err != nil {
+				t.Fatalf("%s/%d: Write: %v", method, size, err)
+			}
+			got := make([]byte, len("reply:")+size)
+			if _, err := io.ReadFull(client, got); err != nil {
+				t.Fatalf("%s/%d: Read: %v", method, size, err)
+			}
+			if err := <-errc; err != nil {
+				t.Fatalf("%s/%d: server: %v", method, size, err)
+			}
+			
+			if server.target.String() != testTarget(t).String() {
+				t.Errorf("%s/%d: server target = %s", method, size, server.target)
+			}
+			if string(server.initialPayload) != "initial" {
+				t.Errorf("%s/%d: server initial payload = %q", method, size, server.initialPayload)
+			}
+			if !bytes.Equal(got, append([]byte("reply:"), data...)) {
+				t.Errorf("%s/%d: client read back different data", method, size)
+			}
+		}
+	}
+}
+
+// recordingTap keeps the plaintext it observes.
+type recordingTap struct {
+	sent, received []byte
+}
+
+func (t *recordingTap) Sent(p []byte)     { t.sent = append(t.sent, p...) }
+func (t *recordingTap) Received(p []byte) { t.received = append(t.received, p...) }
+
+func TestConnTap(t *testing.T) {
+	client, server := newTestPair(t, testMethods[0], nil)
+	tap := &recordingTap{}
+	client.Tap = tap
+	
+	errc := make(chan error, 1)
+	go func() {
+		if err := server.accept(); err != nil {
+			errc <- err
+			return
+		}
+		got, err := server.readFull(len("GET / HTTP/1.1"))
+		if err != nil {
+			errc <- err
+			return
+		}
+		errc <- server.respond([]byte("HTTP/1.1 "), append([]byte("200 OK for "), got...))
+	}()
+	
+	if _, err := client.Write([]byte("GET / HTTP/1.1")); err != nil {
+		t.Fatal(err)
+	}
+	want := "HTTP/1.1 200 OK for GET / HTTP/1.1"
+	if _, err := io.ReadFull(client, make([]byte, len(want))); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("server: %v", err)
+	}
+	
+	if string(tap.sent) != "GET / HTTP/1.1" {
+		t.Errorf("tap saw %q sent, want the plaintext %q", tap.sent, "GET / HTTP/1.1")
+	}
+	if string(tap.received) != want {
+		t.Errorf("tap saw %q received, want the plaintext %q", tap.received, want)
+	}
+}
+
+func TestConnTimeToFirstByte(t *testing.T) {
+	const delay = 150 * time.Millisecond
+	client, server := newTestPair(t, testMethods[0], nil)
+	start := time.Now()
+	if d := client.TimeToFirstByte(start); d != 0 {
+		t.Fatalf("TimeToFirstByte before any data = %v, want 0", d)
+	}
+	
+	errc := make(chan error, 1)
+	go func() {
+		if err := server.accept(); err != nil {
+			errc <- err
+			return
+		}
+		if _, err := server.readFull(len("ping")); err != nil {
+			errc <- err
+			return
+		}
+		time.Sleep(delay)
+		errc <- server.respond([]byte("pong"), []byte("more"))
+	}()
+	
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(client, make([]byte, len("pong"))); err != nil {
+		t.Fatal(err)
+	}
+	ttfb := client.TimeToFirstByte(start)
+	if elapsed := time.Since(start); ttfb < delay || ttfb > elapsed {
+		t.Fatalf("TimeToFirstByte = %v, want between the %v delay and %v", ttfb, delay, elapsed)
+	}
+	
+	// Later reads leave the first byte time alone.
+	if _, err := io.ReadFull(client, make([]byte, len("more"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("server: %v", err)
+	}
+	if d := client.TimeToFirstByte(start); d != ttfb {
+		t.Errorf("TimeToFirstByte changed from %v to %v", ttfb, d)
+	}
+}
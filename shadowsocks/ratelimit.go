@@ -0,0 +1,35 @@
+package shadowsocks
+
+import (
+	"sync"
+	"time"
+)
+
+// packetBucket is a token bucket counting packets. It holds up to one
+// second's worth of tokens, so short bursts pass at up to twice the rate.
+type packetBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token for one packet at rate packets per second and reports
+// whether there was one.
+func (b *packetBucket) allow(rate int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	
+	now := time.Now()
+	if b.last.IsZero() {
+		b.tokens = float64(rate)
+	} else {
+		b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*float64(rate), float64(rate))
+	}
+	b.last = now
+	
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,172 @@
+package shadowsocks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"kage/core"
+	"log/slog"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// RetryConn is a Conn that re-dials the server when the connection fails
+// before any payload has passed in either direction, e.g. because the server
+// resets it right after the handshake. Nothing the client sent can have
+// reached the target at that point, so the retry cannot deliver data twice.
+// Once a byte has been written or read, errors are returned as they are.
+type RetryConn struct {
+	ctx        context.Context
+	dialer     *Dialer
+	targetAddr *core.Address
+	retries    int
+	
+	mu     sync.Mutex
+	conn   *Conn
+	used   bool
+	closed bool
+}
+
+// DialRetry is like Dial, but the returned connection is re-dialed up to
+// retries times while no payload has been exchanged. An initial payload
+// counts as exchanged, since it is sent with the request header.
+func (d *Dialer) DialRetry(ctx context.Context, targetAddr *core.Address, initialPayload []byte, retries int) (*RetryConn, error) {
+	conn, err := d.Dial(ctx, targetAddr, initialPayload)
+	if err != nil {
+		return nil, err
+	}
+	return &RetryConn{
+		ctx:        ctx,
+		dialer:     d,
+		targetAddr: targetAddr,
+		retries:    retries,
+		conn:       conn,
+		used:       len(initialPayload) > 0,
+	}, nil
+}
+
+func (r *RetryConn) current() *Conn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.conn
+}
+
+func (r *RetryConn) Read(p []byte) (int, error) {
+	for {
+		conn := r.current()
+		n, err := conn.Read(p)
+		if n > 0 || err == nil || !earlyFailure(err) || !r.redial(conn, err) {
+			if n > 0 {
+				r.markUsed()
+			}
+			return n, err
+		}
+	}
+}
+
+func (r *RetryConn) Write(p []byte) (int, error) {
+	for {
+		r.mu.Lock()
+		conn := r.conn
+		if len(p) > 0 {
+			r.used = true
+		}
+		r.mu.Unlock()
+		
+		n, err := conn.Write(p)
+		// Only the header can have failed here; Write(nil) is how callers
+		// send it ahead of the first payload.
+		if len(p) > 0 || err == nil || !earlyFailure(err) || !r.redial(conn, err) {
+			return n, err
+		}
+	}
+}
+
+func (r *RetryConn) markUsed() {
+	r.mu.Lock()
+	r.used = true
+	r.mu.Unlock()
+}
+
+// redial replaces failed with a new connection if it is still current and
+// no payload has been exchanged. It reports whether the operation that saw
+// err should be tried again.
+func (r *RetryConn) redial(failed *Conn, err error) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	
+	if r.conn != failed {
+		return !r.closed // another goroutine has redialed already
+	}
+	if r.used || r.closed || r.retries <= 0 {
+		return false
+	}
+	
+	conn, dialErr := r.dialer.Dial(r.ctx, r.targetAddr, nil)
+	if dialErr != nil {
+		slog.Debug("[Shadowsocks] redial after early failure failed", r.dialer.TargetLog.Attr(r.targetAddr.String()), "err", err, "redialErr", dialErr)
+		return false
+	}
+	if _, dialErr = conn.Write(nil); dialErr != nil {
+		conn.Close()
+		return false
+	}
+	slog.Debug("[Shadowsocks] redialed after early failure", r.dialer.TargetLog.Attr(r.targetAddr.String()), "err", err)
+	
+	r.retries--
+	failed.Close()
+	r.conn = conn
+	return true
+}
+
+// earlyFailure reports whether err means the server dropped the connection,
+// as opposed to it being closed locally or timing out.
+func earlyFailure(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// TimeToFirstByte returns the time to first byte of the current connection,
+// see Conn.TimeToFirstByte.
+func (r *RetryConn) TimeToFirstByte(start time.Time) time.Duration {
+	return r.current().TimeToFirstByte(start)
+}
+
+func (r *RetryConn) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	return r.conn.Close()
+}
+
+func (r *RetryConn) CloseWrite() error {
+	return r.current().CloseWrite()
+}
+
+func (r *RetryConn) SetNoDelay(noDelay bool) error {
+	return r.current().SetNoDelay(noDelay)
+}
+
+func (r *RetryConn) LocalAddr() net.Addr {
+	return r.current().LocalAddr()
+}
+
+func (r *RetryConn) RemoteAddr() net.Addr {
+	return r.current().RemoteAddr()
+}
+
+func (r *RetryConn) SetDeadline(t time.Time) error {
+	return r.current().SetDeadline(t)
+}
+
+func (r *RetryConn) SetReadDeadline(t time.Time) error {
+	return r.current().SetReadDeadline(t)
+}
+
+func (r *RetryConn) SetWriteDeadline(t time.Time) error {
+	return r.current().SetWriteDeadline(t)
+}
@@ -0,0 +1,96 @@
+package shadowsocks
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+// resettingServer resets the first connection right after reading the
+// request header, and answers the following ones with "pong". It returns
+// its address and the number of connections it accepted.
+func resettingServer(t *testing.T, method string, key []byte) (string, *atomic.Int32) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			first := accepted.Add(1) == 1
+			go func() {
+				defer conn.Close()
+				c, _, _, err := readRequestHeader(conn, method, key)
+				if err != nil {
+					return
+				}
+				if first {
+					conn.(*net.TCPConn).SetLinger(0)
+					return
+				}
+				header, _ := responseHeader(t, c, []byte("pong"))
+				conn.Write(header)
+				conn.Read(make([]byte, 1))
+			}()
+		}
+	}()
+	return ln.Addr().String(), &accepted
+}
+
+func TestRetryConnRedialsEarlyReset(t *testing.T) {
+	method := testMethods[0]
+	key := testKey(t, method)
+	addr, accepted := resettingServer(t, method, key)
+	d := &Dialer{ServerAddr: addr, Method: method, Key: key}
+	
+	conn, err := d.DialRetry(context.Background(), testTarget(t), nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(nil); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Read after an early reset: %v", err)
+	}
+	if string(buf[:n]) != "pong" {
+		t.Fatalf("Read = %q, want pong", buf[:n])
+	}
+	if n := accepted.Load(); n != 2 {
+		t.Fatalf("server accepted %d connections, want 2", n)
+	}
+}
+
+func TestRetryConnKeepsFailureAfterPayload(t *testing.T) {
+	method := testMethods[0]
+	key := testKey(t, method)
+	addr, accepted := resettingServer(t, method, key)
+	d := &Dialer{ServerAddr: addr, Method: method, Key: key}
+	
+	conn, err := d.DialRetry(context.Background(), testTarget(t), nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// The payload may have reached the target, so it must not be resent.
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, 16)); err == nil {
+		t.Fatal("Read succeeded after the server reset the connection")
+	}
+	if n := accepted.Load(); n != 1 {
+		t.Fatalf("server accepted %d connections, want 1", n)
+	}
+}
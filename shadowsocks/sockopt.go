@@ -0,0 +1,51 @@
+package shadowsocks
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+)
+
+var (
+	ErrInvalidDSCP     = errors.New("dscp: value out of range 0-63")
+	ErrDSCPUnsupported = errors.New("dscp: not supported on this platform")
+)
+
+func ValidateDSCP(dscp int) error {
+	if dscp < 0 || dscp > 63 {
+		return ErrInvalidDSCP
+	}
+	return nil
+}
+
+// dscpControl returns a net.Dialer Control function that marks the socket
+// with dscp, or nil when dscp is zero.
+func dscpControl(dscp int) func(network, address string, c syscall.RawConn) error {
+	if dscp == 0 {
+		return nil
+	}
+	return func(network, _ string, c syscall.RawConn) error {
+		return setTOS(c, strings.HasSuffix(network, "6"), dscp<<2)
+	}
+}
+
+// setConnDSCP marks an already dialed UDP socket with dscp. Connections
+// without a socket, such as in-memory ones, cannot be marked.
+func setConnDSCP(conn net.Conn, dscp int) error {
+	if dscp == 0 {
+		return nil
+	}
+	
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return ErrDSCPUnsupported
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	addr, ok := conn.LocalAddr().(*net.UDPAddr)
+	ipv6 := ok && addr.IP.To4() == nil
+	return setTOS(rc, ipv6, dscp<<2)
+}
@@ -0,0 +1,12 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd)
+
+package shadowsocks
+
+import "syscall"
+
+// DSCPSupported reports whether DSCP marking works on this platform.
+const DSCPSupported = false
+
+func setTOS(c syscall.RawConn, ipv6 bool, tos int) error {
+	return ErrDSCPUnsupported
+}
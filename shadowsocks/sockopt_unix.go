@@ -0,0 +1,23 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package shadowsocks
+
+import "syscall"
+
+// DSCPSupported reports whether DSCP marking works on this platform.
+const DSCPSupported = true
+
+func setTOS(c syscall.RawConn, ipv6 bool, tos int) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		if ipv6 {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
+		} else {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
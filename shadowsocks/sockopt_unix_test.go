@@ -0,0 +1,90 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package shadowsocks
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+)
+
+// socketTOS reads the IP_TOS, or IPV6_TCLASS for ipv6, of the socket of conn.
+func socketTOS(t *testing.T, conn net.Conn, ipv6 bool) int {
+	t.Helper()
+	rc, err := conn.(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tos int
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		if ipv6 {
+			tos, serr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS)
+		} else {
+			tos, serr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	return tos
+}
+
+func TestValidateDSCP(t *testing.T) {
+	for dscp, valid := range map[int]bool{-1: false, 0: true, 46: true, 63: true, 64: false} {
+		if err := ValidateDSCP(dscp); (err == nil) != valid {
+			t.Errorf("ValidateDSCP(%d) = %v", dscp, err)
+		}
+	}
+}
+
+func TestDialerDSCP(t *testing.T) {
+	for _, dscp := range []int{0, 46} {
+		d := &Dialer{
+			ServerAddr: silentServer(t),
+			Method:     testMethods[0],
+			Key:        testKey(t, testMethods[0]),
+			DSCP:       dscp,
+		}
+		conn, err := d.Dial(context.Background(), testTarget(t), nil)
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		defer conn.Close()
+		if tos := socketTOS(t, conn.Conn, false); tos != dscp<<2 {
+			t.Errorf("DSCP %d: socket TOS = %#x, want %#x", dscp, tos, dscp<<2)
+		}
+	}
+}
+
+func TestSetConnDSCP(t *testing.T) {
+	for _, tt := range []struct {
+		addr string
+		ipv6 bool
+	}{{"127.0.0.1:9", false}, {"[::1]:9", true}} {
+		conn, err := net.Dial("udp", tt.addr)
+		if err != nil {
+			t.Logf("skipping %s: %v", tt.addr, err)
+			continue
+		}
+		defer conn.Close()
+		if err := setConnDSCP(conn, 46); err != nil {
+			t.Fatalf("setConnDSCP on %s: %v", tt.addr, err)
+		}
+		if tos := socketTOS(t, conn, tt.ipv6); tos != 46<<2 {
+			t.Errorf("%s: socket TOS = %#x, want %#x", tt.addr, tos, 46<<2)
+		}
+	}
+	
+	// In-memory connections have no socket to mark.
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	if err := setConnDSCP(a, 46); err != ErrDSCPUnsupported {
+		t.Errorf("setConnDSCP on a pipe = %v, want ErrDSCPUnsupported", err)
+	}
+}
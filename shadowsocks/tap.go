@@ -0,0 +1,45 @@
+package shadowsocks
+
+import (
+	"encoding/hex"
+	"kage/core"
+	"log/slog"
+)
+
+// Tap observes the plaintext of a Conn: Sent sees each Write before it is
+// sealed and Received each Read after it is opened. The slices must not be
+// kept after the call returns.
+//
+// A Tap sees everything the application sends and receives, including
+// credentials and cookies, so it is for debugging interop only.
+type Tap interface {
+	Sent(p []byte)
+	Received(p []byte)
+}
+
+// LogTap logs the first Limit bytes of each direction in hex at debug level.
+type LogTap struct {
+	Target string
+	Limit  int
+	// TargetLog reduces the logged target.
+	TargetLog core.TargetLogMode
+	
+	sent, received int
+}
+
+func (t *LogTap) Sent(p []byte) {
+	t.sent = t.log("sent", p, t.sent)
+}
+
+func (t *LogTap) Received(p []byte) {
+	t.received = t.log("received", p, t.received)
+}
+
+func (t *LogTap) log(dir string, p []byte, seen int) int {
+	if seen >= t.Limit || len(p) == 0 {
+		return seen
+	}
+	p = p[:min(len(p), t.Limit-seen)]
+	slog.Debug("[Shadowsocks] tap", "dir", dir, t.TargetLog.Attr(t.Target), "offset", seen, "hex", hex.EncodeToString(p))
+	return seen + len(p)
+}
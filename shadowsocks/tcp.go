@@ -3,15 +3,69 @@ package shadowsocks
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"kage/core"
+	"kage/internal/bufpool"
+	"log/slog"
 	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Conn struct {
 	net.Conn
 	
+	// NoPadding sends the request header without random padding. This weakens
+	// the obfuscation of the handshake length and is meant for benchmarks and
+	// latency-sensitive deployments only. A header without an initial payload
+	// still gets the single byte of padding SIP022 requires for it.
+	NoPadding bool
+	
+	// Padder picks the request header padding length when NoPadding is not
+	// set. Nil means RandomPadder.
+	Padder Padder
+	
+	// PadWithPayload pads the request header even when it carries an
+	// initial payload. SIP022 only requires padding without a payload, which
+	// already hides the header length, so it is skipped by default.
+	PadWithPayload bool
+	
+	// MaxChunkSize limits the payload of each chunk written. Smaller chunks
+	// reduce latency for interactive traffic at the cost of more overhead.
+	// Zero or anything above MaxPayloadSize means MaxPayloadSize.
+	MaxChunkSize int
+	
+	// HandshakeTimeout bounds the wait for the response header once the
+	// request carries payload, i.e. from the first non-empty Write or the
+	// request header with an initial payload, so that a server which
+	// accepts but never answers cannot block Read forever. Servers answer
+	// only once the target does, so a connection that has sent no payload
+	// yet may stay idle. Zero means DefaultHandshakeTimeout, a negative
+	// value no limit.
+	HandshakeTimeout time.Duration
+	// HandshakeDeadline, when set, also bounds that wait from the first
+	// Read on, payload or not, for callers with a budget spanning more than
+	// the handshake.
+	HandshakeDeadline time.Time
+	
+	// CoalesceDelay holds writes smaller than a chunk for up to this long,
+	// so that chatty protocols produce fewer chunks and syscalls. Zero sends
+	// every write at once, which suits latency-sensitive traffic.
+	CoalesceDelay time.Duration
+	
+	// Tap, when set, observes the plaintext of the connection.
+	Tap Tap
+	
+	wmu        sync.Mutex
+	pending    []byte
+	flushTimer *time.Timer
+	werr       error
+	
 	enCipher *Cipher
 	deCipher *Cipher
 	
@@ -19,9 +73,92 @@ type Conn struct {
 	
 	responseHeaderRead   bool
 	requestHeaderWritten bool
+	firstByte            atomic.Int64 // unix nanoseconds
+	
+	// hsMu guards the read deadline bounding the response header, which
+	// Write arms and Read clears.
+	hsMu        sync.Mutex
+	hsDeadline  time.Time
+	hsDone      bool
+	payloadSent atomic.Bool
 	
 	targetAddr     *core.Address
 	initialPayload []byte
+	
+	targetLog     core.TargetLogMode
+	handshakeDump *HandshakeDump
+	dumpHandshake bool
+}
+
+// ConnInfo describes the cipher parameters of a Conn.
+type ConnInfo struct {
+	Method   string `json:"method"`
+	KeySize  int    `json:"key_size"`
+	SaltSize int    `json:"salt_size"`
+	// Overhead is the AEAD tag size added to every sealed length and payload.
+	Overhead int `json:"overhead"`
+	// FastOpen reports whether an initial payload was sent in the request
+	// header.
+	FastOpen bool `json:"fast_open"`
+}
+
+// Info returns the cipher parameters of the connection.
+func (s *Conn) Info() ConnInfo {
+	return ConnInfo{
+		Method:   s.enCipher.Method,
+		KeySize:  len(s.enCipher.Key),
+		SaltSize: len(s.enCipher.Salt),
+		Overhead: s.enCipher.AEAD.Overhead(),
+		FastOpen: len(s.initialPayload) > 0,
+	}
+}
+
+// TimeToFirstByte returns how long after start Read first returned data
+// from the server, or zero if it has not yet.
+func (s *Conn) TimeToFirstByte(start time.Time) time.Duration {
+	ns := s.firstByte.Load()
+	if ns == 0 {
+		return 0
+	}
+	return time.Unix(0, ns).Sub(start)
+}
+
+// ErrBadResponseHeader means the server response could not be read as a
+// shadowsocks 2022 response. A wrong password or method is the usual cause.
+var ErrBadResponseHeader = errors.New("shadowsocks: server response header invalid, likely a wrong password or method, or not a shadowsocks 2022 server")
+
+// ErrHandshakeTimeout means the server did not send its response header in
+// time, as with a blackhole or a port that is not a shadowsocks server.
+var ErrHandshakeTimeout = errors.New("shadowsocks: timed out waiting for server response header")
+
+// ErrEmptyChunk means the server sent a data chunk without payload.
+var ErrEmptyChunk = errors.New("shadowsocks: empty payload chunk from server")
+
+// ErrStreamIntegrity means a chunk from the server failed authentication
+// after the handshake, because of corruption, tampering or nonce desync.
+var ErrStreamIntegrity = errors.New("shadowsocks: stream integrity violated")
+
+// MaxPayloadSize is the largest payload a single chunk can carry.
+const MaxPayloadSize = 0xFFFF
+
+// HandshakeDump logs the raw handshake bytes of the next connections that
+// share it in hex, until its count runs out. Only salts and sealed data are
+// dumped, never the key.
+type HandshakeDump struct {
+	left atomic.Int64
+}
+
+// NewHandshakeDump returns a HandshakeDump for the next n connections.
+func NewHandshakeDump(n int) *HandshakeDump {
+	d := &HandshakeDump{}
+	d.left.Store(int64(n))
+	return d
+}
+
+// take reports whether one more handshake is to be dumped. A nil
+// HandshakeDump dumps nothing.
+func (d *HandshakeDump) take() bool {
+	return d != nil && d.left.Load() > 0 && d.left.Add(-1) >= 0
 }
 
 func NewConn(conn net.Conn, method string, psk []byte, targetAddr *core.Address, initialPayload []byte) (*Conn, error) {
@@ -29,36 +166,133 @@ func NewConn(conn net.Conn, method string, psk []byte, targetAddr *core.Address,
 	if err != nil {
 		return nil, err
 	}
-	
-	return &Conn{
+	return newConn(conn, enCipher, targetAddr, initialPayload), nil
+}
+
+func newConn(conn net.Conn, enCipher *Cipher, targetAddr *core.Address, initialPayload []byte) *Conn {
+	c := &Conn{
 		Conn:           conn,
 		enCipher:       enCipher,
 		targetAddr:     targetAddr,
 		initialPayload: initialPayload,
-	}, nil
+	}
+	return c
 }
 
+// Write seals p into chunks of at most MaxChunkSize bytes. The first call also carries the request header,
+// which already includes the initial payload, and sends everything in a
+// single write so that the handshake costs no extra segment.
+//
+// An empty p never produces a chunk, since servers may take a zero-length
+// chunk for EOF. It only sends the request header if that is still pending,
+// and returns 0, nil otherwise without touching the connection.
+//
+// With CoalesceDelay set, p may be held back and sealed together with the
+// following writes instead. An empty p flushes whatever is held.
 func (s *Conn) Write(p []byte) (n int, err error) {
+	if s.Tap != nil {
+		s.Tap.Sent(p)
+	}
+	if s.CoalesceDelay <= 0 {
+		return s.writeChunks(p)
+	}
+	
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	
+	if s.werr != nil {
+		return 0, s.werr
+	}
+	s.pending = append(s.pending, p...)
+	if len(p) == 0 || len(s.pending) >= s.maxChunkSize() {
+		if err = s.flushLocked(); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if s.flushTimer == nil {
+		s.flushTimer = time.AfterFunc(s.CoalesceDelay, s.flush)
+	}
+	return len(p), nil
+}
+
+// flush writes the held data, if any. Unlike an empty Write it never sends
+// the request header on its own.
+func (s *Conn) flush() {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if len(s.pending) > 0 {
+		s.flushLocked()
+	}
+}
+
+// flushLocked writes the held data. An error is kept and returned by every
+// later Write, since the data it lost was already acknowledged.
+func (s *Conn) flushLocked() error {
+	if s.flushTimer != nil {
+		s.flushTimer.Stop()
+		s.flushTimer = nil
+	}
+	if _, err := s.writeChunks(s.pending); err != nil {
+		s.werr = err
+		return err
+	}
+	s.pending = s.pending[:0]
+	return nil
+}
+
+func (s *Conn) maxChunkSize() int {
+	if s.MaxChunkSize <= 0 || s.MaxChunkSize > MaxPayloadSize {
+		return MaxPayloadSize
+	}
+	return s.MaxChunkSize
+}
+
+// requestPadding returns the padding length of the request header. SIP022
+// requires at least one byte when there is no initial payload, whatever the
+// Padder picks.
+func (s *Conn) requestPadding() int {
+	if len(s.initialPayload) == 0 {
+		if s.NoPadding {
+			return 1
+		}
+		return max(choosePadding(s.Padder, MaxPaddingLength), 1)
+	}
+	if s.NoPadding || !s.PadWithPayload {
+		return 0
+	}
+	return choosePadding(s.Padder, MaxPaddingLength)
+}
+
+func (s *Conn) writeChunks(p []byte) (n int, err error) {
 	var buf []byte
 	if !s.requestHeaderWritten {
-		flHeader, vlHeader, err := PackRequestHeader(s.targetAddr, s.initialPayload)
+		buf, err = packClientHandshake(s.targetAddr, s.initialPayload, s.enCipher, s.requestPadding())
 		if err != nil {
 			return 0, err
 		}
-		
-		buf = append(buf, s.enCipher.Salt...)
-		buf = s.enCipher.Seal(buf, flHeader)
-		buf = s.enCipher.Seal(buf, vlHeader)
-		
+		if s.handshakeDump.take() {
+			s.dumpHandshake = true
+			slog.Info("[Shadowsocks] client handshake", s.targetLog.Attr(s.targetAddr.String()), "hex", hex.EncodeToString(buf))
+		}
 		s.requestHeaderWritten = true
 	}
 	
-	if len(p) > 0 {
+	chunkSize := s.maxChunkSize()
+	chunks := (len(p) + chunkSize - 1) / chunkSize
+	out := bufpool.Get(len(buf) + len(p) + chunks*(2+2*s.enCipher.AEAD.Overhead()))[:0]
+	defer bufpool.Put(out)
+	buf = append(out, buf...)
+	
+	for rest := p; len(rest) > 0; {
+		chunk := rest[:min(len(rest), chunkSize)]
+		rest = rest[len(chunk):]
+		
 		payloadSize := make([]byte, 2)
-		binary.BigEndian.PutUint16(payloadSize, uint16(len(p)))
+		binary.BigEndian.PutUint16(payloadSize, uint16(len(chunk)))
 		
 		buf = s.enCipher.Seal(buf, payloadSize)
-		buf = s.enCipher.Seal(buf, p)
+		buf = s.enCipher.Seal(buf, chunk)
 	}
 	
 	if len(buf) > 0 {
@@ -67,50 +301,100 @@ func (s *Conn) Write(p []byte) (n int, err error) {
 			return 0, err
 		}
 	}
+	
+	if (len(p) > 0 || len(s.initialPayload) > 0) && !s.payloadSent.Swap(true) {
+		timeout := s.HandshakeTimeout
+		if timeout == 0 {
+			timeout = DefaultHandshakeTimeout
+		}
+		if timeout > 0 {
+			s.armHandshakeDeadline(time.Now().Add(timeout))
+		}
+	}
 	return len(p), nil
 }
 
+// armHandshakeDeadline bounds the wait for the response header by d, unless
+// an earlier deadline is set already or the header was read. A zero d does
+// nothing.
+func (s *Conn) armHandshakeDeadline(d time.Time) {
+	if d.IsZero() {
+		return
+	}
+	s.hsMu.Lock()
+	defer s.hsMu.Unlock()
+	if s.hsDone || (!s.hsDeadline.IsZero() && !d.Before(s.hsDeadline)) {
+		return
+	}
+	s.hsDeadline = d
+	s.Conn.SetReadDeadline(d)
+}
+
+// BuildClientHandshake returns the salt followed by the sealed request headers,
+// exactly as the first Write of a Conn with default settings puts them on
+// the wire.
+func BuildClientHandshake(targetAddr *core.Address, initialPayload []byte, c *Cipher) ([]byte, error) {
+	paddingLen := 0
+	if len(initialPayload) == 0 {
+		paddingLen = RandomPaddingLength()
+	}
+	return packClientHandshake(targetAddr, initialPayload, c, paddingLen)
+}
+
+func packClientHandshake(targetAddr *core.Address, initialPayload []byte, c *Cipher, paddingLen int) ([]byte, error) {
+	flHeader, vlHeader, err := PackRequestHeader(targetAddr, initialPayload, paddingLen)
+	if err != nil {
+		return nil, err
+	}
+	
+	buf := make([]byte, 0, len(c.Salt)+len(flHeader)+len(vlHeader)+2*c.AEAD.Overhead())
+	buf = append(buf, c.Salt...)
+	buf = c.Seal(buf, flHeader)
+	buf = c.Seal(buf, vlHeader)
+	return buf, nil
+}
+
+// Read decrypts the next chunk from the server into p. The part of a chunk
+// that does not fit in p is kept for the following reads, so p may be smaller
+// than a chunk without losing data. An empty p returns immediately.
 func (s *Conn) Read(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if s.firstByte.Load() == 0 {
+		defer func() {
+			if n > 0 {
+				s.firstByte.Store(time.Now().UnixNano())
+			}
+		}()
+	}
+	if s.Tap != nil {
+		defer func() {
+			if n > 0 {
+				s.Tap.Received(p[:n])
+			}
+		}()
+	}
+	
 	if !s.responseHeaderRead {
-		saltSize := len(s.enCipher.Salt)
-		headerBuf := make([]byte, 2*saltSize+27)
-		if _, err := io.ReadFull(s.Conn, headerBuf); err != nil {
+		s.armHandshakeDeadline(s.HandshakeDeadline)
+		if err = s.readResponseHeader(); err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				err = fmt.Errorf("%w: %w", ErrHandshakeTimeout, err)
+			}
 			return 0, err
 		}
-		
-		deCipher, err := NewCipherWithSalt(s.enCipher.Method, s.enCipher.Key, headerBuf[:saltSize])
-		if err != nil {
-			return 0, err
+		s.hsMu.Lock()
+		s.hsDone = true
+		if !s.hsDeadline.IsZero() {
+			s.Conn.SetReadDeadline(time.Time{})
 		}
-		s.deCipher = deCipher
-		
-		data, err := s.deCipher.Open(nil, headerBuf[saltSize:])
-		if err != nil {
-			return 0, errors.New("shadowsocks: failed to open response fixed-length header")
-		}
-		
-		if data[0] != 1 {
-			return 0, errors.New("shadowsocks: invalid type in response fixed-length header")
-		}
-		
-		if !bytes.Equal(data[9:9+saltSize], s.enCipher.Salt) {
-			return 0, errors.New("shadowsocks: request salt mismatch in response header")
-		}
-		
-		vlLen := binary.BigEndian.Uint16(data[9+saltSize:])
-		vlBuf := make([]byte, int(vlLen)+16)
-		if _, err := io.ReadFull(s.Conn, vlBuf); err != nil {
-			return 0, err
-		}
-		vlData, err := s.deCipher.Open(nil, vlBuf)
-		if err != nil {
-			return 0, errors.New("shadowsocks: failed to open response variable-length header")
-		}
-		s.readBuffer = append(s.readBuffer, vlData...)
-		
+		s.hsMu.Unlock()
 		s.responseHeaderRead = true
 	}
 	
+	// A server may answer with an empty initial payload, in which case the
+	// first Read falls through to the next framed chunk instead of returning 0.
 	if len(s.readBuffer) > 0 {
 		n = copy(p, s.readBuffer)
 		s.readBuffer = s.readBuffer[n:]
@@ -124,17 +408,24 @@ func (s *Conn) Read(p []byte) (n int, err error) {
 	
 	lenBuf, err := s.deCipher.Open(nil, chunkHeader)
 	if err != nil {
-		return 0, err
+		return 0, s.integrityError("chunk length", err)
 	}
 	
+	// The length is a uint16 and cannot exceed MaxPayloadSize. An empty
+	// chunk would make Read return 0 bytes with no error, letting a server
+	// spin the reader for nothing.
 	payloadLen := binary.BigEndian.Uint16(lenBuf)
-	payloadBuf := make([]byte, payloadLen+16)
+	if payloadLen == 0 {
+		return 0, ErrEmptyChunk
+	}
+	payloadBuf := bufpool.Get(int(payloadLen) + 16)
+	defer bufpool.Put(payloadBuf)
 	if _, err = io.ReadFull(s.Conn, payloadBuf); err != nil {
 		return 0, err
 	}
-	payload, err := s.deCipher.Open(nil, payloadBuf)
+	payload, err := s.deCipher.Open(payloadBuf[:0], payloadBuf)
 	if err != nil {
-		return 0, err
+		return 0, s.integrityError("chunk payload", err)
 	}
 	
 	n = copy(p, payload)
@@ -144,7 +435,89 @@ func (s *Conn) Read(p []byte) (n int, err error) {
 	return n, nil
 }
 
+// integrityError closes the connection after a chunk failed to open and
+// returns err wrapped in ErrStreamIntegrity. The nonces can no longer be
+// trusted to match, so nothing after it can be read either.
+func (s *Conn) integrityError(part string, err error) error {
+	s.Conn.Close()
+	return fmt.Errorf("%w: %s: %w", ErrStreamIntegrity, part, err)
+}
+
+func (s *Conn) readResponseHeader() error {
+	saltSize := len(s.enCipher.Salt)
+	headerBuf := make([]byte, 2*saltSize+27)
+	if _, err := io.ReadFull(s.Conn, headerBuf); err != nil {
+		return err
+	}
+	
+	// A server echoing the request salt would derive the same subkey for
+	// both directions and reuse every nonce.
+	if bytes.Equal(headerBuf[:saltSize], s.enCipher.Salt) {
+		return errors.New("shadowsocks: response salt reuses the request salt")
+	}
+	
+	deCipher, err := NewCipherWithSalt(s.enCipher.Method, s.enCipher.Key, headerBuf[:saltSize])
+	if err != nil {
+		return err
+	}
+	s.deCipher = deCipher
+	
+	data, err := s.deCipher.Open(nil, headerBuf[saltSize:])
+	if err != nil {
+		return fmt.Errorf("%w: failed to open fixed-length header", ErrBadResponseHeader)
+	}
+	
+	if data[0] != 1 {
+		return fmt.Errorf("%w: header type %d, want 1", ErrBadResponseHeader, data[0])
+	}
+	
+	if !bytes.Equal(data[9:9+saltSize], s.enCipher.Salt) {
+		return errors.New("shadowsocks: request salt mismatch in response header")
+	}
+	
+	// Unlike the request, the response carries no address or padding after
+	// the fixed-length header: SIP022 defines the sealed chunk that follows
+	// as payload only, so all of it belongs to the caller. The chunk is
+	// still sealed when its length is zero, so the AEAD tag has to be
+	// consumed either way.
+	vlLen := binary.BigEndian.Uint16(data[9+saltSize:])
+	vlBuf := make([]byte, int(vlLen)+16)
+	if _, err := io.ReadFull(s.Conn, vlBuf); err != nil {
+		return err
+	}
+	if s.dumpHandshake {
+		slog.Info("[Shadowsocks] server handshake", s.targetLog.Attr(s.targetAddr.String()), "hex", hex.EncodeToString(append(headerBuf, vlBuf...)))
+	}
+	vlData, err := s.deCipher.Open(nil, vlBuf)
+	if err != nil {
+		return errors.New("shadowsocks: failed to open response variable-length header")
+	}
+	if len(vlData) > 0 {
+		s.readBuffer = append(s.readBuffer, vlData...)
+	}
+	return nil
+}
+
+// SetNoDelay sets the no-delay option of the underlying TCP connection.
+func (s *Conn) SetNoDelay(noDelay bool) error {
+	if tc, ok := s.Conn.(*net.TCPConn); ok {
+		return tc.SetNoDelay(noDelay)
+	}
+	return nil
+}
+
+// Close flushes the data held by CoalesceDelay and closes the connection.
+func (s *Conn) Close() error {
+	if s.CoalesceDelay > 0 {
+		s.flush()
+	}
+	return s.Conn.Close()
+}
+
 func (s *Conn) CloseWrite() error {
+	if s.CoalesceDelay > 0 {
+		s.flush()
+	}
 	if tc, ok := s.Conn.(*net.TCPConn); ok {
 		return tc.CloseWrite()
 	}
@@ -0,0 +1,70 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// FuzzConnRead feeds Conn.Read arbitrary server streams: raw bytes, and a
+// valid response header followed by a sealed chunk length announcing any
+// size with arbitrary bytes after it, optionally behind one valid chunk.
+// Reading must end in an error, never panic, and never buffer more than a
+// chunk.
+func FuzzConnRead(f *testing.F) {
+	f.Add(uint16(0), []byte{}, false)
+	f.Add(uint16(5), []byte("hello"), true)
+	f.Add(uint16(MaxPayloadSize), bytes.Repeat([]byte{0xaa}, 100), false)
+	f.Add(uint16(16), bytes.Repeat([]byte{0x00}, 32), true)
+	
+	method := testMethods[0]
+	key := testKey(f, method)
+	f.Fuzz(func(t *testing.T, length uint16, data []byte, valid bool) {
+		enCipher, err := NewCipher(method, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream, server := responseHeader(t, enCipher, nil)
+		want := ""
+		if valid {
+			stream = sealChunk(stream, server, []byte("valid"))
+			want = "valid"
+		}
+		stream = server.Seal(stream, binary.BigEndian.AppendUint16(nil, length))
+		stream = append(stream, data...)
+		
+		readAll(t, newConn(&scriptConn{r: bytes.NewReader(stream)}, enCipher, testTarget(t), nil), want)
+		
+		// The same bytes without a valid response header.
+		enCipher, err = NewCipher(method, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readAll(t, newConn(&scriptConn{r: bytes.NewReader(data)}, enCipher, testTarget(t), nil), "")
+	})
+}
+
+// readAll reads conn in small steps until it fails and checks that it read
+// exactly want before that.
+func readAll(t *testing.T, conn *Conn, want string) {
+	t.Helper()
+	var got []byte
+	buf := make([]byte, 3)
+	for range len(want) + 2 {
+		n, err := conn.Read(buf)
+		got = append(got, buf[:n]...)
+		if cap(conn.readBuffer) > MaxPayloadSize {
+			t.Fatalf("read buffer grew to %d bytes", cap(conn.readBuffer))
+		}
+		if err != nil {
+			if string(got) != want {
+				t.Fatalf("read %q before the error, want %q", got, want)
+			}
+			return
+		}
+		if n == 0 {
+			t.Fatal("Read returned 0 bytes without an error")
+		}
+	}
+	t.Fatalf("Read returned %q and no error", got)
+}
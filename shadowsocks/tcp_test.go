@@ -0,0 +1,583 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"kage/core"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testMethods = []string{
+	"2022-blake3-aes-128-gcm",
+	"2022-blake3-aes-256-gcm",
+	"2022-blake3-chacha20-poly1305",
+}
+
+func testKey(t testing.TB, method string) []byte {
+	t.Helper()
+	size, err := SaltSize(method)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Repeat([]byte{0x42}, size)
+}
+
+func testTarget(t testing.TB) *core.Address {
+	t.Helper()
+	addr, err := core.ParseAddress("example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addr
+}
+
+// scriptConn is a net.Conn that reads a prepared server stream and records
+// every write.
+type scriptConn struct {
+	r      io.Reader
+	w      bytes.Buffer
+	writes int
+}
+
+func (c *scriptConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+func (c *scriptConn) Write(p []byte) (int, error) {
+	c.writes++
+	return c.w.Write(p)
+}
+
+func (c *scriptConn) Close() error                       { return nil }
+func (c *scriptConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (c *scriptConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (c *scriptConn) SetDeadline(t time.Time) error      { return nil }
+func (c *scriptConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *scriptConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// responseHeader builds the server response header to the request sealed
+// with c, carrying payload, and returns it with the server's sending cipher.
+func responseHeader(t testing.TB, c *Cipher, payload []byte) ([]byte, *Cipher) {
+	t.Helper()
+	return responseHeaderWithSalt(t, c, bytes.Repeat([]byte{0x17}, len(c.Salt)), payload)
+}
+
+// responseHeaderWithSalt is responseHeader with the given server salt.
+func responseHeaderWithSalt(t testing.TB, c *Cipher, salt, payload []byte) ([]byte, *Cipher) {
+	t.Helper()
+	server, err := NewCipherWithSalt(c.Method, c.Key, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	fixed := []byte{1}
+	fixed = binary.BigEndian.AppendUint64(fixed, uint64(time.Now().Unix()))
+	fixed = append(fixed, c.Salt...)
+	fixed = binary.BigEndian.AppendUint16(fixed, uint16(len(payload)))
+	
+	header := append([]byte(nil), salt...)
+	header = server.Seal(header, fixed)
+	header = server.Seal(header, payload)
+	return header, server
+}
+
+// sealChunk appends p to dst as one sealed chunk.
+func sealChunk(dst []byte, c *Cipher, p []byte) []byte {
+	dst = c.Seal(dst, binary.BigEndian.AppendUint16(nil, uint16(len(p))))
+	return c.Seal(dst, p)
+}
+
+// openChunk reads one chunk sealed with c from r and returns its payload.
+func openChunk(r io.Reader, c *Cipher) ([]byte, error) {
+	overhead := c.AEAD.Overhead()
+	length := make([]byte, 2+overhead)
+	if _, err := io.ReadFull(r, length); err != nil {
+		return nil, err
+	}
+	length, err := c.Open(length[:0], length)
+	if err != nil {
+		return nil, err
+	}
+	payload := make([]byte, int(binary.BigEndian.Uint16(length))+overhead)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return c.Open(payload[:0], payload)
+}
+
+func TestConnWriteChunkSize(t *testing.T) {
+	for _, method := range testMethods {
+		t.Run(method, func(t *testing.T) {
+			key := testKey(t, method)
+			enCipher, err := NewCipher(method, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec := &scriptConn{}
+			conn := newConn(rec, enCipher, testTarget(t), nil)
+			conn.MaxChunkSize = 100
+			
+			data := bytes.Repeat([]byte("x"), 350)
+			if _, err := conn.Write(data); err != nil {
+				t.Fatal(err)
+			}
+			if rec.writes != 1 {
+				t.Errorf("Write made %d writes to the connection, want 1", rec.writes)
+			}
+			
+			deCipher, _, _, err := readRequestHeader(&rec.w, method, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var sizes []int
+			for rec.w.Len() > 0 {
+				chunk, err := openChunk(&rec.w, deCipher)
+				if err != nil {
+					t.Fatal(err)
+				}
+				sizes = append(sizes, len(chunk))
+			}
+			if want := []int{100, 100, 100, 50}; !slices.Equal(sizes, want) {
+				t.Fatalf("chunk sizes = %v, want %v", sizes, want)
+			}
+		})
+	}
+}
+
+func TestConnWriteCoalesce(t *testing.T) {
+	method := testMethods[0]
+	key := testKey(t, method)
+	for _, delay := range []time.Duration{0, time.Minute} {
+		enCipher, err := NewCipher(method, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := &scriptConn{}
+		conn := newConn(rec, enCipher, testTarget(t), nil)
+		conn.CoalesceDelay = delay
+		
+		for range 10 {
+			if _, err := conn.Write([]byte("0123456789")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// An empty Write flushes what is held back.
+		if _, err := conn.Write(nil); err != nil {
+			t.Fatal(err)
+		}
+		
+		deCipher, _, _, err := readRequestHeader(&rec.w, method, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var chunks, size int
+		for rec.w.Len() > 0 {
+			chunk, err := openChunk(&rec.w, deCipher)
+			if err != nil {
+				t.Fatal(err)
+			}
+			chunks++
+			size += len(chunk)
+		}
+		if size != 100 {
+			t.Fatalf("delay %v: %d bytes on the wire, want 100", delay, size)
+		}
+		want := 10
+		if delay > 0 {
+			want = 1
+		}
+		if chunks != want || rec.writes != want {
+			t.Errorf("delay %v: 10 writes made %d chunks in %d writes, want %d", delay, chunks, rec.writes, want)
+		}
+	}
+}
+
+func TestConnRequestPadding(t *testing.T) {
+	method := testMethods[0]
+	key := testKey(t, method)
+	tests := []struct {
+		name           string
+		initialPayload []byte
+		padWithPayload bool
+		noPadding      bool
+		wantPadding    bool
+	}{
+		{"no payload", nil, false, false, true},
+		{"initial payload", []byte("client hello"), false, false, false},
+		{"initial payload padded", []byte("client hello"), true, false, true},
+		// SIP022 requires padding without a payload, even with NoPadding.
+		{"no payload without padding", nil, false, true, true},
+		{"initial payload without padding", []byte("client hello"), true, true, false},
+	}
+	for _, tt := range tests {
+		enCipher, err := NewCipher(method, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := &scriptConn{}
+		conn := newConn(rec, enCipher, testTarget(t), tt.initialPayload)
+		conn.PadWithPayload = tt.padWithPayload
+		conn.NoPadding = tt.noPadding
+		if _, err := conn.Write(nil); err != nil {
+			t.Fatal(err)
+		}
+		
+		_, _, padding, rest, err := readRequestFields(&rec.w, method, key)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := string(rest[padding:]); got != string(tt.initialPayload) {
+			t.Errorf("%s: initial payload = %q, want %q", tt.name, got, tt.initialPayload)
+		}
+		if (padding > 0) != tt.wantPadding {
+			t.Errorf("%s: %d bytes of padding, want padding %v", tt.name, padding, tt.wantPadding)
+		}
+		if tt.noPadding && padding > 1 {
+			t.Errorf("%s: %d bytes of padding with NoPadding, want at most 1", tt.name, padding)
+		}
+	}
+}
+
+func TestConnReadEmptyResponsePayload(t *testing.T) {
+	for _, method := range testMethods {
+		t.Run(method, func(t *testing.T) {
+			enCipher, err := NewCipher(method, testKey(t, method))
+			if err != nil {
+				t.Fatal(err)
+			}
+			stream, server := responseHeader(t, enCipher, nil)
+			stream = sealChunk(stream, server, []byte("first chunk"))
+			
+			conn := newConn(&scriptConn{r: bytes.NewReader(stream)}, enCipher, testTarget(t), nil)
+			buf := make([]byte, 64)
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatalf("Read: %v", err)
+			}
+			if got := string(buf[:n]); got != "first chunk" {
+				t.Fatalf("Read = %q, want the first chunk", got)
+			}
+		})
+	}
+}
+
+func TestConnReadResponsePayloadFirst(t *testing.T) {
+	method := testMethods[0]
+	enCipher, err := NewCipher(method, testKey(t, method))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, server := responseHeader(t, enCipher, []byte("header"))
+	stream = sealChunk(stream, server, []byte("chunk"))
+	
+	conn := newConn(&scriptConn{r: bytes.NewReader(stream)}, enCipher, testTarget(t), nil)
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(got) != "headerchunk" {
+		t.Fatalf("read %q, want %q", got, "headerchunk")
+	}
+}
+
+func TestConnReadResponseNotUnpadded(t *testing.T) {
+	// A response payload that looks like a padding length followed by
+	// padding, as in a request header, is data and reaches the caller whole.
+	payload := []byte{0x00, 0x03, 'p', 'a', 'd', 'd', 'a', 't', 'a'}
+	for _, method := range testMethods {
+		enCipher, err := NewCipher(method, testKey(t, method))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream, server := responseHeader(t, enCipher, payload)
+		stream = sealChunk(stream, server, []byte("chunk"))
+		
+		conn := newConn(&scriptConn{r: bytes.NewReader(stream)}, enCipher, testTarget(t), nil)
+		got, err := io.ReadAll(conn)
+		if err != nil {
+			t.Fatalf("%s: ReadAll: %v", method, err)
+		}
+		if want := append(payload, "chunk"...); !bytes.Equal(got, want) {
+			t.Fatalf("%s: read %q, want %q", method, got, want)
+		}
+	}
+}
+
+func TestConnReadResponseSaltReused(t *testing.T) {
+	for _, method := range testMethods {
+		enCipher, err := NewCipher(method, testKey(t, method))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream, _ := responseHeaderWithSalt(t, enCipher, enCipher.Salt, []byte("hello"))
+		conn := newConn(&scriptConn{r: bytes.NewReader(stream)}, enCipher, testTarget(t), nil)
+		n, err := conn.Read(make([]byte, 16))
+		if n != 0 || err == nil || !strings.Contains(err.Error(), "reuses the request salt") {
+			t.Fatalf("%s: Read of a response with the request salt = %d, %v, want it rejected", method, n, err)
+		}
+	}
+}
+
+func TestConnReadBadResponseHeader(t *testing.T) {
+	method := testMethods[0]
+	enCipher, err := NewCipher(method, testKey(t, method))
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	// A server echoing the request sends a header of the client type.
+	salt := bytes.Repeat([]byte{0x17}, len(enCipher.Salt))
+	server, err := NewCipherWithSalt(method, enCipher.Key, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixed := []byte{0} // Type: Client-to-Server
+	fixed = binary.BigEndian.AppendUint64(fixed, uint64(time.Now().Unix()))
+	fixed = append(fixed, enCipher.Salt...)
+	fixed = binary.BigEndian.AppendUint16(fixed, 0)
+	wrongType := server.Seal(append([]byte(nil), salt...), fixed)
+	
+	// A server with another password seals a header that does not open.
+	otherKey := bytes.Repeat([]byte{0x24}, len(enCipher.Key))
+	other, err := NewCipher(method, otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongKey, _ := responseHeader(t, other, nil)
+	
+	tests := []struct {
+		name   string
+		stream []byte
+		detail string
+	}{
+		{"wrong type", wrongType, "header type 0, want 1"},
+		{"wrong key", wrongKey, "failed to open fixed-length header"},
+	}
+	for _, tt := range tests {
+		conn := newConn(&scriptConn{r: bytes.NewReader(tt.stream)}, enCipher, testTarget(t), nil)
+		_, err := conn.Read(make([]byte, 16))
+		if !errors.Is(err, ErrBadResponseHeader) {
+			t.Errorf("%s: Read = %v, want ErrBadResponseHeader", tt.name, err)
+			continue
+		}
+		if msg := err.Error(); !strings.Contains(msg, "wrong password or method") || !strings.Contains(msg, tt.detail) {
+			t.Errorf("%s: error %q does not name the likely cause and %q", tt.name, msg, tt.detail)
+		}
+	}
+}
+
+func TestConnReadChunkLength(t *testing.T) {
+	method := testMethods[0]
+	enCipher, err := NewCipher(method, testKey(t, method))
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	t.Run("empty", func(t *testing.T) {
+		stream, server := responseHeader(t, enCipher, []byte("hi"))
+		stream = sealChunk(stream, server, nil)
+		conn := newConn(&scriptConn{r: bytes.NewReader(stream)}, enCipher, testTarget(t), nil)
+		if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := conn.Read(make([]byte, 16)); n != 0 || !errors.Is(err, ErrEmptyChunk) {
+			t.Fatalf("Read of an empty chunk = %d, %v, want ErrEmptyChunk", n, err)
+		}
+	})
+	
+	// The length is a uint16, so an over-long chunk can only be announced by
+	// tampering with the sealed length, which fails to open.
+	t.Run("over max", func(t *testing.T) {
+		stream, server := responseHeader(t, enCipher, nil)
+		header := len(stream)
+		stream = sealChunk(stream, server, []byte("chunk"))
+		stream[header], stream[header+1] = stream[header]^0xff, stream[header+1]^0xff
+		conn := newConn(&scriptConn{r: bytes.NewReader(stream)}, enCipher, testTarget(t), nil)
+		if n, err := conn.Read(make([]byte, 16)); n != 0 || err == nil {
+			t.Fatalf("Read of a tampered chunk length = %d, %v, want an error", n, err)
+		}
+	})
+}
+
+func TestConnReadCorruptChunk(t *testing.T) {
+	method := testMethods[0]
+	enCipher, err := NewCipher(method, testKey(t, method))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, server := responseHeader(t, enCipher, nil)
+	stream = sealChunk(stream, server, []byte("intact"))
+	corrupt := len(stream) + 2 + enCipher.AEAD.Overhead() // first payload byte of the next chunk
+	stream = sealChunk(stream, server, []byte("tampered"))
+	stream[corrupt] ^= 0x01
+	
+	clientEnd, serverEnd := net.Pipe()
+	defer serverEnd.Close()
+	go serverEnd.Write(stream)
+	conn := newConn(clientEnd, enCipher, testTarget(t), nil)
+	
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "intact" {
+		t.Fatalf("Read = %q, %v, want the intact chunk", buf[:n], err)
+	}
+	n, err = conn.Read(buf)
+	if n != 0 || !errors.Is(err, ErrStreamIntegrity) {
+		t.Fatalf("Read of a corrupted chunk = %d, %v, want ErrStreamIntegrity", n, err)
+	}
+	if !strings.Contains(err.Error(), "chunk payload") {
+		t.Errorf("error %q does not say which part failed", err)
+	}
+	
+	// The connection is torn down, not left half-open.
+	serverEnd.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := serverEnd.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("server end read %v, want EOF from the closed connection", err)
+	}
+}
+
+func TestConnReadSmallBuffer(t *testing.T) {
+	method := testMethods[0]
+	enCipher, err := NewCipher(method, testKey(t, method))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, server := responseHeader(t, enCipher, nil)
+	stream = sealChunk(stream, server, []byte("first chunk"))
+	stream = sealChunk(stream, server, []byte("second"))
+	
+	conn := newConn(&scriptConn{r: bytes.NewReader(stream)}, enCipher, testTarget(t), nil)
+	if n, err := conn.Read(nil); n != 0 || err != nil {
+		t.Fatalf("Read with an empty buffer = %d, %v, want 0, nil", n, err)
+	}
+	
+	// A buffer smaller than a chunk gets the rest of it on the next reads.
+	var got []byte
+	buf := make([]byte, 3)
+	for {
+		n, err := conn.Read(buf)
+		if n > len(buf) {
+			t.Fatalf("Read returned %d bytes into a %d byte buffer", n, len(buf))
+		}
+		got = append(got, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+	}
+	if string(got) != "first chunksecond" {
+		t.Fatalf("read %q, want %q", got, "first chunksecond")
+	}
+}
+
+func TestConnHeaderSharesFirstWrite(t *testing.T) {
+	method := testMethods[0]
+	key := testKey(t, method)
+	enCipher, err := NewCipher(method, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &scriptConn{}
+	conn := newConn(rec, enCipher, testTarget(t), []byte("client hello"))
+	
+	// The request header, with the initial payload, and the first chunk
+	// go out in one write, so that no segment carries the header alone.
+	if _, err := conn.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	if rec.writes != 1 {
+		t.Fatalf("first Write made %d writes to the connection, want 1", rec.writes)
+	}
+	deCipher, _, padding, rest, err := readRequestFields(&rec.w, method, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(rest[padding:]); got != "client hello" {
+		t.Fatalf("initial payload = %q, want %q", got, "client hello")
+	}
+	chunk, err := openChunk(&rec.w, deCipher)
+	if err != nil {
+		t.Fatalf("first chunk: %v", err)
+	}
+	if string(chunk) != "request" {
+		t.Fatalf("first chunk = %q, want %q", chunk, "request")
+	}
+	
+	if _, err := conn.Write([]byte("more")); err != nil {
+		t.Fatal(err)
+	}
+	if rec.writes != 2 {
+		t.Fatalf("second Write made %d more writes, want 1", rec.writes-1)
+	}
+}
+
+func TestConnWriteEmpty(t *testing.T) {
+	method := testMethods[0]
+	key := testKey(t, method)
+	enCipher, err := NewCipher(method, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &scriptConn{}
+	conn := newConn(rec, enCipher, testTarget(t), nil)
+	
+	// The first empty Write sends the pending request header alone.
+	if n, err := conn.Write(nil); n != 0 || err != nil {
+		t.Fatalf("first empty Write = %d, %v, want 0, nil", n, err)
+	}
+	if rec.writes != 1 {
+		t.Fatalf("first empty Write made %d writes, want 1", rec.writes)
+	}
+	if _, _, _, err := readRequestHeader(&rec.w, method, key); err != nil {
+		t.Fatal(err)
+	}
+	if rec.w.Len() != 0 {
+		t.Fatalf("%d bytes after the request header, want no chunk", rec.w.Len())
+	}
+	
+	// Later ones do not touch the connection.
+	for range 3 {
+		if n, err := conn.Write([]byte{}); n != 0 || err != nil {
+			t.Fatalf("empty Write = %d, %v, want 0, nil", n, err)
+		}
+	}
+	if rec.writes != 1 {
+		t.Fatalf("empty Writes after the header made %d more writes, want none", rec.writes-1)
+	}
+}
+
+func TestConnInfo(t *testing.T) {
+	tests := []struct {
+		method   string
+		keySize  int
+		overhead int
+	}{
+		{"2022-blake3-aes-128-gcm", 16, 16},
+		{"2022-blake3-aes-256-gcm", 32, 16},
+		{"2022-blake3-chacha20-poly1305", 32, 16},
+	}
+	for _, tt := range tests {
+		for _, initialPayload := range [][]byte{nil, []byte("client hello")} {
+			conn, err := NewConn(&scriptConn{}, tt.method, testKey(t, tt.method), testTarget(t), initialPayload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := ConnInfo{
+				Method:   tt.method,
+				KeySize:  tt.keySize,
+				SaltSize: tt.keySize,
+				Overhead: tt.overhead,
+				FastOpen: initialPayload != nil,
+			}
+			if got := conn.Info(); got != want {
+				t.Errorf("Info() = %+v, want %+v", got, want)
+			}
+		}
+	}
+}
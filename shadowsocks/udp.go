@@ -5,13 +5,20 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"math/big"
+	"io"
+	"kage/core"
+	"kage/internal/bufpool"
+	"log/slog"
 	"net"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 	
+	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -20,35 +27,85 @@ var (
 	ErrBadHeaderType    = errors.New("bad header type")
 	ErrTimestampExpired = errors.New("timestamp expired (>30s)")
 	ErrSessionNotFound  = errors.New("client session not found")
+	ErrIdleTimeout      = errors.New("udp association idle timeout")
 )
 
+// minIdleCheckInterval bounds how often Run checks for an idle timeout.
+const minIdleCheckInterval = 10 * time.Millisecond
+
+// SessionIDSize is the size of a UDP session ID. The ID also serves as the
+// salt of the session subkey, independently of the method's SaltSize.
+const SessionIDSize = 8
+
 type UDPSession struct {
 	ID     []byte
 	Cipher *Cipher
+	
+	lastActive    atomic.Int64
+	bytesSent     atomic.Uint64
+	bytesReceived atomic.Uint64
+	// padded is set once the first packet, the only padded one, is built.
+	padded atomic.Bool
+	
+	upLimit   packetBucket
+	downLimit packetBucket
+	dropped   atomic.Uint64
+}
+
+// SessionInfo is a snapshot of a client session, as returned by
+// UDPClient.Sessions.
+type SessionInfo struct {
+	ClientAddr    string    `json:"client_addr"`
+	SessionID     string    `json:"session_id"`
+	LastActive    time.Time `json:"last_active"`
+	BytesSent     uint64    `json:"bytes_sent"`
+	BytesReceived uint64    `json:"bytes_received"`
+	// Dropped counts the packets dropped by MaxPacketRate.
+	Dropped uint64 `json:"dropped"`
 }
 
 func NewUDPSession(method string, psk []byte) (*UDPSession, error) {
-	id := make([]byte, 8)
-	if _, err := rand.Read(id); err != nil {
+	return NewUDPSessionFrom(method, psk, rand.Reader)
+}
+
+// NewUDPSessionFrom is like NewUDPSession, but reads the session ID, which
+// salts the session subkey, from src instead of crypto/rand.
+func NewUDPSessionFrom(method string, psk []byte, src io.Reader) (*UDPSession, error) {
+	id := make([]byte, SessionIDSize)
+	if _, err := io.ReadFull(src, id); err != nil {
 		return nil, fmt.Errorf("generate session id: %w", err)
 	}
 	
-	c, err := NewCipherWithSalt(method, psk, id)
+	c, err := NewSessionCipher(method, psk, id)
 	if err != nil {
 		return nil, fmt.Errorf("create session cipher: %w", err)
 	}
 	
-	return &UDPSession{
+	s := &UDPSession{
 		ID:     id,
 		Cipher: c,
-	}, nil
+	}
+	s.lastActive.Store(time.Now().UnixNano())
+	return s, nil
 }
 
 func (s *UDPSession) SeparateHeader() []byte {
 	sh := make([]byte, 16)
-	copy(sh[:8], s.ID[:8])
+	copy(sh[:SessionIDSize], s.ID)
 	nonce := s.Cipher.Counter.Nonce()
-	copy(sh[8:], nonce[:8])
+	copy(sh[SessionIDSize:], nonce[:8])
+	return sh
+}
+
+// nextSeparateHeader returns the separate header of the next packet and
+// advances the packet ID. Taking the ID and advancing it in one step keeps
+// concurrent EncryptPacket calls for a session from reusing a packet ID,
+// which is also the AEAD nonce with AES.
+func (s *UDPSession) nextSeparateHeader() []byte {
+	sh := make([]byte, 16)
+	copy(sh[:SessionIDSize], s.ID)
+	nonce := s.Cipher.Counter.Next()
+	copy(sh[SessionIDSize:], nonce[:8])
 	return sh
 }
 
@@ -56,9 +113,71 @@ type UDPClient struct {
 	Method      string
 	PSK         []byte
 	BlockCipher cipher.Block
-	
-	ClientConn *net.UDPConn
-	ServerConn *net.UDPConn
+	// XAEAD seals whole packets, separate header included, for
+	// 2022-blake3-chacha20-poly1305, which uses no BlockCipher.
+	XAEAD cipher.AEAD
+	
+	// NoPadding sends every packet with a zero-length padding field.
+	NoPadding bool
+	// Padder picks the padding length of the first packet of each session
+	// when NoPadding is not set. Nil means RandomPadder.
+	Padder Padder
+	
+	// WrapReply frames a decrypted payload with the source address reported
+	// by the server before it is written back to the client. When nil, the
+	// address and payload are written as received.
+	WrapReply func(src *core.Address, payload []byte) []byte
+	
+	// UnwrapRequest turns a packet from the client into the address and
+	// payload sent to the server. A nil result without error means the packet
+	// was consumed without anything to send yet; packets with an error are
+	// dropped. When nil, packets are sent as received.
+	UnwrapRequest func(from net.Addr, packet []byte) ([]byte, error)
+	
+	// IdleTimeout stops Run once no packet has been relayed in either
+	// direction for this long. Zero disables the check.
+	IdleTimeout time.Duration
+	lastActive  atomic.Int64
+	
+	// AllowedClient restricts the clients whose packets are relayed. An
+	// unspecified IP or a zero port matches any value. Nil allows everyone.
+	AllowedClient *net.UDPAddr
+	
+	// MaxRedials is how many times in a row Run re-dials the server after a
+	// failed read instead of stopping. Every re-dial starts new client
+	// sessions, so the server sees fresh session IDs and subkeys.
+	MaxRedials int
+	
+	// DSCP marks the packets sent to the server with this code point.
+	// Zero leaves the marking unchanged.
+	DSCP int
+	
+	// MaxPacketRate caps the packets per second of each session in each
+	// direction; excess packets are dropped. Zero means no limit.
+	MaxPacketRate int
+	
+	// SyncClock stamps outgoing packets with the server's clock, as learned
+	// from the timestamps of its responses, instead of the local one, and
+	// checks the age of responses against it. This keeps a drifting local
+	// clock within the server's acceptance window.
+	SyncClock   bool
+	clockOffset atomic.Int64 // nanoseconds to add to the local clock
+	
+	// SaltSource provides the session IDs, which salt the session subkeys.
+	// Nil means crypto/rand.
+	SaltSource io.Reader
+	
+	// Quota, when set, counts the relayed bytes; Run stops with
+	// core.ErrQuotaExceeded once active connections have to stop.
+	Quota *core.Quota
+	// BackoffJitter randomizes the delays between re-dials, see MaxRedials.
+	BackoffJitter core.Jitter
+	
+	ClientConn net.PacketConn
+	// ServerConn is connected to the server, so that it only receives the
+	// server's packets.
+	ServerConn net.Conn
+	serverMu   sync.RWMutex
 	
 	// server session ID → server session *Cipher
 	serverCiphers sync.Map
@@ -68,12 +187,9 @@ type UDPClient struct {
 	clientAddrByID sync.Map
 }
 
+// NewUDPClient listens for client packets on listenAddr and relays them to
+// serverAddr.
 func NewUDPClient(method string, psk []byte, listenAddr, serverAddr string) (*UDPClient, error) {
-	block, err := NewBlockCipher(psk)
-	if err != nil {
-		return nil, err
-	}
-	
 	lnAddr, err := net.ResolveUDPAddr("udp", listenAddr)
 	if err != nil {
 		return nil, err
@@ -83,6 +199,17 @@ func NewUDPClient(method string, psk []byte, listenAddr, serverAddr string) (*UD
 		return nil, err
 	}
 	
+	c, err := NewUDPClientWithConn(method, psk, clientConn, serverAddr)
+	if err != nil {
+		clientConn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewUDPClientWithConn relays the client packets read from clientConn, which
+// may be any PacketConn, such as an in-memory one.
+func NewUDPClientWithConn(method string, psk []byte, clientConn net.PacketConn, serverAddr string) (*UDPClient, error) {
 	sAddr, err := net.ResolveUDPAddr("udp", serverAddr)
 	if err != nil {
 		return nil, err
@@ -92,16 +219,48 @@ func NewUDPClient(method string, psk []byte, listenAddr, serverAddr string) (*UD
 		return nil, err
 	}
 	
+	c, err := NewUDPClientWithConns(method, psk, clientConn, serverConn)
+	if err != nil {
+		serverConn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewUDPClientWithConns relays between clientConn and serverConn, a Conn
+// connected to the server. Both may be in-memory connections; re-dials
+// after server errors, see MaxRedials, dial the remote address of
+// serverConn over UDP.
+func NewUDPClientWithConns(method string, psk []byte, clientConn net.PacketConn, serverConn net.Conn) (*UDPClient, error) {
+	var block cipher.Block
+	var xaead cipher.AEAD
+	var err error
+	if method == "2022-blake3-chacha20-poly1305" {
+		xaead, err = chacha20poly1305.NewX(psk)
+	} else {
+		block, err = NewBlockCipher(psk)
+	}
+	if err != nil {
+		return nil, err
+	}
+	
 	return &UDPClient{
 		Method:      method,
 		PSK:         psk,
 		BlockCipher: block,
+		XAEAD:       xaead,
 		ClientConn:  clientConn,
 		ServerConn:  serverConn,
 	}, nil
 }
 
 func (c *UDPClient) Run(ctx context.Context) error {
+	if err := setConnDSCP(c.ServerConn, c.DSCP); err != nil {
+		c.ClientConn.Close()
+		c.ServerConn.Close()
+		return err
+	}
+	
 	var errGroup errgroup.Group
 	
 	ctx, cancel := context.WithCancel(ctx)
@@ -110,27 +269,79 @@ func (c *UDPClient) Run(ctx context.Context) error {
 	errGroup.Go(func() error {
 		<-ctx.Done()
 		c.ClientConn.Close()
+		c.serverMu.Lock()
 		c.ServerConn.Close()
+		c.serverMu.Unlock()
 		return nil
 	})
 	
+	c.lastActive.Store(time.Now().UnixNano())
+	if c.IdleTimeout > 0 {
+		errGroup.Go(func() error {
+			defer cancel()
+			
+			// A tiny IdleTimeout must not make NewTicker panic or spin.
+			ticker := time.NewTicker(max(c.IdleTimeout/2, minIdleCheckInterval))
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-ticker.C:
+					if time.Since(time.Unix(0, c.lastActive.Load())) > c.IdleTimeout {
+						return ErrIdleTimeout
+					}
+				}
+			}
+		})
+	}
+	
 	errGroup.Go(func() error {
 		defer cancel()
 		
-		buf := make([]byte, 65535)
+		buf := bufpool.Get(65535)
+		defer bufpool.Put(buf)
 		for {
 			n, fromAddr, err := c.ClientConn.ReadFrom(buf)
 			if err != nil {
 				return fmt.Errorf("read UDP packet from client connection failed: %w", err)
 			}
+			if !c.allowClient(fromAddr) {
+				continue
+			}
+			c.lastActive.Store(time.Now().UnixNano())
+			
+			data := buf[:n]
+			if c.UnwrapRequest != nil {
+				if data, err = c.UnwrapRequest(fromAddr, data); err != nil || data == nil {
+					continue
+				}
+			}
 			
-			packed, err := c.EncryptPacket(fromAddr, buf[:n])
+			if c.MaxPacketRate > 0 && !c.allowPacket(fromAddr, true) {
+				continue
+			}
+			
+			packed, err := c.EncryptPacket(fromAddr, data)
 			if err != nil {
 				return fmt.Errorf("pack UDP packet failed: %w", err)
 			}
 			
-			_, err = c.ServerConn.Write(packed)
+			serverConn := c.serverConn()
+			if err = c.Quota.Count(len(data)); err != nil {
+				return err
+			}
+			_, err = serverConn.Write(packed)
 			if err != nil {
+				if ctx.Err() == nil && serverConn != c.serverConn() {
+					continue // replaced by a re-dial while writing
+				}
+				if errors.Is(err, syscall.EMSGSIZE) {
+					// Only this packet is lost; the association stays usable
+					// for smaller ones.
+					slog.Warn("[Shadowsocks] UDP packet dropped: exceeds path MTU to server", "size", len(packed), "payload", len(data), "hint", "lower the MTU or datagram size of the application")
+					continue
+				}
 				return fmt.Errorf("write UDP packet to server connection failed: %w", err)
 			}
 		}
@@ -139,22 +350,49 @@ func (c *UDPClient) Run(ctx context.Context) error {
 	errGroup.Go(func() error {
 		defer cancel()
 		
-		buf := make([]byte, 65535)
+		buf := bufpool.Get(65535)
+		defer bufpool.Put(buf)
+		redials := 0
+		backoff := core.Backoff{Min: 50 * time.Millisecond, Max: 5 * time.Second, Jitter: c.BackoffJitter}
 		for {
-			n, fromAddr, err := c.ServerConn.ReadFrom(buf)
+			serverConn := c.serverConn()
+			n, err := serverConn.Read(buf)
 			if err != nil {
-				return fmt.Errorf("read UDP packet from server connection failed: %w", err)
-			}
-			
-			if fromAddr.String() != c.ServerConn.RemoteAddr().String() {
-				return fmt.Errorf("got different address from server address: got %s, want:%s", fromAddr.String(), c.ServerConn.RemoteAddr().String())
+				if ctx.Err() != nil || redials >= c.MaxRedials {
+					return fmt.Errorf("read UDP packet from server connection failed: %w", err)
+				}
+				redials++
+				select {
+				case <-ctx.Done():
+					return fmt.Errorf("read UDP packet from server connection failed: %w", err)
+				case <-time.After(backoff.Next()):
+				}
+				if err = c.redialServer(ctx); err != nil {
+					return fmt.Errorf("re-dial server failed: %w", err)
+				}
+				continue
 			}
+			redials = 0
+			backoff.Reset()
+			c.lastActive.Store(time.Now().UnixNano())
 			
-			unpacked, toAddr, err := c.DecryptPacket(buf[:n])
+			unpacked, srcAddr, toAddr, err := c.DecryptPacket(buf[:n])
 			if err != nil {
 				return fmt.Errorf("unpack UDP packet failed: %w", err)
 			}
+			if c.MaxPacketRate > 0 && !c.allowPacket(toAddr, false) {
+				continue
+			}
+			
+			if c.WrapReply != nil {
+				unpacked = c.WrapReply(srcAddr, unpacked)
+			} else {
+				unpacked = append(srcAddr.Bytes(), unpacked...)
+			}
 			
+			if err = c.Quota.Count(len(unpacked)); err != nil {
+				return err
+			}
 			_, err = c.ClientConn.WriteTo(unpacked, toAddr)
 			if err != nil {
 				return fmt.Errorf("write UDP packet to client connection failed: %w", err)
@@ -165,62 +403,166 @@ func (c *UDPClient) Run(ctx context.Context) error {
 	return errGroup.Wait()
 }
 
+// allowPacket applies MaxPacketRate to a packet from (up) or to the client
+// at addr, counting and logging the packets it drops.
+func (c *UDPClient) allowPacket(addr net.Addr, up bool) bool {
+	session, err := c.getOrCreateClientSession(addr)
+	if err != nil {
+		return true // EncryptPacket reports the error
+	}
+	bucket, direction := &session.upLimit, "up"
+	if !up {
+		bucket, direction = &session.downLimit, "down"
+	}
+	if bucket.allow(c.MaxPacketRate) {
+		return true
+	}
+	session.dropped.Add(1)
+	slog.Debug("[Shadowsocks] UDP packet dropped: session rate limit", "client", addr, "direction", direction, "limit", c.MaxPacketRate)
+	return false
+}
+
+func (c *UDPClient) allowClient(addr net.Addr) bool {
+	if c.AllowedClient == nil {
+		return true
+	}
+	from, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	if c.AllowedClient.Port != 0 && c.AllowedClient.Port != from.Port {
+		return false
+	}
+	return c.AllowedClient.IP.IsUnspecified() || c.AllowedClient.IP.Equal(from.IP)
+}
+
+func (c *UDPClient) serverConn() net.Conn {
+	c.serverMu.RLock()
+	defer c.serverMu.RUnlock()
+	return c.ServerConn
+}
+
+func (c *UDPClient) redialServer(ctx context.Context) error {
+	c.serverMu.Lock()
+	defer c.serverMu.Unlock()
+	
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	
+	serverConn, err := net.Dial("udp", c.ServerConn.RemoteAddr().String())
+	if err != nil {
+		return err
+	}
+	if err = setConnDSCP(serverConn, c.DSCP); err != nil {
+		serverConn.Close()
+		return err
+	}
+	c.ServerConn.Close()
+	c.ServerConn = serverConn
+	
+	c.clientSessions.Clear()
+	c.clientAddrByID.Clear()
+	c.serverCiphers.Clear()
+	return nil
+}
+
 func (c *UDPClient) EncryptPacket(clientAddr net.Addr, data []byte) ([]byte, error) {
 	session, err := c.getOrCreateClientSession(clientAddr)
 	if err != nil {
 		return nil, err
 	}
+	session.lastActive.Store(time.Now().UnixNano())
+	session.bytesSent.Add(uint64(len(data)))
 	
-	separateHeader := session.SeparateHeader()
-	enSeparateHeader := make([]byte, 16)
-	c.BlockCipher.Encrypt(enSeparateHeader, separateHeader)
+	separateHeader := session.nextSeparateHeader()
+	pad := !session.padded.Swap(true)
+	if c.XAEAD != nil {
+		return c.encryptXPacket(session, separateHeader, pad, data)
+	}
+	
+	// The whole packet is built in one buffer: the body follows the encrypted
+	// separate header and is sealed in place.
+	packet := make([]byte, 16, 16+maxMessageHeaderLen+len(data)+session.Cipher.AEAD.Overhead())
+	c.BlockCipher.Encrypt(packet[:16], separateHeader)
 	
-	messageHeader, err := c.buildMessageHeader()
+	packet, err = c.appendMessageHeader(packet, pad)
 	if err != nil {
 		return nil, err
 	}
+	packet = append(packet, data...)
 	
-	body := append(messageHeader, data...)
+	packet = session.Cipher.AEAD.Seal(packet[:16], separateHeader[4:16], packet[16:], nil)
 	
-	enBody := session.Cipher.AEAD.Seal(nil, separateHeader[4:16], body, nil)
-	session.Cipher.Counter.Count()
-	
-	return append(enSeparateHeader, enBody...), nil
+	return packet, nil
 }
 
-func (c *UDPClient) DecryptPacket(payload []byte) ([]byte, net.Addr, error) {
-	if len(payload) < 16 {
-		return nil, nil, ErrPayloadTooShort
+// encryptXPacket builds a chacha20 packet: a random 24-byte nonce followed by
+// the separate header, message header and data, all sealed with the PSK.
+func (c *UDPClient) encryptXPacket(session *UDPSession, separateHeader []byte, pad bool, data []byte) ([]byte, error) {
+	nonceSize := c.XAEAD.NonceSize()
+	packet := make([]byte, nonceSize, nonceSize+16+maxMessageHeaderLen+len(data)+c.XAEAD.Overhead())
+	if _, err := rand.Read(packet); err != nil {
+		return nil, err
 	}
+	packet = append(packet, separateHeader...)
 	
-	deHeader := make([]byte, 16)
-	c.BlockCipher.Decrypt(deHeader, payload[:16])
-	
-	serverCipher, err := c.getOrCreateServerCipher(deHeader[:8])
+	packet, err := c.appendMessageHeader(packet, pad)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
+	packet = append(packet, data...)
 	
-	aeadNonce := make([]byte, 12)
-	copy(aeadNonce[:4], deHeader[4:8])
-	copy(aeadNonce[4:], deHeader[8:16])
+	packet = c.XAEAD.Seal(packet[:nonceSize], packet[:nonceSize], packet[nonceSize:], nil)
 	
-	deBody, err := serverCipher.AEAD.Open(nil, aeadNonce, payload[16:], nil)
+	return packet, nil
+}
+
+// DecryptPacket opens a server packet and returns its payload, the source
+// address reported by the server and the client the packet belongs to.
+//
+// The body is decrypted in place, so payload must not be used afterwards.
+func (c *UDPClient) DecryptPacket(payload []byte) ([]byte, *core.Address, net.Addr, error) {
+	deBody, err := c.openPacket(payload)
 	if err != nil {
-		return nil, nil, fmt.Errorf("decrypt body: %w", err)
+		return nil, nil, nil, err
 	}
 	
-	body, clientSessionID, err := c.parseMessageBody(deBody)
+	body, srcAddr, clientSessionID, err := c.parseMessageBody(deBody)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	
 	v, ok := c.clientAddrByID.Load(string(clientSessionID))
 	if !ok {
-		return nil, nil, ErrSessionNotFound
+		return nil, nil, nil, ErrSessionNotFound
+	}
+	if s, ok := c.clientSessions.Load(v.(net.Addr).String()); ok {
+		session := s.(*UDPSession)
+		session.lastActive.Store(time.Now().UnixNano())
+		session.bytesReceived.Add(uint64(len(body)))
 	}
 	
-	return body, v.(net.Addr), nil
+	return body, srcAddr, v.(net.Addr), nil
+}
+
+// Sessions returns a snapshot of the active client sessions. It is safe to
+// call while Run is relaying.
+func (c *UDPClient) Sessions() []SessionInfo {
+	var infos []SessionInfo
+	c.clientSessions.Range(func(k, v any) bool {
+		s := v.(*UDPSession)
+		infos = append(infos, SessionInfo{
+			ClientAddr:    k.(string),
+			SessionID:     hex.EncodeToString(s.ID),
+			LastActive:    time.Unix(0, s.lastActive.Load()),
+			BytesSent:     s.bytesSent.Load(),
+			BytesReceived: s.bytesReceived.Load(),
+			Dropped:       s.dropped.Load(),
+		})
+		return true
+	})
+	return infos
 }
 
 func (c *UDPClient) Close() error {
@@ -235,7 +577,11 @@ func (c *UDPClient) getOrCreateClientSession(addr net.Addr) (*UDPSession, error)
 		return v.(*UDPSession), nil
 	}
 	
-	session, err := NewUDPSession(c.Method, c.PSK)
+	src := c.SaltSource
+	if src == nil {
+		src = rand.Reader
+	}
+	session, err := NewUDPSessionFrom(c.Method, c.PSK, src)
 	if err != nil {
 		return nil, err
 	}
@@ -255,7 +601,7 @@ func (c *UDPClient) getOrCreateServerCipher(sessionID []byte) (*Cipher, error) {
 		return v.(*Cipher), nil
 	}
 	
-	cipher, err := NewCipherWithSalt(c.Method, c.PSK, sessionID)
+	cipher, err := NewSessionCipher(c.Method, c.PSK, sessionID)
 	if err != nil {
 		return nil, err
 	}
@@ -264,62 +610,125 @@ func (c *UDPClient) getOrCreateServerCipher(sessionID []byte) (*Cipher, error) {
 	return cipher, nil
 }
 
-func (c *UDPClient) buildMessageHeader() ([]byte, error) {
-	mh := []byte{0x00} // Type: Client-to-Server
-	
-	timestamp := make([]byte, 8)
-	binary.BigEndian.PutUint64(timestamp, uint64(time.Now().Unix()))
-	mh = append(mh, timestamp...)
+// maxMessageHeaderLen is the size of a client message header carrying the
+// longest padding: type, timestamp, padding length and padding.
+const maxMessageHeaderLen = 1 + 8 + 2 + maxUDPPaddingLength - 1
+
+const maxUDPPaddingLength = 100
+
+// appendMessageHeader appends a client message header to dst. Only the first
+// packet of a session needs padding to hide its length; later ones carry an
+// empty padding field.
+func (c *UDPClient) appendMessageHeader(dst []byte, pad bool) ([]byte, error) {
+	dst = append(dst, 0x00) // Type: Client-to-Server
+	dst = binary.BigEndian.AppendUint64(dst, uint64(c.now().Unix()))
+	
+	var paddingLength int
+	if pad && !c.NoPadding {
+		paddingLength = choosePadding(c.Padder, maxUDPPaddingLength)
+	}
+	dst = binary.BigEndian.AppendUint16(dst, uint16(paddingLength))
 	
-	pl, err := rand.Int(rand.Reader, big.NewInt(100))
-	if err != nil {
+	start := len(dst)
+	dst = append(dst, make([]byte, paddingLength)...)
+	if _, err := rand.Read(dst[start:]); err != nil {
 		return nil, err
 	}
-	paddingLength := uint16(pl.Int64())
-	padding := make([]byte, paddingLength+2)
-	binary.BigEndian.PutUint16(padding, paddingLength)
-	if _, err = rand.Read(padding[2:]); err != nil {
+	
+	return dst, nil
+}
+
+// now returns the local time, corrected by the learned offset to the
+// server's clock when SyncClock is set.
+func (c *UDPClient) now() time.Time {
+	return time.Now().Add(time.Duration(c.clockOffset.Load()))
+}
+
+// openPacket decrypts a server packet in place and returns its message
+// body, which starts with the type field.
+func (c *UDPClient) openPacket(payload []byte) ([]byte, error) {
+	if c.XAEAD != nil {
+		nonceSize := c.XAEAD.NonceSize()
+		if len(payload) < nonceSize+16+c.XAEAD.Overhead() {
+			return nil, ErrPayloadTooShort
+		}
+		deBody, err := c.XAEAD.Open(payload[nonceSize:nonceSize], payload[:nonceSize], payload[nonceSize:], nil)
+		if err != nil {
+			return nil, fmt.Errorf("decrypt packet: %w", err)
+		}
+		return deBody[16:], nil // skip the separate header
+	}
+	
+	if len(payload) < 16 {
+		return nil, ErrPayloadTooShort
+	}
+	
+	var deHeader [16]byte
+	c.BlockCipher.Decrypt(deHeader[:], payload[:16])
+	
+	serverCipher, err := c.getOrCreateServerCipher(deHeader[:SessionIDSize])
+	if err != nil {
 		return nil, err
 	}
 	
-	return append(mh, padding...), nil
+	deBody, err := serverCipher.AEAD.Open(payload[16:16], deHeader[4:16], payload[16:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt body: %w", err)
+	}
+	return deBody, nil
 }
 
-func (c *UDPClient) parseMessageBody(deBody []byte) (payload, clientSessionID []byte, err error) {
+func (c *UDPClient) parseMessageBody(deBody []byte) (payload []byte, srcAddr *core.Address, clientSessionID []byte, err error) {
 	if len(deBody) < 1 {
-		return nil, nil, ErrPayloadTooShort
+		return nil, nil, nil, ErrPayloadTooShort
 	}
 	if deBody[0] != 1 { // Type: Server-to-Client
-		return nil, nil, ErrBadHeaderType
+		return nil, nil, nil, ErrBadHeaderType
 	}
 	deBody = deBody[1:]
 	
 	if len(deBody) < 8 {
-		return nil, nil, ErrPayloadTooShort
+		return nil, nil, nil, ErrPayloadTooShort
 	}
 	t := time.Unix(int64(binary.BigEndian.Uint64(deBody[:8])), 0)
-	if time.Since(t) > 30*time.Second {
-		return nil, nil, ErrTimestampExpired
+	offset := c.clockOffset.Load()
+	now := time.Now().Add(time.Duration(offset))
+	if d := t.Sub(now); c.SyncClock && (d > time.Second || d < -time.Second) {
+		// The packet is authenticated, so t is the server's clock. Smaller
+		// differences are within its one-second resolution. The offset is
+		// only moved from the value now was based on, so that packets
+		// measured concurrently do not add up their corrections.
+		c.clockOffset.CompareAndSwap(offset, offset+int64(d))
+		now = now.Add(d)
+	}
+	if now.Sub(t) > 30*time.Second {
+		return nil, nil, nil, ErrTimestampExpired
 	}
 	deBody = deBody[8:]
 	
-	if len(deBody) < 8 {
-		return nil, nil, ErrPayloadTooShort
+	if len(deBody) < SessionIDSize {
+		return nil, nil, nil, ErrPayloadTooShort
 	}
-	clientSessionID = make([]byte, 8)
-	copy(clientSessionID, deBody[:8])
-	deBody = deBody[8:]
+	clientSessionID = make([]byte, SessionIDSize)
+	copy(clientSessionID, deBody[:SessionIDSize])
+	deBody = deBody[SessionIDSize:]
 	
 	if len(deBody) < 2 {
-		return nil, nil, ErrPayloadTooShort
+		return nil, nil, nil, ErrPayloadTooShort
 	}
 	paddingLen := int(binary.BigEndian.Uint16(deBody))
 	deBody = deBody[2:]
 	
 	if len(deBody) < paddingLen {
-		return nil, nil, ErrPayloadTooShort
+		return nil, nil, nil, ErrPayloadTooShort
 	}
 	deBody = deBody[paddingLen:]
 	
-	return deBody, clientSessionID, nil
+	srcAddr, err = core.ReadAddressFromBytes(deBody)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("read source address: %w", err)
+	}
+	deBody = deBody[len(srcAddr.Bytes()):]
+	
+	return deBody, srcAddr, clientSessionID, nil
 }
@@ -0,0 +1,897 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"kage/core"
+	"log/slog"
+	"maps"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// newTestUDPClient returns a UDPClient that can pack and unpack packets
+// without any socket.
+func newTestUDPClient(tb testing.TB, method string) *UDPClient {
+	tb.Helper()
+	psk := testKey(tb, method)
+	c := &UDPClient{Method: method, PSK: psk}
+	var err error
+	if method == "2022-blake3-chacha20-poly1305" {
+		c.XAEAD, err = chacha20poly1305.NewX(psk)
+	} else {
+		c.BlockCipher, err = NewBlockCipher(psk)
+	}
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return c
+}
+
+// testServerSession is the server side of one UDP session.
+type testServerSession struct {
+	id       []byte
+	packetID uint64
+	cipher   *Cipher
+	clock    time.Duration // skew of the server's clock from the local one
+}
+
+func newTestServerSession(tb testing.TB, c *UDPClient) *testServerSession {
+	tb.Helper()
+	id := []byte{9, 8, 7, 6, 5, 4, 3, 2}
+	sc, err := NewSessionCipher(c.Method, c.PSK, id)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return &testServerSession{id: id, cipher: sc}
+}
+
+// seal builds a server packet to the client session clientID, as sent by
+// the server for a reply from src.
+func (s *testServerSession) seal(c *UDPClient, clientID []byte, src *core.Address, payload []byte) []byte {
+	header := make([]byte, 16)
+	copy(header, s.id)
+	binary.BigEndian.PutUint64(header[SessionIDSize:], s.packetID)
+	s.packetID++
+	
+	body := []byte{1} // Type: Server-to-Client
+	body = binary.BigEndian.AppendUint64(body, uint64(time.Now().Add(s.clock).Unix()))
+	body = append(body, clientID...)
+	body = binary.BigEndian.AppendUint16(body, 0) // padding length
+	body = append(body, src.Bytes()...)
+	body = append(body, payload...)
+	
+	if c.XAEAD != nil {
+		nonce := bytes.Repeat([]byte{byte(s.packetID)}, c.XAEAD.NonceSize())
+		return c.XAEAD.Seal(nonce, nonce, append(header, body...), nil)
+	}
+	packet := make([]byte, 16)
+	c.BlockCipher.Encrypt(packet, header)
+	return s.cipher.AEAD.Seal(packet, header[4:16], body, nil)
+}
+
+// openClientPacket is the server side of EncryptPacket: it returns the
+// separate header and the message body of a client packet.
+func openClientPacket(tb testing.TB, c *UDPClient, packet []byte) (header, body []byte) {
+	tb.Helper()
+	if c.XAEAD != nil {
+		nonceSize := c.XAEAD.NonceSize()
+		plain, err := c.XAEAD.Open(nil, packet[:nonceSize], packet[nonceSize:], nil)
+		if err != nil {
+			tb.Fatalf("open client packet: %v", err)
+		}
+		return plain[:16], plain[16:]
+	}
+	header = make([]byte, 16)
+	c.BlockCipher.Decrypt(header, packet[:16])
+	sc, err := NewSessionCipher(c.Method, c.PSK, header[:SessionIDSize])
+	if err != nil {
+		tb.Fatal(err)
+	}
+	body, err = sc.AEAD.Open(nil, header[4:16], packet[16:], nil)
+	if err != nil {
+		tb.Fatalf("open client packet: %v", err)
+	}
+	return header, body
+}
+
+// parseClientBody returns the target and payload of a client message body.
+func parseClientBody(tb testing.TB, body []byte) (*core.Address, []byte) {
+	tb.Helper()
+	if len(body) < 11 || body[0] != 0 {
+		tb.Fatalf("bad client message header % x", body[:min(len(body), 11)])
+	}
+	rest := body[11+int(binary.BigEndian.Uint16(body[9:11])):]
+	addr, err := core.ReadAddressFromBytes(rest)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return addr, rest[len(addr.Bytes()):]
+}
+
+// recvPacket waits for the next packet arriving at c.
+func recvPacket(tb testing.TB, c *memPacketConn) memPacket {
+	tb.Helper()
+	select {
+	case pkt := <-c.in:
+		return pkt
+	case <-time.After(5 * time.Second):
+		tb.Fatalf("no packet arrived at %s", c.local)
+		return memPacket{}
+	}
+}
+
+func TestUDPClientRelayInMemory(t *testing.T) {
+	for _, method := range testMethods {
+		t.Run(method, func(t *testing.T) {
+			app, clientSide := newMemPacketPair("app", "client-side")
+			serverSide, server := newMemPacketPair("server-side", "server")
+			c, err := NewUDPClientWithConns(method, testKey(t, method), clientSide, serverSide)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() { done <- c.Run(ctx) }()
+			
+			target := testTarget(t)
+			app.WriteTo(append(target.Bytes(), "ping"...), clientSide.LocalAddr())
+			header, body := openClientPacket(t, c, recvPacket(t, server).data)
+			addr, payload := parseClientBody(t, body)
+			if addr.String() != target.String() || string(payload) != "ping" {
+				t.Fatalf("server got %q for %s, want %q for %s", payload, addr, "ping", target)
+			}
+			
+			server.Write(newTestServerSession(t, c).seal(c, header[:SessionIDSize], target, []byte("pong")))
+			reply := recvPacket(t, app)
+			if want := append(target.Bytes(), "pong"...); !bytes.Equal(reply.data, want) {
+				t.Fatalf("client got % x, want % x", reply.data, want)
+			}
+			if reply.from != clientSide.LocalAddr() {
+				t.Errorf("reply from %v, want %v", reply.from, clientSide.LocalAddr())
+			}
+			if sessions := c.Sessions(); len(sessions) != 1 || sessions[0].ClientAddr != "app" {
+				t.Errorf("Sessions() = %+v, want one session for app", sessions)
+			}
+			
+			cancel()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Run did not return after cancellation")
+			}
+		})
+	}
+}
+
+func TestUDPClientMaxPacketRate(t *testing.T) {
+	const rate = 5
+	method := testMethods[0]
+	app, clientSide := newMemPacketPair("app", "client-side")
+	serverSide, server := newMemPacketPair("server-side", "server")
+	c, err := NewUDPClientWithConns(method, testKey(t, method), clientSide, serverSide)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.MaxPacketRate = rate
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx)
+	
+	// received counts the packets reaching the server until none arrives
+	// for a while.
+	received := func() int {
+		n := 0
+		for {
+			select {
+			case <-server.in:
+				n++
+			case <-time.After(100 * time.Millisecond):
+				return n
+			}
+		}
+	}
+	
+	packet := append(testTarget(t).Bytes(), "flood"...)
+	for range 4 * rate {
+		app.WriteTo(packet, clientSide.LocalAddr())
+	}
+	// The bucket starts full and refills a little while the burst is read.
+	if n := received(); n < rate || n > rate+1 {
+		t.Fatalf("%d of %d packets relayed, want the %d of a full bucket", n, 4*rate, rate)
+	}
+	sessions := c.Sessions()
+	if len(sessions) != 1 {
+		t.Fatalf("%d sessions, want 1", len(sessions))
+	}
+	if d := sessions[0].Dropped; d < 4*rate-rate-1 || d > 4*rate-rate {
+		t.Errorf("Dropped = %d, want the %d packets over the limit", d, 4*rate-rate)
+	}
+	
+	// The session lives on and gets new tokens.
+	time.Sleep(time.Second / rate)
+	app.WriteTo(packet, clientSide.LocalAddr())
+	if n := received(); n != 1 {
+		t.Fatalf("%d packets relayed after the bucket refilled, want 1", n)
+	}
+	if after := c.Sessions(); len(after) != 1 || after[0].SessionID != sessions[0].SessionID {
+		t.Errorf("Sessions() = %+v after the burst, want the same session", after)
+	}
+}
+
+func TestDecryptPacketSourceAddress(t *testing.T) {
+	for _, method := range testMethods {
+		t.Run(method, func(t *testing.T) {
+			c := newTestUDPClient(t, method)
+			packet, err := c.EncryptPacket(benchClient, append(testTarget(t).Bytes(), "query"...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			header, _ := openClientPacket(t, c, packet)
+			
+			// The reply comes from another address than the one asked,
+			// as with a DNS server answering from a different interface.
+			src, err := core.ParseAddress("198.51.100.7:5353")
+			if err != nil {
+				t.Fatal(err)
+			}
+			reply := newTestServerSession(t, c).seal(c, header[:SessionIDSize], src, []byte("answer"))
+			payload, gotSrc, client, err := c.DecryptPacket(reply)
+			if err != nil {
+				t.Fatalf("DecryptPacket: %v", err)
+			}
+			if gotSrc.String() != src.String() {
+				t.Errorf("source address = %s, want %s", gotSrc, src)
+			}
+			if client.String() != benchClient.String() {
+				t.Errorf("client = %s, want %s", client, benchClient)
+			}
+			if string(payload) != "answer" {
+				t.Errorf("payload = %q, want %q", payload, "answer")
+			}
+		})
+	}
+}
+
+func TestUDPClientSyncClock(t *testing.T) {
+	const skew = -90 * time.Second
+	method := testMethods[0]
+	// near reports whether the offset is the skew, up to the one-second
+	// resolution of timestamps.
+	near := func(d time.Duration) bool {
+		return d > skew-2*time.Second && d < skew+2*time.Second
+	}
+	
+	c := newTestUDPClient(t, method)
+	packet, err := c.EncryptPacket(benchClient, append(testTarget(t).Bytes(), "ping"...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, _ := openClientPacket(t, c, packet)
+	s := newTestServerSession(t, c)
+	s.clock = skew
+	if _, _, _, err := c.DecryptPacket(s.seal(c, header[:SessionIDSize], testTarget(t), []byte("pong"))); !errors.Is(err, ErrTimestampExpired) {
+		t.Fatalf("without SyncClock: err = %v, want %v", err, ErrTimestampExpired)
+	}
+	
+	c.SyncClock = true
+	if _, _, _, err := c.DecryptPacket(s.seal(c, header[:SessionIDSize], testTarget(t), []byte("pong"))); err != nil {
+		t.Fatalf("with SyncClock: %v", err)
+	}
+	if offset := time.Duration(c.clockOffset.Load()); !near(offset) {
+		t.Fatalf("offset = %v, want about %v", offset, skew)
+	}
+	packet, err = c.EncryptPacket(benchClient, append(testTarget(t).Bytes(), "ping"...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, body := openClientPacket(t, c, packet)
+	stamp := time.Unix(int64(binary.BigEndian.Uint64(body[1:9])), 0)
+	if d := time.Until(stamp); !near(d) {
+		t.Errorf("outgoing timestamp is off by %v, want about %v", d, skew)
+	}
+	
+	// Packets measured against the same offset correct it once, not once
+	// each.
+	c.clockOffset.Store(0)
+	packets := make([][]byte, 16)
+	for i := range packets {
+		packets[i] = s.seal(c, header[:SessionIDSize], testTarget(t), []byte("pong"))
+	}
+	var wg sync.WaitGroup
+	for _, p := range packets {
+		wg.Go(func() {
+			if _, _, _, err := c.DecryptPacket(p); err != nil {
+				t.Errorf("DecryptPacket: %v", err)
+			}
+		})
+	}
+	wg.Wait()
+	if offset := time.Duration(c.clockOffset.Load()); !near(offset) {
+		t.Errorf("offset after concurrent packets = %v, want about %v", offset, skew)
+	}
+}
+
+func TestUDPClientSaltSource(t *testing.T) {
+	for _, method := range testMethods {
+		t.Run(method, func(t *testing.T) {
+			id := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+			c := newTestUDPClient(t, method)
+			c.SaltSource = bytes.NewReader(id)
+			packet, err := c.EncryptPacket(benchClient, append(testTarget(t).Bytes(), "ping"...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if header, _ := openClientPacket(t, c, packet); !bytes.Equal(header[:SessionIDSize], id) {
+				t.Fatalf("session ID = % x, want % x from SaltSource", header[:SessionIDSize], id)
+			}
+			
+			// A new client needs a new session, and the source is drained.
+			other := &net.UDPAddr{IP: benchClient.IP, Port: benchClient.Port + 1}
+			if _, err := c.EncryptPacket(other, append(testTarget(t).Bytes(), "ping"...)); !errors.Is(err, io.EOF) {
+				t.Fatalf("EncryptPacket with a drained SaltSource = %v, want EOF", err)
+			}
+		})
+	}
+}
+
+func TestUDPChachaRoundTrip(t *testing.T) {
+	c := newTestUDPClient(t, "2022-blake3-chacha20-poly1305")
+	target := testTarget(t)
+	packet, err := c.EncryptPacket(benchClient, append(target.Bytes(), "ping"...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	// Both directions seal whole packets with the PSK, so the reply path
+	// opens what encryptXPacket sealed.
+	body, err := c.openPacket(slices.Clone(packet))
+	if err != nil {
+		t.Fatalf("openPacket: %v", err)
+	}
+	addr, payload := parseClientBody(t, body)
+	if addr.String() != target.String() || string(payload) != "ping" {
+		t.Fatalf("got %q for %s, want %q for %s", payload, addr, "ping", target)
+	}
+	
+	header, _ := openClientPacket(t, c, packet)
+	reply := newTestServerSession(t, c).seal(c, header[:SessionIDSize], target, []byte("pong"))
+	for i := range c.XAEAD.NonceSize() {
+		tampered := slices.Clone(packet)
+		tampered[i] ^= 0x80
+		if _, err := c.openPacket(tampered); err == nil {
+			t.Fatalf("client packet with nonce byte %d flipped was accepted", i)
+		}
+		tampered = slices.Clone(reply)
+		tampered[i] ^= 0x80
+		if _, _, _, err := c.DecryptPacket(tampered); err == nil {
+			t.Fatalf("reply with nonce byte %d flipped was accepted", i)
+		}
+	}
+	
+	payload, _, _, err = c.DecryptPacket(reply)
+	if err != nil {
+		t.Fatalf("DecryptPacket: %v", err)
+	}
+	if string(payload) != "pong" {
+		t.Errorf("payload = %q, want %q", payload, "pong")
+	}
+}
+
+func TestUDPPaddingFirstPacketOnly(t *testing.T) {
+	for _, method := range testMethods {
+		t.Run(method, func(t *testing.T) {
+			c := newTestUDPClient(t, method)
+			data := append(testTarget(t).Bytes(), "ping"...)
+			paddings := func(client net.Addr, n int) []int {
+				var got []int
+				for range n {
+					packet, err := c.EncryptPacket(client, data)
+					if err != nil {
+						t.Fatal(err)
+					}
+					_, body := openClientPacket(t, c, packet)
+					got = append(got, int(binary.BigEndian.Uint16(body[9:11])))
+					if _, payload := parseClientBody(t, body); string(payload) != "ping" {
+						t.Fatalf("payload = %q, want %q", payload, "ping")
+					}
+				}
+				return got
+			}
+			
+			// Every session pads its own first packet.
+			for _, client := range []net.Addr{benchClient, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40001}} {
+				got := paddings(client, 3)
+				if got[0] == 0 || got[1] != 0 || got[2] != 0 {
+					t.Errorf("%v: padding lengths %v, want only the first packet padded", client, got)
+				}
+			}
+			
+			c.NoPadding = true
+			if got := paddings(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40002}, 2); got[0] != 0 || got[1] != 0 {
+				t.Errorf("NoPadding: padding lengths %v, want none", got)
+			}
+		})
+	}
+}
+
+// Run with -race: datagrams from one client may be packed concurrently, and
+// every packet of the session must still get its own packet ID and open with
+// the nonce its separate header carries.
+func TestEncryptPacketConcurrent(t *testing.T) {
+	for _, method := range testMethods {
+		t.Run(method, func(t *testing.T) {
+			c := newTestUDPClient(t, method)
+			data := append(testTarget(t).Bytes(), "ping"...)
+			const workers, perWorker = 8, 50
+			
+			packets := make(chan []byte, workers*perWorker)
+			var wg sync.WaitGroup
+			for range workers {
+				wg.Go(func() {
+					for range perWorker {
+						packet, err := c.EncryptPacket(benchClient, data)
+						if err != nil {
+							t.Error(err)
+							return
+						}
+						packets <- packet
+					}
+				})
+			}
+			wg.Wait()
+			close(packets)
+			
+			var sessionID []byte
+			seen := make(map[uint64]bool)
+			for packet := range packets {
+				header, body := openClientPacket(t, c, packet)
+				if sessionID == nil {
+					sessionID = header[:SessionIDSize]
+				} else if !bytes.Equal(header[:SessionIDSize], sessionID) {
+					t.Fatalf("session ID % x, want % x", header[:SessionIDSize], sessionID)
+				}
+				id := binary.BigEndian.Uint64(header[SessionIDSize:])
+				if seen[id] {
+					t.Fatalf("packet ID %d used twice", id)
+				}
+				seen[id] = true
+				if _, payload := parseClientBody(t, body); string(payload) != "ping" {
+					t.Fatalf("payload = %q, want %q", payload, "ping")
+				}
+			}
+			if len(seen) != workers*perWorker {
+				t.Fatalf("%d packets, want %d", len(seen), workers*perWorker)
+			}
+		})
+	}
+}
+
+func TestUDPClientTinyIdleTimeout(t *testing.T) {
+	method := testMethods[0]
+	_, clientSide := newMemPacketPair("app", "client-side")
+	serverSide, _ := newMemPacketPair("server-side", "server")
+	c, err := NewUDPClientWithConns(method, testKey(t, method), clientSide, serverSide)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.IdleTimeout = time.Nanosecond
+	
+	done := make(chan error, 1)
+	go func() { done <- c.Run(context.Background()) }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrIdleTimeout) {
+			t.Fatalf("Run = %v, want ErrIdleTimeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not time out")
+	}
+}
+
+func TestUDPClientIdleTimeout(t *testing.T) {
+	method := testMethods[0]
+	app, clientSide := newMemPacketPair("app", "client-side")
+	serverSide, server := newMemPacketPair("server-side", "server")
+	c, err := NewUDPClientWithConns(method, testKey(t, method), clientSide, serverSide)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const idle = 200 * time.Millisecond
+	c.IdleTimeout = idle
+	
+	done := make(chan error, 1)
+	go func() { done <- c.Run(context.Background()) }()
+	
+	// Traffic for twice the timeout keeps the association alive.
+	data := append(testTarget(t).Bytes(), "ping"...)
+	for range 8 {
+		app.WriteTo(data, clientSide.LocalAddr())
+		recvPacket(t, server)
+		time.Sleep(idle / 4)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("Run returned %v while packets were relayed", err)
+	default:
+	}
+	
+	start := time.Now()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrIdleTimeout) {
+			t.Fatalf("Run = %v, want ErrIdleTimeout", err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*idle {
+			t.Errorf("association reaped %v after the last packet, want about %v", elapsed, idle)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not time out once idle")
+	}
+}
+
+// brokenServerConn stands in for a server connection that fails: its Read
+// blocks until fail is closed and then returns ECONNREFUSED. Its writes are
+// kept in written.
+type brokenServerConn struct {
+	net.Conn // nil, only to satisfy net.Conn
+	remote   net.Addr
+	fail     chan struct{}
+	written  chan []byte
+}
+
+func (c *brokenServerConn) Read(p []byte) (int, error) {
+	<-c.fail
+	return 0, syscall.ECONNREFUSED
+}
+
+func (c *brokenServerConn) Write(p []byte) (int, error) {
+	c.written <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func (c *brokenServerConn) Close() error         { return nil }
+func (c *brokenServerConn) RemoteAddr() net.Addr { return c.remote }
+
+// mtuServerConn stands in for a server connection whose path MTU is mtu:
+// larger writes fail with EMSGSIZE, the others are kept in written.
+type mtuServerConn struct {
+	net.Conn // nil, only to satisfy net.Conn
+	mtu      int
+	written  chan []byte
+	closed   chan struct{}
+	once     sync.Once
+}
+
+func (c *mtuServerConn) Read(p []byte) (int, error) {
+	<-c.closed
+	return 0, net.ErrClosed
+}
+
+func (c *mtuServerConn) Write(p []byte) (int, error) {
+	if len(p) > c.mtu {
+		return 0, &net.OpError{Op: "write", Net: "udp", Err: os.NewSyscallError("write", syscall.EMSGSIZE)}
+	}
+	c.written <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func (c *mtuServerConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *mtuServerConn) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8388}
+}
+
+func TestUDPClientPathMTU(t *testing.T) {
+	h := &countingHandler{prefix: "[Shadowsocks] UDP packet dropped: exceeds path MTU"}
+	old := slog.Default()
+	slog.SetDefault(slog.New(h))
+	t.Cleanup(func() { slog.SetDefault(old) })
+	
+	method := testMethods[0]
+	app, clientSide := newMemPacketPair("app", "client-side")
+	server := &mtuServerConn{mtu: 1200, written: make(chan []byte, 8), closed: make(chan struct{})}
+	c, err := NewUDPClientWithConns(method, testKey(t, method), clientSide, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+	
+	// The oversized datagram is dropped with a warning, and the association
+	// keeps relaying smaller ones.
+	target := testTarget(t).Bytes()
+	app.WriteTo(append(slices.Clone(target), make([]byte, 1500)...), clientSide.LocalAddr())
+	app.WriteTo(append(target, "ping"...), clientSide.LocalAddr())
+	select {
+	case packet := <-server.written:
+		if _, body := openClientPacket(t, c, packet); !bytes.HasSuffix(body, []byte("ping")) {
+			t.Fatalf("server got %x, want the small datagram", body)
+		}
+	case err := <-done:
+		t.Fatalf("Run stopped on an oversized datagram: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("small datagram not relayed")
+	}
+	if n := h.count(); n != 1 {
+		t.Fatalf("%d MTU warnings logged, want 1", n)
+	}
+	
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not stop")
+	}
+}
+
+func TestUDPClientRedial(t *testing.T) {
+	method := testMethods[0]
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	
+	for _, redials := range []int{0, 1} {
+		app, clientSide := newMemPacketPair("app", "client-side")
+		broken := &brokenServerConn{remote: server.LocalAddr(), fail: make(chan struct{}), written: make(chan []byte, 8)}
+		c, err := NewUDPClientWithConns(method, testKey(t, method), clientSide, broken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.MaxRedials = redials
+		done := make(chan error, 1)
+		go func() { done <- c.Run(context.Background()) }()
+		
+		data := append(testTarget(t).Bytes(), "ping"...)
+		app.WriteTo(data, clientSide.LocalAddr())
+		before, _ := openClientPacket(t, c, <-broken.written)
+		close(broken.fail)
+		
+		if redials == 0 {
+			select {
+			case err := <-done:
+				if !errors.Is(err, syscall.ECONNREFUSED) {
+					t.Fatalf("Run without redials = %v, want the read error", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Run without redials did not stop on the read error")
+			}
+			continue
+		}
+		
+		deadline := time.Now().Add(5 * time.Second)
+		for c.serverConn() == broken {
+			if time.Now().After(deadline) {
+				t.Fatal("server not re-dialed")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		
+		// The re-dialed connection reaches the server with a new session.
+		app.WriteTo(data, clientSide.LocalAddr())
+		server.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 2048)
+		n, from, err := server.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("no packet after the re-dial: %v", err)
+		}
+		after, _ := openClientPacket(t, c, buf[:n])
+		if bytes.Equal(after[:SessionIDSize], before[:SessionIDSize]) {
+			t.Error("session ID kept across the re-dial, want a new session")
+		}
+		
+		server.WriteToUDP(newTestServerSession(t, c).seal(c, after[:SessionIDSize], testTarget(t), []byte("pong")), from)
+		if reply := recvPacket(t, app); !bytes.HasSuffix(reply.data, []byte("pong")) {
+			t.Fatalf("client got % x, want the reply", reply.data)
+		}
+		
+		c.Close()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Run did not return after Close")
+		}
+	}
+}
+
+func TestUDPClientSessions(t *testing.T) {
+	method := testMethods[0]
+	c := newTestUDPClient(t, method)
+	if sessions := c.Sessions(); len(sessions) != 0 {
+		t.Fatalf("Sessions() of a new client = %+v, want none", sessions)
+	}
+	
+	before := time.Now()
+	data := append(testTarget(t).Bytes(), "ping"...)
+	clients := map[string]int{}
+	var replyTo []byte
+	for i := range 3 {
+		addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000 + i}
+		for range i + 1 {
+			packet, err := c.EncryptPacket(addr, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i == 0 {
+				header, _ := openClientPacket(t, c, packet)
+				replyTo = header[:SessionIDSize]
+			}
+		}
+		clients[addr.String()] = (i + 1) * len(data)
+	}
+	reply := newTestServerSession(t, c).seal(c, replyTo, testTarget(t), []byte("pong"))
+	if _, _, _, err := c.DecryptPacket(reply); err != nil {
+		t.Fatal(err)
+	}
+	after := time.Now()
+	
+	sessions := c.Sessions()
+	if len(sessions) != len(clients) {
+		t.Fatalf("%d sessions, want %d", len(sessions), len(clients))
+	}
+	ids := map[string]bool{}
+	for _, s := range sessions {
+		sent, ok := clients[s.ClientAddr]
+		if !ok {
+			t.Errorf("session for unknown client %s", s.ClientAddr)
+			continue
+		}
+		if s.BytesSent != uint64(sent) {
+			t.Errorf("%s: BytesSent = %d, want %d", s.ClientAddr, s.BytesSent, sent)
+		}
+		if s.LastActive.Before(before) || s.LastActive.After(after) {
+			t.Errorf("%s: LastActive %v outside of [%v, %v]", s.ClientAddr, s.LastActive, before, after)
+		}
+		if len(s.SessionID) != 2*SessionIDSize || ids[s.SessionID] {
+			t.Errorf("%s: session ID %q not a fresh hex ID", s.ClientAddr, s.SessionID)
+		}
+		ids[s.SessionID] = true
+		wantReceived := uint64(0)
+		if s.SessionID == hex.EncodeToString(replyTo) {
+			wantReceived = 4
+		}
+		if s.BytesReceived != wantReceived {
+			t.Errorf("%s: BytesReceived = %d, want %d", s.ClientAddr, s.BytesReceived, wantReceived)
+		}
+	}
+}
+
+func TestSessionInfoJSON(t *testing.T) {
+	c := newTestUDPClient(t, testMethods[0])
+	packet, err := c.EncryptPacket(benchClient, append(testTarget(t).Bytes(), "ping"...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, _ := openClientPacket(t, c, packet)
+	reply := newTestServerSession(t, c).seal(c, header[:SessionIDSize], testTarget(t), []byte("pong"))
+	if _, _, _, err := c.DecryptPacket(reply); err != nil {
+		t.Fatal(err)
+	}
+	
+	data, err := json.Marshal(c.Sessions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sessions []map[string]any
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		t.Fatalf("%s: %v", data, err)
+	}
+	if len(sessions) != 1 {
+		t.Fatalf("%d sessions in %s, want 1", len(sessions), data)
+	}
+	s := sessions[0]
+	
+	keys := slices.Sorted(maps.Keys(s))
+	want := []string{"bytes_received", "bytes_sent", "client_addr", "dropped", "last_active", "session_id"}
+	if !slices.Equal(keys, want) {
+		t.Fatalf("keys %v, want %v", keys, want)
+	}
+	if s["client_addr"] != benchClient.String() {
+		t.Errorf("client_addr = %v, want %s", s["client_addr"], benchClient)
+	}
+	if s["session_id"] != hex.EncodeToString(header[:SessionIDSize]) {
+		t.Errorf("session_id = %v, want the hex session ID %x", s["session_id"], header[:SessionIDSize])
+	}
+	// Byte counts are plain numbers, the time is RFC 3339.
+	if s["bytes_sent"] != float64(len(testTarget(t).Bytes())+4) || s["bytes_received"] != float64(4) || s["dropped"] != float64(0) {
+		t.Errorf("counters = %v, %v, %v", s["bytes_sent"], s["bytes_received"], s["dropped"])
+	}
+	if active, ok := s["last_active"].(string); !ok {
+		t.Errorf("last_active = %v, want a string", s["last_active"])
+	} else if _, err := time.Parse(time.RFC3339Nano, active); err != nil {
+		t.Errorf("last_active: %v", err)
+	}
+}
+
+// Run with -race: Sessions may be called while new sessions are created.
+func TestUDPClientSessionsConcurrent(t *testing.T) {
+	c := newTestUDPClient(t, testMethods[0])
+	data := append(testTarget(t).Bytes(), "ping"...)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range 200 {
+			c.EncryptPacket(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000 + i}, data)
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			if n := len(c.Sessions()); n != 200 {
+				t.Fatalf("%d sessions, want 200", n)
+			}
+			return
+		default:
+			for _, s := range c.Sessions() {
+				if s.ClientAddr == "" || s.SessionID == "" {
+					t.Fatalf("incomplete session in snapshot: %+v", s)
+				}
+			}
+		}
+	}
+}
+
+var benchClient = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+
+// Packets are sealed and opened in place, so the per-packet allocations no
+// longer grow with the payload. For a 1200-byte payload with
+// 2022-blake3-aes-128-gcm, EncryptPacket went from 11 allocs and 3941 B/op
+// to 6 allocs and 1478 B/op, the packet itself being most of it, and
+// DecryptPacket from 1392 to 128 B/op. openPacket alone costs 2 allocs and
+// 30 B/op, the session lookup, and none with chacha20.
+func BenchmarkEncryptPacket(b *testing.B) {
+	for _, method := range testMethods {
+		b.Run(method, func(b *testing.B) {
+			c := newTestUDPClient(b, method)
+			c.NoPadding = true
+			data := append(testTarget(b).Bytes(), make([]byte, 1200)...)
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			for b.Loop() {
+				if _, err := c.EncryptPacket(benchClient, data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkOpenPacket(b *testing.B) {
+	for _, method := range testMethods {
+		b.Run(method, func(b *testing.B) {
+			c := newTestUDPClient(b, method)
+			session, err := c.getOrCreateClientSession(benchClient)
+			if err != nil {
+				b.Fatal(err)
+			}
+			packet := newTestServerSession(b, c).seal(c, session.ID, testTarget(b), make([]byte, 1200))
+			buf := make([]byte, len(packet))
+			b.ReportAllocs()
+			b.SetBytes(int64(len(packet)))
+			for b.Loop() {
+				copy(buf, packet)
+				if _, err := c.openPacket(buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package socks5
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+var (
+	ErrAuthVersion     = errors.New("socks5: unsupported username/password auth version")
+	ErrAuthFailed      = errors.New("socks5: authentication failed")
+	ErrNoAuthenticator = errors.New("socks5: username/password auth without authenticator")
+)
+
+// Authenticator checks the credentials of the username/password method
+// (RFC 1929) and returns the identity the connection is attributed to.
+type Authenticator interface {
+	Authenticate(user, pass string) (identity string, err error)
+}
+
+// StaticAuthenticator accepts the users of a fixed username → password map.
+// The identity of a user is its username.
+type StaticAuthenticator map[string]string
+
+func (a StaticAuthenticator) Authenticate(user, pass string) (string, error) {
+	want, ok := a[user]
+	if !ok || subtle.ConstantTimeCompare([]byte(want), []byte(pass)) != 1 {
+		return "", ErrAuthFailed
+	}
+	return user, nil
+}
+
+func authUserPass(conn net.Conn, authenticator Authenticator) (string, error) {
+	if authenticator == nil {
+		return "", ErrNoAuthenticator
+	}
+	
+	buf := make([]byte, 255)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return "", fmt.Errorf("failed to read auth request: %w", err)
+	}
+	if buf[0] != 0x01 {
+		return "", fmt.Errorf("%w: got %d", ErrAuthVersion, buf[0])
+	}
+	
+	uLen := int(buf[1])
+	if _, err := io.ReadFull(conn, buf[:uLen]); err != nil {
+		return "", fmt.Errorf("failed to read username: %w", err)
+	}
+	user := string(buf[:uLen])
+	
+	if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+		return "", fmt.Errorf("failed to read password length: %w", err)
+	}
+	pLen := int(buf[0])
+	if _, err := io.ReadFull(conn, buf[:pLen]); err != nil {
+		return "", fmt.Errorf("failed to read password: %w", err)
+	}
+	pass := string(buf[:pLen])
+	
+	identity, err := authenticator.Authenticate(user, pass)
+	if err != nil {
+		conn.Write([]byte{0x01, 0x01})
+		return "", fmt.Errorf("%w: user %q: %w", ErrAuthFailed, user, err)
+	}
+	
+	if _, err = conn.Write([]byte{0x01, 0x00}); err != nil {
+		return "", fmt.Errorf("failed to write auth response: %w", err)
+	}
+	return identity, nil
+}
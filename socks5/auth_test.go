@@ -0,0 +1,69 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// handshakeWithPassword runs a password handshake for user and pass over a
+// pipe and returns the result of the server side.
+func handshakeWithPassword(t *testing.T, h *Handshaker, user, pass string) (*HandshakeResult, error) {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	
+	go func() {
+		reply := make([]byte, 2)
+		client.Write([]byte{0x05, 0x01, MethodUserPass})
+		if _, err := io.ReadFull(client, reply); err != nil || reply[1] != MethodUserPass {
+			client.Close()
+			return
+		}
+		auth := append([]byte{0x01, byte(len(user))}, user...)
+		auth = append(append(auth, byte(len(pass))), pass...)
+		client.Write(auth)
+		if _, err := io.ReadFull(client, reply); err != nil || reply[1] != 0x00 {
+			client.Close()
+			return
+		}
+		client.Write([]byte{0x05, 0x01, 0x00, 0x01, 127, 0, 0, 1, 0x00, 0x50})
+	}()
+	return h.Handshake(server)
+}
+
+func TestStaticAuthenticator(t *testing.T) {
+	h := &Handshaker{
+		Methods:       []byte{MethodUserPass},
+		Authenticator: StaticAuthenticator{"alice": "secret"},
+	}
+	
+	res, err := handshakeWithPassword(t, h, "alice", "secret")
+	if err != nil {
+		t.Fatalf("Handshake with valid credentials: %v", err)
+	}
+	if res.Identity != "alice" {
+		t.Errorf("Identity = %q, want alice", res.Identity)
+	}
+	
+	if _, err = handshakeWithPassword(t, h, "alice", "wrong"); !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("Handshake with a wrong password: err = %v, want ErrAuthFailed", err)
+	}
+	if _, err = handshakeWithPassword(t, h, "bob", "secret"); !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("Handshake with an unknown user: err = %v, want ErrAuthFailed", err)
+	}
+}
+
+func TestRunRejectsPasswordWithoutAuthenticator(t *testing.T) {
+	c := &Client{ListenAddr: "127.0.0.1:0", AuthMethods: []string{"none", "password"}}
+	err := c.Run(context.Background())
+	if !errors.Is(err, ErrNoAuthenticator) {
+		t.Fatalf("Run error = %v, want ErrNoAuthenticator", err)
+	}
+	if c.Addr() != nil {
+		t.Errorf("Run bound %v before rejecting the configuration", c.Addr())
+	}
+}
@@ -9,25 +9,201 @@ import (
 	"kage/shadowsocks"
 	"log/slog"
 	"net"
+	"os"
 	"syscall"
 	"time"
 )
 
+var ErrPayloadNotDelivered = errors.New("socks5: initial payload not delivered")
+
+// ErrNoUDPAddr means UDP is enabled on a listener without an IP address,
+// such as an in-memory one, and without a ListenAddr to bind instead.
+var ErrNoUDPAddr = errors.New("socks5: no address to bind UDP associations, set ListenAddr")
+
 type Client struct {
 	ListenAddr string
 	ServerAddr string
 	Method     string
 	Key        []byte
 	FastOpen   bool
+	NoPadding  bool
+	// DelayInitialPayload keeps the data read by FastOpen out of the request
+	// header and sends it as the first chunk after the handshake instead, so
+	// the header does not reveal the size of e.g. a TLS ClientHello.
+	DelayInitialPayload bool
+	// PadWithPayload pads the request header even when it carries the
+	// initial payload, see shadowsocks.Conn.PadWithPayload.
+	PadWithPayload bool
+	// CoalesceInitialPayload gathers an initial payload split over several
+	// quick writes instead of only the first segment.
+	CoalesceInitialPayload bool
+	// CompleteTLSRecord reads a whole TLS record, such as a ClientHello
+	// split over several segments, as the initial payload.
+	CompleteTLSRecord bool
+	// AbortOnPayloadError fails the connection on any error while reading
+	// the initial payload, see Handshaker.AbortOnPayloadError.
+	AbortOnPayloadError bool
+	// AuthMethods lists the accepted authentication methods by name, most
+	// preferred first. Defaults to "none".
+	AuthMethods []string
+	// Authenticator validates username/password credentials. Setting it
+	// without AuthMethods requires the "password" method.
+	Authenticator Authenticator
+	// MaxDomainLength caps the length of requested domain names.
+	MaxDomainLength int
 	
 	UDP bool
+	// UDPIdleTimeout reaps a UDP association that relayed nothing for this
+	// long, even if the client keeps the control connection open.
+	UDPIdleTimeout time.Duration
+	// UDPFragments reassembles fragmented UDP requests instead of dropping
+	// them.
+	UDPFragments bool
+	// UDPRedials is how many times in a row a UDP association re-dials the
+	// server after a read error before it is torn down.
+	UDPRedials int
+	// UDPPacketRate caps the packets per second of each UDP session in each
+	// direction. Zero means no limit.
+	UDPPacketRate int
+	// UDPSyncClock stamps UDP packets with the server's clock, see
+	// shadowsocks.UDPClient.SyncClock.
+	UDPSyncClock bool
+	// BlockQUIC drops UDP requests to port 443 so that clients fall back
+	// from QUIC to TCP.
+	BlockQUIC bool
+	// Strict enforces RFC 1928 in the handshake, see Handshaker.Strict.
+	Strict bool
+	// LogNegotiation logs each handshake at debug level, see
+	// Handshaker.LogNegotiation.
+	LogNegotiation bool
+	
+	ConnectTimeout   time.Duration
+	HandshakeTimeout time.Duration
+	ChunkSize        int
+	DSCP             int
+	CoalesceDelay    time.Duration
+	// HandshakeDump logs the first server handshakes in hex, see
+	// shadowsocks.HandshakeDump.
+	HandshakeDump *shadowsocks.HandshakeDump
+	// TapLimit logs up to this many bytes of plaintext per direction of
+	// each connection, see shadowsocks.Dialer.TapLimit.
+	TapLimit int
+	
+	// SetupTimeout bounds the whole setup of a connection: the SOCKS5
+	// handshake, the dial and the server response header together. Zero
+	// means no limit beyond the individual timeouts.
+	SetupTimeout time.Duration
+	// EarlyRetries re-dials the server up to this many times when it drops
+	// a connection before any data was exchanged, see
+	// shadowsocks.RetryConn.
+	EarlyRetries int
+	
+	// Relayer relays the connections with the settings this inbound shares
+	// with the others of the instance, such as the quota. Nil relays with
+	// the defaults.
+	Relayer *core.Relayer
+	// BackoffJitter randomizes the delays between UDP re-dials.
+	BackoffJitter core.Jitter
+	
+	ln             net.Listener
+	udpSetupErrors core.LogLimiter
 }
 
-func (c *Client) Run(ctx context.Context) error {
+const defaultUDPIdleTimeout = 5 * time.Minute
+
+// Bind opens the TCP listener ahead of Run, so that Addr is known before
+// serving starts. Run binds by itself when Bind was not called.
+func (c *Client) Bind() error {
 	ln, err := net.Listen("tcp", c.ListenAddr)
 	if err != nil {
 		return fmt.Errorf("listen on %s failed: %w", c.ListenAddr, err)
 	}
+	c.ln = ln
+	return nil
+}
+
+// SetListener makes Run serve ln, e.g. one wrapped with TLS or rate
+// limiting, instead of binding ListenAddr. UDP associations bind the address
+// of ln, or ListenAddr when ln has no TCP address.
+func (c *Client) SetListener(ln net.Listener) error {
+	if err := core.CheckStreamListener(ln); err != nil {
+		return err
+	}
+	c.ln = ln
+	return nil
+}
+
+// Addr returns the address the TCP listener is bound to, which differs from
+// ListenAddr when its port is 0. It is nil before binding.
+func (c *Client) Addr() net.Addr {
+	if c.ln == nil {
+		return nil
+	}
+	return c.ln.Addr()
+}
+
+// udpListenAddr returns the address UDP associations bind: the one the TCP
+// listener is bound to once it is, so that a ListenAddr with port 0 or a
+// listener from SetListener gets the same port for both.
+func (c *Client) udpListenAddr() string {
+	if c.ln != nil {
+		if addr, ok := c.ln.Addr().(*net.TCPAddr); ok {
+			return addr.String()
+		}
+	}
+	return c.ListenAddr
+}
+
+func (c *Client) Run(ctx context.Context) error {
+	handshaker := &Handshaker{
+		FastOpen:               c.FastOpen,
+		CoalesceInitialPayload: c.CoalesceInitialPayload,
+		CompleteTLSRecord:      c.CompleteTLSRecord,
+		AbortOnPayloadError:    c.AbortOnPayloadError,
+		MaxDomainLength:        c.MaxDomainLength,
+		Authenticator:          c.Authenticator,
+		UDP:                    c.UDP,
+		Strict:                 c.Strict,
+		LogNegotiation:         c.LogNegotiation,
+		TargetLog:              c.Relayer.TargetLogMode(),
+	}
+	authMethods := c.AuthMethods
+	if len(authMethods) == 0 && c.Authenticator != nil {
+		authMethods = []string{"password"}
+	}
+	for _, name := range authMethods {
+		m, err := ParseMethod(name)
+		if err != nil {
+			return err
+		}
+		if m == MethodUserPass && c.Authenticator == nil {
+			return fmt.Errorf("%w: %q is an accepted method", ErrNoAuthenticator, name)
+		}
+		handshaker.Methods = append(handshaker.Methods, m)
+	}
+	
+	if c.ln == nil {
+		if err := c.Bind(); err != nil {
+			return err
+		}
+	}
+	ln := c.ln
+	
+	// UDP associations bind the same port as the TCP listener when they are
+	// created. Probe it now, so that a port held by another process for UDP
+	// only fails at startup rather than on the first association.
+	if c.UDP {
+		if c.udpListenAddr() == "" {
+			ln.Close()
+			return ErrNoUDPAddr
+		}
+		pc, err := net.ListenPacket("udp", c.udpListenAddr())
+		if err != nil {
+			ln.Close()
+			return fmt.Errorf("listen on %s succeeded for TCP but failed for UDP: %w", c.udpListenAddr(), err)
+		}
+		pc.Close()
+	}
 	
 	go func() {
 		<-ctx.Done()
@@ -45,74 +221,203 @@ func (c *Client) Run(ctx context.Context) error {
 			return err
 		}
 		
-		go c.handleConn(ctx, clientConn)
+		go c.handleConn(ctx, handshaker, clientConn)
 	}
 }
 
-func (c *Client) handleConn(ctx context.Context, clientConn net.Conn) {
+func (c *Client) handleConn(ctx context.Context, handshaker *Handshaker, clientConn net.Conn) {
 	defer clientConn.Close()
+	accepted := time.Now()
+	
+	setupCtx := ctx
+	if c.SetupTimeout > 0 {
+		var cancel context.CancelFunc
+		setupCtx, cancel = context.WithTimeout(ctx, c.SetupTimeout)
+		defer cancel()
+	}
 	
-	handshakeRes, err := Handshake(clientConn, c.FastOpen)
+	// Cancellation aborts a handshake that is blocked on the client. Only
+	// reading is stopped, so that a refusal can still be written.
+	stop := context.AfterFunc(setupCtx, func() {
+		unblockRead(clientConn)
+	})
+	handshakeRes, err := handshaker.Handshake(clientConn)
+	aborted := !stop()
+	
+	// A handshake that completed or was aborted while shutting down gets a
+	// refusal rather than a success reply or a dropped connection.
+	if ctx.Err() != nil && (err == nil || aborted) {
+		writeReply(clientConn, 0x05)
+		slog.Debug("[SOCKS5] connection refused, shutting down", "client", clientConn.RemoteAddr())
+		return
+	}
+	if aborted {
+		slog.Debug("[SOCKS5] handshake aborted", "client", clientConn.RemoteAddr(), "err", setupCtx.Err())
+		return
+	}
 	if err != nil {
-		slog.Debug("[SOCKS5] handshake failed", "client", clientConn.RemoteAddr(), "err", err)
+		if clientGone(err) {
+			slog.Debug("[SOCKS5] client disconnected during handshake", "client", clientConn.RemoteAddr(), "err", err)
+		} else {
+			slog.Debug("[SOCKS5] handshake failed", "client", clientConn.RemoteAddr(), "err", err)
+		}
+		return
+	}
+	
+	if c.Relayer.QuotaExceeded() {
+		writeReply(clientConn, 0x02)
+		slog.Debug("[SOCKS5] connection refused", "client", clientConn.RemoteAddr(), "err", core.ErrQuotaExceeded)
 		return
 	}
 	
 	if handshakeRes.Command == 0x03 {
-		if !c.UDP {
-			slog.Debug("[SOCKS5] UDP Associate rejected: UDP disabled", "client", clientConn.RemoteAddr())
-			return
-		}
-		if err = c.handleUDP(ctx, clientConn); err != nil {
+		if err = c.handleUDP(ctx, clientConn, handshakeRes.TargetAddress); err != nil {
 			slog.Debug("[SOCKS5] UDP proxy connection failed", "client", clientConn.RemoteAddr(), "err", err)
 		}
 		return
 	}
 	
-	if err = c.handleTCP(ctx, clientConn, handshakeRes.TargetAddress, handshakeRes.InitialPayload); err != nil {
-		slog.Debug("[SOCKS5] TCP proxy connection failed", "client", clientConn.RemoteAddr(), "err", err)
+	if err = c.handleTCP(ctx, setupCtx, accepted, clientConn, handshakeRes.TargetAddress, handshakeRes.InitialPayload); err != nil {
+		slog.Debug("[SOCKS5] TCP proxy connection failed", "client", clientConn.RemoteAddr(), "user", handshakeRes.Identity, "err", err)
 	}
 }
 
-func (c *Client) handleTCP(ctx context.Context, clientConn net.Conn, targetAddr *core.Address, initialPayload []byte) error {
+// unblockRead makes a Read blocked on conn return without closing conn.
+// Connections without CloseRead get a read deadline in the past instead.
+func unblockRead(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseRead() error }); ok {
+		c.CloseRead()
+		return
+	}
+	conn.SetReadDeadline(time.Unix(1, 0))
+}
+
+// handleTCP relays a CONNECT request. The dial and the server handshake must
+// complete before setupCtx is done; the relay itself only ends with ctx.
+// The time to first byte is measured from accepted.
+func (c *Client) handleTCP(ctx, setupCtx context.Context, accepted time.Time, clientConn net.Conn, targetAddr *core.Address, initialPayload []byte) (err error) {
+	ctx, span := c.Relayer.StartConnSpan(ctx, "socks5", targetAddr.String())
+	defer func() { span.End(err) }()
+	
+	if core.IsSelfTarget(targetAddr, c.ServerAddr) {
+		writeReply(clientConn, 0x02)
+		return fmt.Errorf("%w: %v", core.ErrSelfTarget, targetAddr)
+	}
+	
 	if err := SendResponse(clientConn, ""); err != nil {
 		return fmt.Errorf("send response failed: %w", err)
 	}
 	
-	serverConn, err := net.DialTimeout("tcp", c.ServerAddr, time.Second*3)
-	if err != nil {
-		return fmt.Errorf("dial server for %v failed: %w", targetAddr, err)
+	var delayedPayload []byte
+	if c.DelayInitialPayload {
+		delayedPayload, initialPayload = initialPayload, nil
 	}
-	defer serverConn.Close()
 	
-	shadowConn, err := shadowsocks.NewConn(serverConn, c.Method, c.Key, targetAddr, initialPayload)
+	dialer := &shadowsocks.Dialer{
+		ServerAddr:       c.ServerAddr,
+		Method:           c.Method,
+		Key:              c.Key,
+		NoPadding:        c.NoPadding,
+		PadWithPayload:   c.PadWithPayload,
+		ChunkSize:        c.ChunkSize,
+		DSCP:             c.DSCP,
+		CoalesceDelay:    c.CoalesceDelay,
+		ConnectTimeout:   c.ConnectTimeout,
+		HandshakeTimeout: c.HandshakeTimeout,
+		TargetLog:        c.Relayer.TargetLogMode(),
+		HandshakeDump:    c.HandshakeDump,
+		TapLimit:         c.TapLimit,
+	}
+	// The response header is read by the first Read of the relay, so the
+	// rest of the setup budget caps its wait.
+	dialer.HandshakeDeadline, _ = setupCtx.Deadline()
+	// With fast open the client already got its reply and its first bytes
+	// were read, so a failure below silently drops data it believes sent.
+	pending := len(initialPayload) + len(delayedPayload)
+	
+	shadowConn, err := dialer.DialRetry(setupCtx, targetAddr, initialPayload, c.EarlyRetries)
 	if err != nil {
-		return fmt.Errorf("create shadow connection failed: %w", err)
+		return payloadLost(pending, fmt.Errorf("dial server for %v failed: %w", targetAddr, err))
 	}
 	defer shadowConn.Close()
 	
 	if _, err = shadowConn.Write(nil); err != nil {
-		return fmt.Errorf("send handshake to server header failed: %w", err)
+		return payloadLost(pending, fmt.Errorf("send handshake to server header failed: %w", err))
+	}
+	if len(delayedPayload) > 0 {
+		if _, err = shadowConn.Write(delayedPayload); err != nil {
+			return payloadLost(len(delayedPayload), fmt.Errorf("send initial payload failed: %w", err))
+		}
 	}
 	
-	slog.Debug("[SOCKS5] TCP proxy connection established", "client", clientConn.RemoteAddr(), "server", serverConn.RemoteAddr(), "target", targetAddr)
-	err = core.TCPRelay(ctx, clientConn, shadowConn)
-	err = ignoreExpectedErrors(err)
+	sampled := c.Relayer.SampleConn()
+	if sampled {
+		slog.Debug("[SOCKS5] TCP proxy connection established", "client", clientConn.RemoteAddr(), "server", shadowConn.RemoteAddr(), c.Relayer.TargetAttr(targetAddr.String()))
+	}
+	result := c.Relayer.Relay(ctx, clientConn, shadowConn)
+	ttfb := shadowConn.TimeToFirstByte(accepted)
+	span.SetAttributes(slog.Duration("ttfb", ttfb))
+	err = ignoreExpectedErrors(result.Err)
 	if err != nil {
 		return fmt.Errorf("TCP relay failed: %w", err)
 	}
-	slog.Debug("[SOCKS5] TCP proxy connection disconnected", "client", clientConn.RemoteAddr(), "server", serverConn.RemoteAddr(), "target", targetAddr)
+	if sampled {
+		slog.Debug("[SOCKS5] TCP proxy connection disconnected", "client", clientConn.RemoteAddr(), "server", shadowConn.RemoteAddr(), c.Relayer.TargetAttr(targetAddr.String()), "ttfb", ttfb, "reason", result.Reason)
+	}
 	return nil
 }
 
-func (c *Client) handleUDP(ctx context.Context, clientConn net.Conn) error {
-	if err := SendResponse(clientConn, c.ListenAddr); err != nil {
+func (c *Client) handleUDP(ctx context.Context, clientConn net.Conn, clientAddr *core.Address) error {
+	// Bind the relay socket before replying: a client may send its first
+	// datagram as soon as it reads the reply, and the kernel queues it from
+	// then on until Run reads it instead of answering port unreachable.
+	udpClient, err := shadowsocks.NewUDPClient(c.Method, c.Key, c.udpListenAddr(), c.ServerAddr)
+	if err != nil {
+		writeReply(clientConn, 0x01)
+		// Every association fails the same way while the server is
+		// unreachable, so only the first of a burst is a warning.
+		if ok, suppressed := c.udpSetupErrors.Allow(time.Now()); ok {
+			slog.Warn("[SOCKS5] UDP association setup failed", "server", c.ServerAddr, "err", err, "suppressed", suppressed)
+		}
+		return fmt.Errorf("init UDP client failed: %w", err)
+	}
+	bindAddr := udpClient.ClientConn.LocalAddr().String()
+	if err = SendResponse(clientConn, bindAddr); err != nil {
+		udpClient.Close()
 		return fmt.Errorf("send response failed: %w", err)
 	}
+	udpClient.NoPadding = c.NoPadding
+	udpClient.WrapReply = PackDatagram
+	udpClient.UnwrapRequest = UnwrapDatagram
+	if c.UDPFragments {
+		udpClient.UnwrapRequest = (&Reassembler{}).Unwrap
+	}
+	if c.BlockQUIC {
+		udpClient.UnwrapRequest = BlockQUIC(udpClient.UnwrapRequest)
+	}
+	// The client may announce where it will send datagrams from; a domain
+	// name cannot be matched against packet sources and is not enforced.
+	if clientAddr.Type != core.AtypDomainName {
+		udpClient.AllowedClient = &net.UDPAddr{IP: net.IP(clientAddr.Host), Port: int(clientAddr.Port)}
+	}
+	udpClient.MaxRedials = c.UDPRedials
+	udpClient.BackoffJitter = c.BackoffJitter
+	if c.Relayer != nil {
+		udpClient.Quota = c.Relayer.Quota
+	}
+	udpClient.MaxPacketRate = c.UDPPacketRate
+	udpClient.SyncClock = c.UDPSyncClock
+	udpClient.DSCP = c.DSCP
+	udpClient.IdleTimeout = c.UDPIdleTimeout
+	if udpClient.IdleTimeout == 0 {
+		udpClient.IdleTimeout = defaultUDPIdleTimeout
+	}
 	
-	udpClient, err := shadowsocks.NewUDPClient(c.Method, c.Key, c.ListenAddr, c.ServerAddr)
-	if err != nil {
-		return fmt.Errorf("init UDP client failed: %w", err)
+	// The association lives as long as the control connection, so keep it
+	// from being silently dropped by middleboxes.
+	if tc, ok := clientConn.(*net.TCPConn); ok {
+		tc.SetKeepAlive(true)
+		tc.SetKeepAlivePeriod(30 * time.Second)
 	}
 	
 	udpCtx, cancel := context.WithCancel(ctx)
@@ -122,11 +427,11 @@ func (c *Client) handleUDP(ctx context.Context, clientConn net.Conn) error {
 		cancel()
 	}()
 	
-	slog.Debug("[SOCKS5] UDP relay connection established", "client", clientConn.RemoteAddr(), "server", c.ListenAddr)
+	slog.Debug("[SOCKS5] UDP relay connection established", "client", clientConn.RemoteAddr(), "server", bindAddr)
 	if err = udpClient.Run(udpCtx); err != nil {
 		return fmt.Errorf("UDP relay failed: %w", err)
 	}
-	slog.Debug("[SOCKS5] UDP relay connection closed", "client", clientConn.RemoteAddr(), "server", c.ListenAddr)
+	slog.Debug("[SOCKS5] UDP relay connection closed", "client", clientConn.RemoteAddr(), "server", bindAddr)
 	return nil
 }
 
@@ -139,3 +444,25 @@ func ignoreExpectedErrors(err error) error {
 	}
 	return err
 }
+
+// clientGone reports whether err means the client closed, reset or stopped
+// talking on the connection, as opposed to sending something invalid.
+func clientGone(err error) bool {
+	if errors.Is(err, ErrMethodsTruncated) {
+		return false
+	}
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, os.ErrDeadlineExceeded) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.ECONNRESET)
+}
+
+// payloadLost marks err as having dropped n bytes already read from the
+// client. It returns err unchanged when nothing was pending.
+func payloadLost(n int, err error) error {
+	if n == 0 {
+		return err
+	}
+	return fmt.Errorf("%w (%d bytes): %w", ErrPayloadNotDelivered, n, err)
+}
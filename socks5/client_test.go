@@ -0,0 +1,925 @@
+package socks5
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"kage/core"
+	"kage/shadowsocks"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startClient binds c on a free loopback port unless it was given a
+// listener, runs it until the test ends and returns its address.
+func startClient(t *testing.T, c *Client) string {
+	t.Helper()
+	if c.ln == nil {
+		if c.ListenAddr == "" {
+			c.ListenAddr = "127.0.0.1:0"
+		}
+		if err := c.Bind(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return c.Addr().String()
+}
+
+// connect sends a no-auth CONNECT to target through the SOCKS5 proxy at
+// proxy and returns the connection and the reply code.
+func connect(t *testing.T, proxy string, target *net.TCPAddr) (net.Conn, byte) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	
+	req := []byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x01}
+	req = append(req, target.IP.To4()...)
+	req = append(req, byte(target.Port>>8), byte(target.Port))
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 2+10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	return conn, reply[3]
+}
+
+func TestSelfTargetRefused(t *testing.T) {
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	var dials atomic.Int32
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			dials.Add(1)
+			conn.Close()
+		}
+	}()
+	
+	proxy := startClient(t, &Client{
+		ServerAddr: server.Addr().String(),
+		Method:     "2022-blake3-aes-128-gcm",
+		Key:        make([]byte, 16),
+	})
+	conn, rep := connect(t, proxy, server.Addr().(*net.TCPAddr))
+	if rep != 0x02 {
+		t.Fatalf("reply = %#x, want 0x02 (not allowed by ruleset)", rep)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("connection still open after the refusal: %v", err)
+	}
+	if n := dials.Load(); n != 0 {
+		t.Errorf("proxy dialed the server %d times", n)
+	}
+}
+
+// logRecorder is a slog.Handler that passes records with the given message
+// prefix on to a channel.
+type logRecorder struct {
+	prefix  string
+	records chan slog.Record
+}
+
+func (h *logRecorder) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *logRecorder) Handle(_ context.Context, r slog.Record) error {
+	if strings.HasPrefix(r.Message, h.prefix) {
+		h.records <- r
+	}
+	return nil
+}
+
+func (h *logRecorder) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *logRecorder) WithGroup(string) slog.Handler      { return h }
+
+// recordLogs makes the default logger send records with the given message
+// prefix to the returned channel until the test ends.
+func recordLogs(t *testing.T, prefix string) <-chan slog.Record {
+	rec := &logRecorder{prefix: prefix, records: make(chan slog.Record, 16)}
+	old := slog.Default()
+	slog.SetDefault(slog.New(rec))
+	t.Cleanup(func() { slog.SetDefault(old) })
+	return rec.records
+}
+
+func TestHandshakeFailureLogLevel(t *testing.T) {
+	tests := []struct {
+		name    string
+		send    []byte
+		message string
+	}{
+		// The client gives up after the method selection.
+		{"client closed", []byte{0x05, 0x01, 0x00}, "[SOCKS5] client disconnected during handshake"},
+		// SOCKS4 is a protocol error, but no less the client's business.
+		{"bad version", []byte{0x04, 0x01, 0x00, 0x50, 127, 0, 0, 1, 0x00}, "[SOCKS5] handshake failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records := recordLogs(t, "[SOCKS5] ")
+			proxy := startClient(t, &Client{})
+			conn, err := net.Dial("tcp", proxy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Write(tt.send)
+			conn.(*net.TCPConn).CloseWrite()
+			
+			select {
+			case r := <-records:
+				if r.Message != tt.message {
+					t.Errorf("logged %q, want %q", r.Message, tt.message)
+				}
+				if r.Level != slog.LevelDebug {
+					t.Errorf("logged at %v, want %v", r.Level, slog.LevelDebug)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("handshake failure not logged")
+			}
+			conn.Close()
+		})
+	}
+}
+
+// udpAssociate sends a no-auth UDP ASSOCIATE to the SOCKS5 proxy at proxy
+// and returns the control connection and BND.ADDR.
+func udpAssociate(t *testing.T, proxy string) (net.Conn, *net.UDPAddr) {
+	t.Helper()
+	return udpAssociateFrom(t, proxy, &net.UDPAddr{IP: net.IPv4zero})
+}
+
+// udpAssociateFrom is udpAssociate announcing from as the address the client
+// will send its datagrams from.
+func udpAssociateFrom(t *testing.T, proxy string, from *net.UDPAddr) (net.Conn, *net.UDPAddr) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	req := []byte{0x05, 0x01, 0x00, 0x05, 0x03, 0x00, 0x01}
+	req = append(req, from.IP.To4()...)
+	conn.Write(append(req, byte(from.Port>>8), byte(from.Port)))
+	reply := make([]byte, 2+10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[3] != 0x00 {
+		t.Fatalf("UDP ASSOCIATE reply = %#x, want success", reply[3])
+	}
+	return conn, &net.UDPAddr{IP: net.IP(reply[6:10]), Port: int(reply[10])<<8 | int(reply[11])}
+}
+
+func TestUDPAssociatePortZero(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	
+	proxy := startClient(t, &Client{
+		ListenAddr: "127.0.0.1:0",
+		ServerAddr: server.LocalAddr().String(),
+		Method:     "2022-blake3-aes-128-gcm",
+		Key:        make([]byte, 16),
+		UDP:        true,
+	})
+	conn, bnd := udpAssociate(t, proxy)
+	if tcpPort := conn.RemoteAddr().(*net.TCPAddr).Port; bnd.Port != tcpPort {
+		t.Fatalf("BND.ADDR = %v, want the port %d of the TCP listener", bnd, tcpPort)
+	}
+	
+	// A datagram sent to BND.ADDR reaches the server.
+	udp, err := net.DialUDP("udp", nil, bnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	udp.Write([]byte{0, 0, 0, 0x01, 127, 0, 0, 1, 0x00, 0x35, 'h', 'i'})
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := server.ReadFrom(make([]byte, 2048)); err != nil {
+		t.Fatalf("no packet relayed to the server: %v", err)
+	}
+}
+
+func TestUDPDatagramBeforeReply(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	
+	proxy := startClient(t, &Client{
+		ServerAddr: server.LocalAddr().String(),
+		Method:     "2022-blake3-aes-128-gcm",
+		Key:        make([]byte, 16),
+		UDP:        true,
+	})
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	
+	// The relay binds the port of the listener, so the client can send
+	// datagrams before it has read the reply. Its socket is unconnected, so
+	// that a port unreachable error for a racing datagram does not fail the
+	// next write.
+	relay := net.UDPAddrFromAddrPort(conn.RemoteAddr().(*net.TCPAddr).AddrPort())
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	datagram := []byte{0, 0, 0, 0x01, 127, 0, 0, 1, 0x00, 0x35, 'h', 'i'}
+	conn.Write([]byte{0x05, 0x01, 0x00, 0x05, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	udp.WriteTo(datagram, relay)
+	reply := make([]byte, 2+10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[3] != 0x00 {
+		t.Fatalf("UDP ASSOCIATE reply = %#x, want success", reply[3])
+	}
+	
+	// One sent right after the reply, before the relay reads its socket,
+	// is queued by the kernel rather than refused.
+	udp.WriteTo(datagram, relay)
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := server.ReadFrom(make([]byte, 2048)); err != nil {
+		t.Fatalf("no early datagram relayed to the server: %v", err)
+	}
+	
+	// The association keeps working afterwards. Drain a relayed racing
+	// datagram first, so that the next read gets a new one.
+	server.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	server.ReadFrom(make([]byte, 2048))
+	udp.WriteTo(datagram, relay)
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := server.ReadFrom(make([]byte, 2048)); err != nil {
+		t.Fatalf("association stopped relaying: %v", err)
+	}
+}
+
+func TestUDPAssociateDisabled(t *testing.T) {
+	proxy := startClient(t, &Client{
+		ServerAddr: "203.0.113.1:8388",
+		Method:     "2022-blake3-aes-128-gcm",
+		Key:        make([]byte, 16),
+	})
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte{0x05, 0x01, 0x00, 0x05, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	reply := make([]byte, 2+10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	if reply[3] != 0x07 {
+		t.Fatalf("UDP ASSOCIATE reply = %#x, want 0x07 (command not supported)", reply[3])
+	}
+	// The rest of the request is left unread, so the close may be a reset.
+	if n, err := conn.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("connection still open after the refusal: read %d bytes, %v", n, err)
+	}
+}
+
+func TestRunUDPPortTaken(t *testing.T) {
+	// Another process holds the UDP side of the port.
+	taken, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	addr := taken.LocalAddr().String()
+	
+	c := &Client{
+		ListenAddr: addr,
+		ServerAddr: "203.0.113.1:8388",
+		Method:     "2022-blake3-aes-128-gcm",
+		Key:        make([]byte, 16),
+		UDP:        true,
+	}
+	err = c.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "failed for UDP") {
+		t.Fatalf("Run with the UDP port taken = %v, want a UDP listen error", err)
+	}
+	
+	// The TCP listener was released again.
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("TCP port still held after the failed start: %v", err)
+	}
+	ln.Close()
+	
+	// Without UDP, the port is only needed for TCP.
+	c = &Client{ListenAddr: addr, ServerAddr: "203.0.113.1:8388", Method: "2022-blake3-aes-128-gcm", Key: make([]byte, 16)}
+	proxy := startClient(t, c)
+	if proxy != addr {
+		t.Fatalf("listening on %s, want %s", proxy, addr)
+	}
+}
+
+func TestUDPSetupErrorRateLimited(t *testing.T) {
+	records := recordLogs(t, "[SOCKS5] UDP association setup failed")
+	proxy := startClient(t, &Client{
+		// An invalid port fails every association before sending anything.
+		ServerAddr: "127.0.0.1:65536",
+		Method:     "2022-blake3-aes-128-gcm",
+		Key:        make([]byte, 16),
+		UDP:        true,
+	})
+	
+	for range 5 {
+		conn, err := net.Dial("tcp", proxy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte{0x05, 0x01, 0x00, 0x05, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		reply := make([]byte, 2+10)
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply[3] != 0x01 {
+			t.Fatalf("UDP ASSOCIATE reply = %#x, want 0x01 (general failure)", reply[3])
+		}
+		conn.Read(make([]byte, 1)) // wait for the proxy to be done with it
+		conn.Close()
+	}
+	
+	select {
+	case r := <-records:
+		if r.Level != slog.LevelWarn {
+			t.Errorf("logged at %v, want %v", r.Level, slog.LevelWarn)
+		}
+	default:
+		t.Fatal("setup failure not logged")
+	}
+	if n := len(records); n != 0 {
+		t.Fatalf("%d more setup failures logged within the interval", n)
+	}
+}
+
+func TestSetupTimeoutSpansPhases(t *testing.T) {
+	// The server accepts but never answers, so the response header wait
+	// only ends with the setup budget.
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	
+	const budget = 300 * time.Millisecond
+	proxy := startClient(t, &Client{
+		ServerAddr:   server.Addr().String(),
+		Method:       "2022-blake3-aes-128-gcm",
+		Key:          make([]byte, 16),
+		SetupTimeout: budget,
+	})
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	conn.SetDeadline(start.Add(5 * time.Second))
+	
+	// A slow but valid SOCKS5 handshake uses up most of the budget.
+	conn.Write([]byte{0x05, 0x01, 0x00})
+	if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(budget * 2 / 3)
+	conn.Write([]byte{0x05, 0x01, 0x00, 0x01, 203, 0, 113, 1, 0x00, 0x50})
+	if _, err := io.ReadFull(conn, make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	
+	if n, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("read %d bytes, want the connection aborted", n)
+	} else if errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("connection not aborted at the end of the setup budget")
+	}
+	if elapsed := time.Since(start); elapsed < budget {
+		t.Fatalf("connection aborted after %v, before the %v budget", elapsed, budget)
+	}
+}
+
+// pipeListener is an in-memory net.Listener handing out the server ends of
+// net.Pipe connections made with dial.
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *pipeListener) dial() net.Conn {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+	case <-l.closed:
+		server.Close()
+	}
+	return client
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr { return pipeAddr{} }
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+func TestSetListenerInMemory(t *testing.T) {
+	ln := newPipeListener()
+	c := &Client{ServerAddr: "203.0.113.1:8388", Method: "2022-blake3-aes-128-gcm", Key: make([]byte, 16)}
+	if err := c.SetListener(ln); err != nil {
+		t.Fatal(err)
+	}
+	startClient(t, c)
+	
+	// A target equal to the server is refused without dialing anything, so
+	// the reply shows the connection went through the whole handshake.
+	conn := ln.dial()
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte{0x05, 0x01, 0x00})
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte{0x05, 0x01, 0x00, 0x01, 203, 0, 113, 1, 0x20, 0xc4})
+	reply = make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != 0x02 {
+		t.Fatalf("reply = %#x, want 0x02 (not allowed by ruleset)", reply[1])
+	}
+}
+
+func TestReplyWriteFailure(t *testing.T) {
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	var dials atomic.Int32
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			dials.Add(1)
+			conn.Close()
+		}
+	}()
+	
+	records := recordLogs(t, "[SOCKS5] ")
+	ln := newPipeListener()
+	c := &Client{ServerAddr: server.Addr().String(), Method: "2022-blake3-aes-128-gcm", Key: make([]byte, 16)}
+	if err := c.SetListener(ln); err != nil {
+		t.Fatal(err)
+	}
+	startClient(t, c)
+	
+	// The client sends its request and leaves before reading the reply, so
+	// writing the reply fails on the closed pipe.
+	conn := ln.dial()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte{0x05, 0x01, 0x00})
+	if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte{0x05, 0x01, 0x00, 0x01, 198, 51, 100, 1, 0x00, 0x50})
+	conn.Close()
+	
+	select {
+	case r := <-records:
+		if r.Message != "[SOCKS5] TCP proxy connection failed" {
+			t.Fatalf("logged %q, want the connection failure", r.Message)
+		}
+		if r.Level != slog.LevelDebug {
+			t.Errorf("logged at %v, want %v", r.Level, slog.LevelDebug)
+		}
+		r.Attrs(func(a slog.Attr) bool {
+			if a.Key == "err" && !strings.Contains(a.Value.String(), "send response failed") {
+				t.Errorf("err = %v, want the reply write failure", a.Value)
+			}
+			return true
+		})
+	case <-time.After(5 * time.Second):
+		t.Fatal("reply write failure not logged")
+	}
+	if n := dials.Load(); n != 0 {
+		t.Errorf("proxy dialed the server %d times after the reply failed", n)
+	}
+}
+
+func TestSetListenerUDP(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	// Without ListenAddr, associations bind the address of the listener.
+	c := &Client{ServerAddr: server.LocalAddr().String(), Method: "2022-blake3-aes-128-gcm", Key: make([]byte, 16), UDP: true}
+	if err := c.SetListener(ln); err != nil {
+		t.Fatal(err)
+	}
+	_, bnd := udpAssociate(t, startClient(t, c))
+	if want := ln.Addr().(*net.TCPAddr); bnd.Port != want.Port || !bnd.IP.Equal(want.IP) {
+		t.Fatalf("BND.ADDR = %v, want %v", bnd, want)
+	}
+	
+	// A listener without an IP address leaves nothing to bind.
+	c = &Client{UDP: true}
+	if err := c.SetListener(newPipeListener()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Run(context.Background()); !errors.Is(err, ErrNoUDPAddr) {
+		t.Fatalf("Run = %v, want ErrNoUDPAddr", err)
+	}
+}
+
+func TestSetupTimeoutAbortsHandshake(t *testing.T) {
+	const budget = 200 * time.Millisecond
+	proxy := startClient(t, &Client{
+		ServerAddr:   "203.0.113.1:8388",
+		Method:       "2022-blake3-aes-128-gcm",
+		Key:          make([]byte, 16),
+		SetupTimeout: budget,
+	})
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	conn.SetDeadline(start.Add(5 * time.Second))
+	
+	// The request never follows the greeting, so the handshake blocks on
+	// the client until the budget runs out.
+	conn.Write([]byte{0x05, 0x01, 0x00})
+	if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("read %d bytes, want the connection closed", n)
+	} else if errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("handshake not aborted at the end of the setup budget")
+	}
+	if elapsed := time.Since(start); elapsed < budget {
+		t.Fatalf("handshake aborted after %v, before the %v budget", elapsed, budget)
+	}
+}
+
+func TestShutdownRefusesHandshake(t *testing.T) {
+	c := &Client{ListenAddr: "127.0.0.1:0", ServerAddr: "203.0.113.1:8388", Method: "2022-blake3-aes-128-gcm", Key: make([]byte, 16)}
+	if err := c.Bind(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx)
+	
+	conn, err := net.Dial("tcp", c.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte{0x05, 0x01, 0x00})
+	if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	
+	// Shutting down while the handshake waits for the request.
+	cancel()
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("no reply after shutdown: %v", err)
+	}
+	if reply[1] != 0x05 {
+		t.Fatalf("reply = %#x, want 0x05 (connection refused)", reply[1])
+	}
+	if n, err := conn.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("connection still open after the refusal: read %d bytes, %v", n, err)
+	}
+}
+
+// ssRequest is a shadowsocks request as a server reads it.
+type ssRequest struct {
+	target         *core.Address
+	initialPayload []byte
+	firstChunk     []byte
+}
+
+// readSSRequest reads the request header and the first chunk, if any
+// follows within a short while, of a shadowsocks connection sealed with key.
+func readSSRequest(conn net.Conn, method string, key []byte) (*ssRequest, error) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	salt := make([]byte, len(key))
+	if _, err := io.ReadFull(conn, salt); err != nil {
+		return nil, err
+	}
+	c, err := shadowsocks.NewCipherWithSalt(method, key, salt)
+	if err != nil {
+		return nil, err
+	}
+	open := func(n int) ([]byte, error) {
+		b := make([]byte, n+c.AEAD.Overhead())
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return nil, err
+		}
+		return c.Open(b[:0], b)
+	}
+	
+	fixed, err := open(1 + 8 + 2)
+	if err != nil {
+		return nil, err
+	}
+	variable, err := open(int(binary.BigEndian.Uint16(fixed[9:])))
+	if err != nil {
+		return nil, err
+	}
+	req := &ssRequest{}
+	if req.target, err = core.ReadAddressFromBytes(variable); err != nil {
+		return nil, err
+	}
+	rest := variable[len(req.target.Bytes()):]
+	padding := int(binary.BigEndian.Uint16(rest))
+	req.initialPayload = rest[2+padding:]
+	
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	length, err := open(2)
+	if err != nil {
+		return req, nil
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if req.firstChunk, err = open(int(binary.BigEndian.Uint16(length))); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func TestDelayInitialPayload(t *testing.T) {
+	const method = "2022-blake3-aes-128-gcm"
+	key := make([]byte, 16)
+	for _, delay := range []bool{false, true} {
+		server, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+		requests := make(chan *ssRequest, 1)
+		go func() {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			req, err := readSSRequest(conn, method, key)
+			if err != nil {
+				t.Error(err)
+			}
+			requests <- req
+		}()
+		
+		proxy := startClient(t, &Client{
+			ServerAddr:          server.Addr().String(),
+			Method:              method,
+			Key:                 key,
+			FastOpen:            true,
+			DelayInitialPayload: delay,
+		})
+		conn, err := net.Dial("tcp", proxy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		// The client data follows the request without waiting for the
+		// reply, so the proxy has it before dialing the server.
+		conn.Write([]byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x01, 203, 0, 113, 1, 0x01, 0xbb})
+		conn.Write([]byte("client hello"))
+		
+		var req *ssRequest
+		select {
+		case req = <-requests:
+		case <-time.After(5 * time.Second):
+			t.Fatal("no request reached the server")
+		}
+		if req == nil {
+			t.Fatal("server could not read the request")
+		}
+		wantHeader, wantChunk := "client hello", ""
+		if delay {
+			wantHeader, wantChunk = "", "client hello"
+		}
+		if string(req.initialPayload) != wantHeader || string(req.firstChunk) != wantChunk {
+			t.Errorf("delay %v: header payload %q and first chunk %q, want %q and %q", delay, req.initialPayload, req.firstChunk, wantHeader, wantChunk)
+		}
+	}
+}
+
+func TestUDPAssociateAnnouncedSource(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	proxy := startClient(t, &Client{
+		ServerAddr: server.LocalAddr().String(),
+		Method:     "2022-blake3-aes-128-gcm",
+		Key:        make([]byte, 16),
+		UDP:        true,
+	})
+	
+	announced, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer announced.Close()
+	other, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	_, bnd := udpAssociateFrom(t, proxy, announced.LocalAddr().(*net.UDPAddr))
+	
+	datagram := []byte{0, 0, 0, 0x01, 127, 0, 0, 1, 0x00, 0x35, 'h', 'i'}
+	other.WriteToUDP(datagram, bnd)
+	server.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if _, _, err := server.ReadFrom(make([]byte, 2048)); err == nil {
+		t.Fatal("datagram from another source than announced relayed to the server")
+	}
+	
+	announced.WriteToUDP(datagram, bnd)
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := server.ReadFrom(make([]byte, 2048)); err != nil {
+		t.Fatalf("datagram from the announced source not relayed: %v", err)
+	}
+}
+
+func TestMaxDomainLengthRefusedBeforeDial(t *testing.T) {
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	var dials atomic.Int32
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			dials.Add(1)
+			conn.Close()
+		}
+	}()
+	
+	proxy := startClient(t, &Client{
+		ServerAddr:      server.Addr().String(),
+		Method:          "2022-blake3-aes-128-gcm",
+		Key:             make([]byte, 16),
+		MaxDomainLength: 32,
+	})
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	
+	domain := strings.Repeat("a", 200)
+	req := []byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, byte(core.AtypDomainName), byte(len(domain))}
+	conn.Write(append(append(req, domain...), 0x01, 0xbb))
+	reply := make([]byte, 2+10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	if reply[3] != 0x01 {
+		t.Fatalf("reply to an oversized domain = %#x, want general failure", reply[3])
+	}
+	if n := dials.Load(); n != 0 {
+		t.Fatalf("server dialed %d times for an oversized domain", n)
+	}
+}
+
+func TestPayloadLostOnDialFailure(t *testing.T) {
+	refused, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused.Close()
+	target, err := core.ParseAddress("example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	tests := []struct {
+		name           string
+		initialPayload []byte
+		delay          bool
+		lost           bool
+	}{
+		{"no payload", nil, false, false},
+		{"fast open", []byte("GET / HTTP/1.1\r\n\r\n"), false, true},
+		{"delayed", []byte("GET / HTTP/1.1\r\n\r\n"), true, true},
+	}
+	for _, tt := range tests {
+		c := &Client{
+			ServerAddr:          refused.Addr().String(),
+			Method:              "2022-blake3-aes-128-gcm",
+			Key:                 make([]byte, 16),
+			DelayInitialPayload: tt.delay,
+		}
+		client, peer := net.Pipe()
+		go io.Copy(io.Discard, peer)
+		err := c.handleTCP(context.Background(), context.Background(), time.Now(), client, target, tt.initialPayload)
+		client.Close()
+		peer.Close()
+		
+		if err == nil {
+			t.Fatalf("%s: handleTCP with the server down succeeded", tt.name)
+		}
+		if errors.Is(err, ErrPayloadNotDelivered) != tt.lost {
+			t.Errorf("%s: handleTCP = %v, want payload lost %v", tt.name, err, tt.lost)
+		}
+		if tt.lost && !strings.Contains(err.Error(), fmt.Sprintf("(%d bytes)", len(tt.initialPayload))) {
+			t.Errorf("%s: error %q does not tell how much was lost", tt.name, err)
+		}
+		if !errors.Is(err, syscall.ECONNREFUSED) {
+			t.Errorf("%s: error %v does not wrap the dial error", tt.name, err)
+		}
+	}
+}
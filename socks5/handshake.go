@@ -1,12 +1,16 @@
 package socks5
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"kage/core"
+	"log/slog"
 	"net"
+	"os"
 	"slices"
+	"syscall"
 	"time"
 )
 
@@ -14,18 +18,83 @@ var (
 	ErrVersionNotSupported = errors.New("socks5: version not supported")
 	ErrCommandNotSupported = errors.New("socks5: command not supported")
 	ErrMethodsCount        = errors.New("socks5: invalid methods count")
+	ErrMethodsTruncated    = errors.New("socks5: truncated methods list")
 	ErrNoAcceptableMethods = errors.New("socks5: no acceptable methods")
+	ErrUnknownMethod       = errors.New("socks5: unknown authentication method")
+	ErrProtocolDeviation   = errors.New("socks5: protocol deviation")
 )
 
+const (
+	MethodNoAuth       byte = 0x00
+	MethodUserPass     byte = 0x02
+	MethodNoAcceptable byte = 0xFF
+)
+
+// ParseMethod maps a config name to its SOCKS5 authentication method.
+func ParseMethod(name string) (byte, error) {
+	switch name {
+	case "none":
+		return MethodNoAuth, nil
+	case "password":
+		return MethodUserPass, nil
+	default:
+		return 0, fmt.Errorf("%w: %q", ErrUnknownMethod, name)
+	}
+}
+
 type HandshakeResult struct {
 	TargetAddress *core.Address
 	Command       byte
+	// Identity is the authenticated user, empty without authentication.
+	Identity string
 	
 	InitialPayload []byte
 }
 
-func Handshake(conn net.Conn, fastOpen bool) (*HandshakeResult, error) {
-	if err := auth(conn); err != nil {
+type Handshaker struct {
+	FastOpen bool
+	// Methods lists the accepted authentication methods, most preferred
+	// first. Only MethodNoAuth is accepted when it is empty.
+	Methods []byte
+	// Authenticator validates the credentials of MethodUserPass.
+	Authenticator Authenticator
+	// CoalesceInitialPayload keeps reading for a short while after the first
+	// segment of the initial payload, so that data the client splits over
+	// several quick writes is still sent with the request header.
+	CoalesceInitialPayload bool
+	// CompleteTLSRecord keeps reading an initial payload that starts with a
+	// TLS record header until the whole record, usually the ClientHello, has
+	// arrived.
+	CompleteTLSRecord bool
+	// AbortOnPayloadError fails the handshake when reading the initial
+	// payload fails. By default only a broken connection does; other errors,
+	// such as the client shutting down its write side, leave the payload
+	// empty and the request proceeds.
+	AbortOnPayloadError bool
+	// MaxDomainLength rejects requests for longer domain names.
+	// Defaults to core.MaxDomainLength.
+	MaxDomainLength int
+	// UDP accepts UDP ASSOCIATE. Without it the command is refused with
+	// "command not supported", like any other unsupported command.
+	UDP bool
+	// Strict rejects requests that RFC 1928 does not allow but that are
+	// otherwise understood: a non-zero RSV byte, an empty domain name or a
+	// CONNECT to port 0. Failed error replies are reported too.
+	Strict bool
+	// LogNegotiation logs the offered and selected methods, the command and
+	// the target of every handshake at debug level.
+	LogNegotiation bool
+	// TargetLog reduces the logged targets.
+	TargetLog core.TargetLogMode
+}
+
+// Handshake reads the method selection, optional authentication and request
+// from conn. Every field it reads is bounded: the method list, username and
+// password by their one-byte length prefixes, the domain name by
+// MaxDomainLength, and a fast-open payload by maxInitialPayloadLength.
+func (h *Handshaker) Handshake(conn net.Conn) (*HandshakeResult, error) {
+	identity, err := h.auth(conn)
+	if err != nil {
 		return nil, err
 	}
 	
@@ -37,31 +106,54 @@ func Handshake(conn net.Conn, fastOpen bool) (*HandshakeResult, error) {
 	if b[0] != 0x05 {
 		return nil, ErrVersionNotSupported
 	}
+	if h.Strict && b[2] != 0x00 {
+		writeReply(conn, 0x01)
+		return nil, fmt.Errorf("%w: RSV is %#x", ErrProtocolDeviation, b[2])
+	}
 	
-	switch b[1] {
-	case 0x01, 0x03:
+	switch {
+	case b[1] == 0x01, b[1] == 0x03 && h.UDP:
 	default:
-		conn.Write([]byte{0x05, 0x07, 0x00, byte(core.AtypIPv4), 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+		writeReply(conn, 0x07)
 		return nil, ErrCommandNotSupported
 	}
 	
-	addr, err := core.ReadAddress(conn)
+	maxDomainLen := h.MaxDomainLength
+	if maxDomainLen <= 0 {
+		maxDomainLen = core.MaxDomainLength
+	}
+	addr, err := core.ReadAddressLimit(conn, maxDomainLen)
 	if errors.Is(err, core.ErrAddressTypeNotSupported) {
-		conn.Write([]byte{0x05, 0x08, 0x00, byte(core.AtypIPv4), 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+		writeReply(conn, 0x08)
 		return nil, core.ErrAddressTypeNotSupported
 	}
+	if errors.Is(err, core.ErrDomainTooLong) {
+		writeReply(conn, 0x01)
+		return nil, core.ErrDomainTooLong
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to read target address: %w", err)
 	}
+	if h.Strict {
+		if err = strictCheckAddress(addr, b[1]); err != nil {
+			writeReply(conn, 0x01)
+			return nil, err
+		}
+	}
+	
+	if h.LogNegotiation {
+		slog.Debug("[SOCKS5] request", "client", conn.RemoteAddr(), "command", b[1], h.TargetLog.Attr(addr.String()))
+	}
 	
 	result := &HandshakeResult{
 		TargetAddress: addr,
 		Command:       b[1],
+		Identity:      identity,
 	}
 	
-	if fastOpen && b[1] == 0x01 {
-		payload, err := readInitialPayload(conn)
-		if err != nil {
+	if h.FastOpen && b[1] == 0x01 {
+		payload, err := readInitialPayload(conn, h.CoalesceInitialPayload, h.CompleteTLSRecord)
+		if err != nil && (h.AbortOnPayloadError || connBroken(err)) {
 			return nil, fmt.Errorf("failed to read initial payload: %w", err)
 		}
 		result.InitialPayload = payload
@@ -70,6 +162,13 @@ func Handshake(conn net.Conn, fastOpen bool) (*HandshakeResult, error) {
 	return result, nil
 }
 
+// writeReply sends a reply with code rep and an empty bound address, as for
+// every refused or failed request.
+func writeReply(conn net.Conn, rep byte) error {
+	_, err := conn.Write([]byte{0x05, rep, 0x00, byte(core.AtypIPv4), 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+	return err
+}
+
 func SendResponse(conn net.Conn, addr string) (err error) {
 	var address *core.Address
 	if addr == "" {
@@ -85,16 +184,27 @@ func SendResponse(conn net.Conn, addr string) (err error) {
 	return err
 }
 
-func readInitialPayload(conn net.Conn) ([]byte, error) {
+const (
+	maxInitialPayloadLength = 32 * 1024
+	coalesceWindow          = 20 * time.Millisecond
+)
+
+func readInitialPayload(conn net.Conn, coalesce, completeTLS bool) ([]byte, error) {
 	if err := conn.SetDeadline(time.Now().Add(500 * time.Millisecond)); err != nil {
 		return nil, err
 	}
 	defer conn.SetDeadline(time.Time{})
 	
-	buf := make([]byte, 32*1024)
+	buf := make([]byte, maxInitialPayloadLength)
 	n, err := conn.Read(buf)
 	
 	if n > 0 {
+		if completeTLS {
+			n += readTLSRecord(conn, buf, n)
+		}
+		if coalesce {
+			n += readMore(conn, buf[n:])
+		}
 		return buf[:n], nil
 	}
 	
@@ -109,42 +219,122 @@ func readInitialPayload(conn net.Conn) ([]byte, error) {
 	return nil, nil
 }
 
-func auth(conn net.Conn) error {
+// connBroken reports whether err leaves conn unusable for the request.
+func connBroken(err error) bool {
+	return errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// tlsRecordHeaderLength is the size of a TLS record header: content type,
+// protocol version and length.
+const tlsRecordHeaderLength = 5
+
+// readTLSRecord reads the rest of the TLS record at the start of buf[:n], if
+// it is one and fits in buf, and returns the number of bytes added. Whatever
+// arrived before the deadline is kept.
+func readTLSRecord(conn net.Conn, buf []byte, n int) int {
+	if n < tlsRecordHeaderLength || buf[0] != 0x16 || buf[1] != 0x03 { // handshake record, TLS 1.x
+		return 0
+	}
+	recordLen := tlsRecordHeaderLength + int(binary.BigEndian.Uint16(buf[3:5]))
+	if recordLen <= n || recordLen > len(buf) {
+		return 0
+	}
+	more, _ := io.ReadFull(conn, buf[n:recordLen])
+	return more
+}
+
+// readMore reads whatever arrives within coalesceWindow of the previous
+// segment, until buf is full.
+func readMore(conn net.Conn, buf []byte) int {
+	total := 0
+	for total < len(buf) {
+		if err := conn.SetReadDeadline(time.Now().Add(coalesceWindow)); err != nil {
+			break
+		}
+		n, err := conn.Read(buf[total:])
+		total += n
+		if err != nil {
+			break
+		}
+	}
+	return total
+}
+
+func (h *Handshaker) auth(conn net.Conn) (string, error) {
 	if err := conn.SetDeadline(time.Now().Add(time.Second * 5)); err != nil {
-		return err
+		return "", err
 	}
 	defer conn.SetDeadline(time.Time{})
 	
 	buf := make([]byte, 255)
 	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
 		if errors.Is(err, io.EOF) {
-			return err
+			return "", err
 		}
-		return fmt.Errorf("failed to read auth header: %w", err)
+		return "", fmt.Errorf("failed to read auth header: %w", err)
 	}
 	
 	if buf[0] != 0x05 {
-		return fmt.Errorf("%w: got %d", ErrVersionNotSupported, buf[0])
+		return "", fmt.Errorf("%w: got %d", ErrVersionNotSupported, buf[0])
 	}
 	
 	nMethods := int(buf[1])
 	if nMethods < 1 {
-		return ErrMethodsCount
+		return "", ErrMethodsCount
 	}
 	
-	if _, err := io.ReadFull(conn, buf[:nMethods]); err != nil {
-		return fmt.Errorf("failed to read auth methods: %w", err)
+	if n, err := io.ReadFull(conn, buf[:nMethods]); err != nil {
+		// A client that declares more methods than it sends leaves ReadFull
+		// waiting for the deadline; report that as what it is.
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, os.ErrDeadlineExceeded) {
+			return "", fmt.Errorf("%w: declared %d, received %d: %w", ErrMethodsTruncated, nMethods, n, err)
+		}
+		return "", fmt.Errorf("failed to read auth methods: %w", err)
 	}
 	
-	if !slices.Contains(buf[:nMethods], 0x00) {
-		conn.Write([]byte{0x05, 0xFF})
-		return ErrNoAcceptableMethods
+	method := h.selectMethod(buf[:nMethods])
+	if h.LogNegotiation {
+		slog.Debug("[SOCKS5] methods negotiated", "client", conn.RemoteAddr(), "offered", fmt.Sprintf("% x", buf[:nMethods]), "selected", fmt.Sprintf("%02x", method))
+	}
+	if method == MethodNoAcceptable {
+		if _, err := conn.Write([]byte{0x05, MethodNoAcceptable}); err != nil && h.Strict {
+			return "", fmt.Errorf("%w: failed to write auth response: %w", ErrNoAcceptableMethods, err)
+		}
+		return "", ErrNoAcceptableMethods
 	}
 	
 	var err error
-	if _, err = conn.Write([]byte{0x05, 0x00}); err != nil {
-		return fmt.Errorf("failed to write auth response: %w", err)
+	if _, err = conn.Write([]byte{0x05, method}); err != nil {
+		return "", fmt.Errorf("failed to write auth response: %w", err)
 	}
 	
+	if method == MethodUserPass {
+		return authUserPass(conn, h.Authenticator)
+	}
+	return "", nil
+}
+
+func strictCheckAddress(addr *core.Address, cmd byte) error {
+	if addr.Type == core.AtypDomainName && len(addr.Host) == 0 {
+		return fmt.Errorf("%w: empty domain name", ErrProtocolDeviation)
+	}
+	if cmd == 0x01 && addr.Port == 0 {
+		return fmt.Errorf("%w: CONNECT to port 0", ErrProtocolDeviation)
+	}
 	return nil
 }
+
+func (h *Handshaker) selectMethod(offered []byte) byte {
+	accepted := h.Methods
+	if len(accepted) == 0 {
+		accepted = []byte{MethodNoAuth}
+	}
+	for _, m := range accepted {
+		if slices.Contains(offered, m) {
+			return m
+		}
+	}
+	return MethodNoAcceptable
+}
@@ -0,0 +1,432 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"kage/core"
+	"log/slog"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// runHandshake runs Handshake with h on a loopback connection whose client
+// sends script and then closes its write side. It returns the result, every
+// byte the server wrote back and the error of Handshake.
+func runHandshake(t *testing.T, h *Handshaker, script []byte) (*HandshakeResult, []byte, error) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	
+	client.Write(script)
+	client.(*net.TCPConn).CloseWrite()
+	res, err := h.Handshake(server)
+	// Drain what the handshake left unread, so that closing does not reset
+	// the connection before the client has read the replies.
+	server.(*net.TCPConn).CloseWrite()
+	io.Copy(io.Discard, server)
+	server.Close()
+	replies, _ := io.ReadAll(client)
+	return res, replies, err
+}
+
+func TestMethodPriority(t *testing.T) {
+	tests := []struct {
+		accepted []byte
+		offered  []byte
+		want     byte
+	}{
+		{nil, []byte{MethodUserPass, MethodNoAuth}, MethodNoAuth},
+		{nil, []byte{MethodUserPass}, MethodNoAcceptable},
+		// The configured order wins over the order the client offers.
+		{[]byte{MethodUserPass, MethodNoAuth}, []byte{MethodNoAuth, MethodUserPass}, MethodUserPass},
+		{[]byte{MethodNoAuth, MethodUserPass}, []byte{MethodUserPass, MethodNoAuth}, MethodNoAuth},
+		{[]byte{MethodUserPass, MethodNoAuth}, []byte{MethodNoAuth}, MethodNoAuth},
+	}
+	for _, tt := range tests {
+		h := &Handshaker{Methods: tt.accepted, Authenticator: StaticAuthenticator{"alice": "secret"}}
+		script := append([]byte{0x05, byte(len(tt.offered))}, tt.offered...)
+		_, replies, _ := runHandshake(t, h, script)
+		if len(replies) < 2 || replies[1] != tt.want {
+			t.Errorf("accepting % x, offered % x: reply % x, want method %02x", tt.accepted, tt.offered, replies, tt.want)
+		}
+	}
+}
+
+func TestMethodsTruncated(t *testing.T) {
+	_, replies, err := runHandshake(t, &Handshaker{}, []byte{0x05, 0x03, MethodNoAuth})
+	if !errors.Is(err, ErrMethodsTruncated) {
+		t.Fatalf("err = %v, want ErrMethodsTruncated", err)
+	}
+	if errors.Is(err, ErrNoAcceptableMethods) {
+		t.Errorf("err = %v, also reported as no acceptable methods", err)
+	}
+	if !strings.Contains(err.Error(), "declared 3, received 1") {
+		t.Errorf("error %q does not say how many methods arrived", err)
+	}
+	if len(replies) != 0 {
+		t.Errorf("replies % x to a truncated list, want none", replies)
+	}
+	// A truncated list is a broken client, not one that went away.
+	if clientGone(err) {
+		t.Error("clientGone reports a truncated methods list")
+	}
+}
+
+func TestMaxDomainLength(t *testing.T) {
+	request := func(domain string) []byte {
+		b := []byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, byte(core.AtypDomainName), byte(len(domain))}
+		return append(append(b, domain...), 0x01, 0xbb)
+	}
+	tests := []struct {
+		max    int
+		domain string
+		err    error
+	}{
+		{0, strings.Repeat("a", 255), nil},
+		{16, strings.Repeat("a", 16), nil},
+		{16, strings.Repeat("a", 17), core.ErrDomainTooLong},
+		{16, strings.Repeat("a", 255), core.ErrDomainTooLong},
+	}
+	for _, tt := range tests {
+		h := &Handshaker{MaxDomainLength: tt.max}
+		res, replies, err := runHandshake(t, h, request(tt.domain))
+		if !errors.Is(err, tt.err) {
+			t.Errorf("max %d, %d byte domain: err = %v, want %v", tt.max, len(tt.domain), err, tt.err)
+			continue
+		}
+		if tt.err == nil {
+			if string(res.TargetAddress.Host) != tt.domain {
+				t.Errorf("max %d: target %q, want %q", tt.max, res.TargetAddress.Host, tt.domain)
+			}
+			continue
+		}
+		// The refusal follows the method selection reply.
+		if want := []byte{0x05, 0x00, 0x05, 0x01}; !bytes.HasPrefix(replies, want) || len(replies) != 12 {
+			t.Errorf("max %d, %d byte domain: replies % x, want a general failure reply", tt.max, len(tt.domain), replies)
+		}
+	}
+}
+
+func TestStrict(t *testing.T) {
+	tests := []struct {
+		name    string
+		request []byte
+	}{
+		{"non-zero RSV", []byte{0x05, 0x01, 0x01, byte(core.AtypIPv4), 127, 0, 0, 1, 0x00, 0x50}},
+		{"empty domain", []byte{0x05, 0x01, 0x00, byte(core.AtypDomainName), 0, 0x00, 0x50}},
+		{"CONNECT to port 0", []byte{0x05, 0x01, 0x00, byte(core.AtypIPv4), 127, 0, 0, 1, 0x00, 0x00}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			script := append([]byte{0x05, 0x01, 0x00}, tt.request...)
+			
+			res, replies, err := runHandshake(t, &Handshaker{}, script)
+			if err != nil {
+				t.Fatalf("lenient: %v", err)
+			}
+			if res.Command != 0x01 {
+				t.Errorf("lenient: command %#x, want CONNECT", res.Command)
+			}
+			if want := []byte{0x05, 0x00}; !bytes.Equal(replies, want) {
+				t.Errorf("lenient: replies % x, want only the method selection % x", replies, want)
+			}
+			
+			_, replies, err = runHandshake(t, &Handshaker{Strict: true}, script)
+			if !errors.Is(err, ErrProtocolDeviation) {
+				t.Fatalf("strict: err = %v, want ErrProtocolDeviation", err)
+			}
+			if want := []byte{0x05, 0x00, 0x05, 0x01}; !bytes.HasPrefix(replies, want) || len(replies) != 12 {
+				t.Errorf("strict: replies % x, want a general failure reply", replies)
+			}
+		})
+	}
+	
+	// Both modes refuse reserved commands alike.
+	for _, strict := range []bool{false, true} {
+		_, replies, err := runHandshake(t, &Handshaker{Strict: strict}, []byte{0x05, 0x01, 0x00, 0x05, 0x04, 0x00, byte(core.AtypIPv4), 127, 0, 0, 1, 0x00, 0x50})
+		if !errors.Is(err, ErrCommandNotSupported) {
+			t.Errorf("strict %v: err = %v, want ErrCommandNotSupported", strict, err)
+		}
+		if want := []byte{0x05, 0x00, 0x05, 0x07}; !bytes.HasPrefix(replies, want) {
+			t.Errorf("strict %v: replies % x, want command not supported", strict, replies)
+		}
+	}
+}
+
+func TestLogNegotiation(t *testing.T) {
+	script := []byte{0x05, 0x02, MethodUserPass, MethodNoAuth, 0x05, 0x01, 0x00, byte(core.AtypDomainName), 11}
+	script = append(append(script, "example.com"...), 0x01, 0xbb)
+	
+	records := recordLogs(t, "[SOCKS5] ")
+	if _, _, err := runHandshake(t, &Handshaker{}, script); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-records:
+		t.Fatalf("logged %q without LogNegotiation", r.Message)
+	default:
+	}
+	
+	if _, _, err := runHandshake(t, &Handshaker{LogNegotiation: true}, script); err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		message string
+		attrs   map[string]string
+	}{
+		{"[SOCKS5] methods negotiated", map[string]string{"offered": "02 00", "selected": "00"}},
+		{"[SOCKS5] request", map[string]string{"command": "1", "target": "example.com:443"}},
+	}
+	for _, w := range want {
+		var r slog.Record
+		select {
+		case r = <-records:
+		default:
+			t.Fatalf("%q not logged", w.message)
+		}
+		if r.Message != w.message || r.Level != slog.LevelDebug {
+			t.Fatalf("logged %q at %v, want %q at debug level", r.Message, r.Level, w.message)
+		}
+		got := map[string]string{}
+		r.Attrs(func(a slog.Attr) bool {
+			got[a.Key] = a.Value.String()
+			return true
+		})
+		if got["client"] == "" {
+			t.Errorf("%s: no client attribute", w.message)
+		}
+		for key, value := range w.attrs {
+			if got[key] != value {
+				t.Errorf("%s: %s = %q, want %q", w.message, key, got[key], value)
+			}
+		}
+	}
+}
+
+// tcpPair returns the two ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (client, server net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err = net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	server, err = ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return client, server
+}
+
+func TestCoalesceInitialPayload(t *testing.T) {
+	for _, coalesce := range []bool{false, true} {
+		client, server := tcpPair(t)
+		go func() {
+			client.Write([]byte("client "))
+			time.Sleep(coalesceWindow / 4)
+			client.Write([]byte("hello"))
+		}()
+		
+		payload, err := readInitialPayload(server, coalesce, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "client "
+		if coalesce {
+			want = "client hello"
+		}
+		if string(payload) != want {
+			t.Errorf("coalesce %v: initial payload %q, want %q", coalesce, payload, want)
+		}
+	}
+}
+
+func TestCompleteTLSRecord(t *testing.T) {
+	// A ClientHello record split in two segments further apart than the
+	// coalesce window, followed by data that is not part of the record.
+	record := []byte{0x16, 0x03, 0x01, 0x01, 0x00} // handshake record of 256 bytes
+	record = append(record, bytes.Repeat([]byte{0xab}, 256)...)
+	tests := []struct {
+		name  string
+		first []byte
+		rest  []byte
+		want  []byte
+	}{
+		{"tls", record[:40], append(record[40:], "next"...), record},
+		{"not tls", []byte("GET / HTTP/1.1\r\n"), []byte("Host: example.com\r\n"), []byte("GET / HTTP/1.1\r\n")},
+		{"short header", record[:3], record[3:], record[:3]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := tcpPair(t)
+			go func() {
+				client.Write(tt.first)
+				time.Sleep(3 * coalesceWindow)
+				client.Write(tt.rest)
+			}()
+			
+			payload, err := readInitialPayload(server, false, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(payload, tt.want) {
+				t.Errorf("initial payload is %d bytes % .8x..., want %d bytes % .8x...", len(payload), payload, len(tt.want), tt.want)
+			}
+		})
+	}
+}
+
+func TestCoalesceInitialPayloadOversized(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	payload := make([]byte, maxInitialPayloadLength+8*1024)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	go func() {
+		client.Write([]byte{0x05, 0x01, 0x00})
+		io.ReadFull(client, make([]byte, 2))
+		client.Write([]byte{0x05, 0x01, 0x00, byte(core.AtypIPv4), 127, 0, 0, 1, 0x00, 0x50})
+		client.Write(payload)
+	}()
+	
+	h := &Handshaker{FastOpen: true, CoalesceInitialPayload: true}
+	res, err := h.Handshake(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res.InitialPayload, payload[:maxInitialPayloadLength]) {
+		t.Fatalf("initial payload is %d bytes, want the first %d", len(res.InitialPayload), maxInitialPayloadLength)
+	}
+	
+	// What does not fit is left on the connection for the relay.
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	rest := make([]byte, len(payload)-maxInitialPayloadLength)
+	if _, err := io.ReadFull(server, rest); err != nil {
+		t.Fatalf("read the rest of the payload: %v", err)
+	}
+	if !bytes.Equal(rest, payload[maxInitialPayloadLength:]) {
+		t.Fatal("the rest of the payload was altered")
+	}
+}
+
+// probeErrConn passes the first n bytes read from its connection, then
+// fails every Read with err.
+type probeErrConn struct {
+	net.Conn
+	n   int
+	err error
+}
+
+func (c *probeErrConn) Read(p []byte) (int, error) {
+	if c.n == 0 {
+		return 0, c.err
+	}
+	n, err := c.Conn.Read(p[:min(len(p), c.n)])
+	c.n -= n
+	return n, err
+}
+
+func TestInitialPayloadReadError(t *testing.T) {
+	script := []byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, byte(core.AtypIPv4), 127, 0, 0, 1, 0x00, 0x50}
+	transient := errors.New("transient read error")
+	tests := []struct {
+		name  string
+		abort bool
+		err   error
+		fails bool
+	}{
+		{"transient", false, transient, false},
+		{"transient aborted", true, transient, true},
+		{"reset", false, syscall.ECONNRESET, true},
+		{"closed", false, net.ErrClosed, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := tcpPair(t)
+			client.Write(script)
+			
+			h := &Handshaker{FastOpen: true, AbortOnPayloadError: tt.abort}
+			res, err := h.Handshake(&probeErrConn{Conn: server, n: len(script), err: tt.err})
+			if tt.fails {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("err = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Handshake: %v", err)
+			}
+			if res.TargetAddress.String() != "127.0.0.1:80" || len(res.InitialPayload) != 0 {
+				t.Fatalf("request for %s with %d bytes of payload, want 127.0.0.1:80 without payload", res.TargetAddress, len(res.InitialPayload))
+			}
+		})
+	}
+}
+
+// countingConn counts the bytes read from its connection.
+type countingConn struct {
+	net.Conn
+	n int
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.n += n
+	return n, err
+}
+
+func TestOversizedFieldsBounded(t *testing.T) {
+	junk := bytes.Repeat([]byte{0xFF}, 1<<20)
+	tests := []struct {
+		name   string
+		h      *Handshaker
+		prefix []byte
+		// limit is the most Handshake may read before it gives up.
+		limit int
+	}{
+		// 255 methods, none of them acceptable.
+		{"methods", &Handshaker{}, []byte{0x05, 0xFF}, 2 + 255},
+		// The longest username and password, both wrong.
+		{"credentials", &Handshaker{Authenticator: StaticAuthenticator{"alice": "secret"}}, append([]byte{0x05, 0x01, MethodUserPass, 0x01, 0xFF}, bytes.Repeat([]byte{'u'}, 255)...), 3 + 2 + 255 + 1 + 255},
+		// A domain longer than MaxDomainLength.
+		{"domain", &Handshaker{MaxDomainLength: 64}, []byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, byte(core.AtypDomainName), 0xFF}, 3 + 4 + 1 + 255 + 2},
+	}
+	for _, tt := range tests {
+		client, server := tcpPair(t)
+		go client.Write(append(append([]byte{}, tt.prefix...), junk...))
+		go io.Copy(io.Discard, client)
+		
+		conn := &countingConn{Conn: server}
+		if _, err := tt.h.Handshake(conn); err == nil {
+			t.Errorf("%s: oversized handshake accepted", tt.name)
+		}
+		if conn.n > tt.limit {
+			t.Errorf("%s: read %d bytes before rejecting, want at most %d", tt.name, conn.n, tt.limit)
+		}
+	}
+}
@@ -1,14 +1,24 @@
 package socks5
 
 import (
+	"bytes"
 	"errors"
 	"kage/core"
+	"net"
+	"sync"
+	"time"
 )
 
 var (
-	ErrInvalidDatagram = errors.New("socks5: invalid datagram")
+	ErrInvalidDatagram      = errors.New("socks5: invalid datagram")
+	ErrFragmentNotSupported = errors.New("socks5: fragmentation not supported")
+	ErrQUICBlocked          = errors.New("socks5: QUIC datagram blocked")
 )
 
+// quicPort is the UDP port of HTTP/3, whose clients fall back to TCP when
+// their datagrams go unanswered.
+const quicPort = 443
+
 type Datagram []byte
 
 func (d Datagram) Validate() error {
@@ -19,11 +29,108 @@ func (d Datagram) Validate() error {
 		return ErrInvalidDatagram
 	}
 	if d[2] != 0x00 { // FRAG
-		return errors.New("socks5: fragmentation not supported")
+		return ErrFragmentNotSupported
 	}
 	return nil
 }
 
+// UnwrapDatagram strips the RSV and FRAG fields of an unfragmented request,
+// leaving the address and payload the shadowsocks server expects.
+func UnwrapDatagram(_ net.Addr, b []byte) ([]byte, error) {
+	d := Datagram(b)
+	if err := d.Validate(); err != nil {
+		return nil, err
+	}
+	if _, err := d.Address(); err != nil {
+		return nil, err
+	}
+	return b[3:], nil
+}
+
+const defaultReassemblyTimeout = 5 * time.Second
+
+// Reassembler unwraps requests like UnwrapDatagram but also reassembles
+// fragmented ones per client as described in RFC 1928 section 7: fragments
+// 1 to 127 are queued in order until the one with the high-order bit set
+// completes the datagram. A fragment that does not directly follow its
+// predecessor or a queue older than Timeout discards what was queued.
+type Reassembler struct {
+	// Timeout defaults to 5 seconds.
+	Timeout time.Duration
+	
+	mu      sync.Mutex
+	pending map[string]*fragmentQueue
+}
+
+type fragmentQueue struct {
+	started time.Time
+	last    byte
+	addr    []byte
+	data    []byte
+}
+
+func (r *Reassembler) Unwrap(from net.Addr, b []byte) ([]byte, error) {
+	d := Datagram(b)
+	if len(d) < 4 || d[0] != 0x00 || d[1] != 0x00 {
+		return nil, ErrInvalidDatagram
+	}
+	frag := d[2]
+	if frag == 0x00 {
+		r.discard(from)
+		return UnwrapDatagram(from, b)
+	}
+	
+	addr, err := d.Address()
+	if err != nil {
+		return nil, err
+	}
+	
+	timeout := r.Timeout
+	if timeout == 0 {
+		timeout = defaultReassemblyTimeout
+	}
+	
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pending == nil {
+		r.pending = make(map[string]*fragmentQueue)
+	}
+	
+	key := from.String()
+	pos := frag & 0x7F
+	q := r.pending[key]
+	if q != nil && (pos != q.last+1 || time.Since(q.started) > timeout) {
+		delete(r.pending, key)
+		q = nil
+	}
+	if q == nil {
+		if pos != 1 {
+			return nil, nil
+		}
+		q = &fragmentQueue{started: time.Now(), addr: addr.Bytes()}
+		r.pending[key] = q
+	}
+	
+	q.last = pos
+	q.data = append(q.data, d.Payload()...)
+	if len(q.data) > 0xFFFF {
+		delete(r.pending, key)
+		return nil, ErrInvalidDatagram
+	}
+	if frag&0x80 == 0 {
+		return nil, nil
+	}
+	
+	delete(r.pending, key)
+	return append(q.addr, q.data...), nil
+}
+
+func (r *Reassembler) discard(from net.Addr) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.pending, from.String())
+}
+
 func (d Datagram) Address() (*core.Address, error) {
 	return core.ReadAddressFromBytes(d[3:])
 }
@@ -68,3 +175,21 @@ func ParseDatagram(b []byte) (addr *core.Address, payload []byte, err error) {
 	return addr, d.Payload(), nil
 }
 
+// BlockQUIC wraps an UnwrapRequest function so that requests to UDP port 443
+// are dropped, pushing applications from QUIC back to TCP.
+func BlockQUIC(unwrap func(net.Addr, []byte) ([]byte, error)) func(net.Addr, []byte) ([]byte, error) {
+	return func(from net.Addr, b []byte) ([]byte, error) {
+		data, err := unwrap(from, b)
+		if err != nil || data == nil {
+			return data, err
+		}
+		addr, err := core.ReadAddress(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if addr.Port == quicPort {
+			return nil, ErrQUICBlocked
+		}
+		return data, nil
+	}
+}
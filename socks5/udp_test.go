@@ -0,0 +1,173 @@
+package socks5
+
+import (
+	"bytes"
+	"kage/core"
+	"net"
+	"testing"
+	"time"
+)
+
+// fragment builds a SOCKS5 UDP request for 203.0.113.1:53 with the given
+// FRAG field.
+func fragment(t *testing.T, frag byte, payload string) []byte {
+	t.Helper()
+	addr, err := core.ParseAddress("203.0.113.1:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(append([]byte{0x00, 0x00, frag}, addr.Bytes()...), payload...)
+}
+
+func TestReassembler(t *testing.T) {
+	type step struct {
+		frag    byte
+		payload string
+		// want is the payload of the datagram completed by this step, if
+		// any.
+		want string
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"unfragmented", []step{{0x00, "abc", "abc"}}},
+		{"in order", []step{{0x01, "ab", ""}, {0x02, "cd", ""}, {0x83, "ef", "abcdef"}}},
+		{"single fragment", []step{{0x81, "abc", "abc"}}},
+		{"again after completion", []step{{0x01, "ab", ""}, {0x82, "cd", "abcd"}, {0x01, "ef", ""}, {0x82, "gh", "efgh"}}},
+		// A queue only starts with fragment 1.
+		{"no first fragment", []step{{0x02, "ab", ""}, {0x83, "cd", ""}}},
+		{"out of order", []step{{0x01, "ab", ""}, {0x03, "cd", ""}, {0x82, "ef", ""}}},
+		{"repeated fragment", []step{{0x01, "ab", ""}, {0x01, "cd", ""}, {0x82, "ef", "cdef"}}},
+		{"gap", []step{{0x01, "ab", ""}, {0x83, "cd", ""}}},
+		// An unfragmented datagram discards the queue.
+		{"unfragmented in between", []step{{0x01, "ab", ""}, {0x00, "xy", "xy"}, {0x82, "cd", ""}}},
+	}
+	from := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &Reassembler{}
+			for i, s := range tt.steps {
+				got, err := r.Unwrap(from, fragment(t, s.frag, s.payload))
+				if err != nil {
+					t.Fatalf("step %d: %v", i, err)
+				}
+				var want []byte
+				if s.want != "" {
+					want = fragment(t, 0x00, s.want)[3:]
+				}
+				if !bytes.Equal(got, want) {
+					t.Fatalf("step %d: Unwrap = %q, want %q", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestReassemblerPerClient(t *testing.T) {
+	r := &Reassembler{}
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	b := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40001}
+	r.Unwrap(a, fragment(t, 0x01, "a1"))
+	r.Unwrap(b, fragment(t, 0x01, "b1"))
+	got, err := r.Unwrap(a, fragment(t, 0x82, "a2"))
+	if err != nil || !bytes.Equal(got, fragment(t, 0x00, "a1a2")[3:]) {
+		t.Fatalf("Unwrap from a = %q, %v", got, err)
+	}
+	got, err = r.Unwrap(b, fragment(t, 0x82, "b2"))
+	if err != nil || !bytes.Equal(got, fragment(t, 0x00, "b1b2")[3:]) {
+		t.Fatalf("Unwrap from b = %q, %v", got, err)
+	}
+}
+
+func TestReassemblerTimeout(t *testing.T) {
+	r := &Reassembler{Timeout: 20 * time.Millisecond}
+	from := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	r.Unwrap(from, fragment(t, 0x01, "ab"))
+	time.Sleep(50 * time.Millisecond)
+	
+	// The stale partial datagram is discarded rather than completed.
+	if got, err := r.Unwrap(from, fragment(t, 0x82, "cd")); err != nil || got != nil {
+		t.Fatalf("Unwrap after the timeout = %q, %v, want nothing", got, err)
+	}
+	// A fresh queue started after the timeout completes normally.
+	r.Unwrap(from, fragment(t, 0x01, "ef"))
+	got, err := r.Unwrap(from, fragment(t, 0x82, "gh"))
+	if err != nil || !bytes.Equal(got, fragment(t, 0x00, "efgh")[3:]) {
+		t.Fatalf("Unwrap of a fresh queue = %q, %v", got, err)
+	}
+}
+
+func TestReassemblerTooLarge(t *testing.T) {
+	r := &Reassembler{}
+	from := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	big := string(bytes.Repeat([]byte("x"), 0x8000))
+	r.Unwrap(from, fragment(t, 0x01, big))
+	if _, err := r.Unwrap(from, fragment(t, 0x02, big+"xx")); err != ErrInvalidDatagram {
+		t.Fatalf("Unwrap beyond 64 KiB = %v, want ErrInvalidDatagram", err)
+	}
+}
+
+func TestBlockQUIC(t *testing.T) {
+	unwrap := BlockQUIC(UnwrapDatagram)
+	from := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	tests := []struct {
+		target string
+		err    error
+	}{
+		{"203.0.113.1:443", ErrQUICBlocked},
+		{"[2001:db8::1]:443", ErrQUICBlocked},
+		{"example.com:443", ErrQUICBlocked},
+		{"203.0.113.1:53", nil},
+		{"example.com:4433", nil},
+	}
+	for _, tt := range tests {
+		addr, err := core.ParseAddress(tt.target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := append(append([]byte{0x00, 0x00, 0x00}, addr.Bytes()...), "quic"...)
+		data, err := unwrap(from, req)
+		if err != tt.err {
+			t.Errorf("%s: error %v, want %v", tt.target, err, tt.err)
+		}
+		if tt.err == nil && !bytes.Equal(data, req[3:]) {
+			t.Errorf("%s: unwrapped %x, want %x", tt.target, data, req[3:])
+		}
+	}
+}
+
+func TestBlockQUICRelay(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	
+	proxy := startClient(t, &Client{
+		ServerAddr: server.LocalAddr().String(),
+		Method:     "2022-blake3-aes-128-gcm",
+		Key:        make([]byte, 16),
+		UDP:        true,
+		BlockQUIC:  true,
+	})
+	_, bnd := udpAssociate(t, proxy)
+	udp, err := net.DialUDP("udp", nil, bnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	
+	// Only the datagram to port 53 reaches the server.
+	udp.Write([]byte{0, 0, 0, 0x01, 127, 0, 0, 1, 0x01, 0xBB, 'q', 'u', 'i', 'c'})
+	udp.Write([]byte{0, 0, 0, 0x01, 127, 0, 0, 1, 0x00, 0x35, 'd', 'n', 's'})
+	buf := make([]byte, 2048)
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := server.ReadFrom(buf); err != nil {
+		t.Fatalf("no packet relayed to the server: %v", err)
+	}
+	server.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, _, err := server.ReadFrom(buf); err == nil {
+		t.Fatal("the datagram to port 443 was relayed too")
+	}
+}
@@ -3,6 +3,7 @@ package tunnel
 import (
 	"context"
 	"errors"
+	"fmt"
 	"kage/core"
 	"kage/shadowsocks"
 	"log/slog"
@@ -10,20 +11,99 @@ import (
 	"time"
 )
 
+const maxAcceptFailures = 32
+
+// acceptBackoff spaces out accept retries, as a variable for tests.
+var acceptBackoff = core.Backoff{Min: 5 * time.Millisecond, Max: time.Second}
+
 type Client struct {
 	ListenAddr string
 	ServerAddr string
 	Method     string
 	TargetAddr string
+	NoPadding  bool
 	
 	Key []byte
+	
+	ConnectTimeout   time.Duration
+	HandshakeTimeout time.Duration
+	ChunkSize        int
+	DSCP             int
+	CoalesceDelay    time.Duration
+	// HandshakeDump logs the first server handshakes in hex, see
+	// shadowsocks.HandshakeDump.
+	HandshakeDump *shadowsocks.HandshakeDump
+	// TapLimit logs up to this many bytes of plaintext per direction of
+	// each connection, see shadowsocks.Dialer.TapLimit.
+	TapLimit int
+	// EarlyRetries re-dials the server when it drops a connection before
+	// any data was exchanged, see shadowsocks.RetryConn.
+	EarlyRetries int
+	
+	// Relayer relays the connections with the settings this inbound shares
+	// with the others of the instance, such as the quota. Nil relays with
+	// the defaults.
+	Relayer *core.Relayer
+	// BackoffJitter randomizes the delays between accept retries.
+	BackoffJitter core.Jitter
+	
+	ln net.Listener
 }
 
-func (c *Client) Run(ctx context.Context) error {
+// Bind opens the listener ahead of Run, so that Addr is known before serving
+// starts. Run binds by itself when Bind was not called.
+func (c *Client) Bind() error {
 	ln, err := net.Listen("tcp", c.ListenAddr)
 	if err != nil {
 		return err
 	}
+	c.ln = ln
+	return nil
+}
+
+// SetListener makes Run serve ln, e.g. one wrapped with TLS or rate
+// limiting, instead of binding ListenAddr.
+func (c *Client) SetListener(ln net.Listener) error {
+	if err := core.CheckStreamListener(ln); err != nil {
+		return err
+	}
+	c.ln = ln
+	return nil
+}
+
+// Addr returns the address the listener is bound to, which differs from
+// ListenAddr when its port is 0. It is nil before binding.
+func (c *Client) Addr() net.Addr {
+	if c.ln == nil {
+		return nil
+	}
+	return c.ln.Addr()
+}
+
+// Validate reports a target that would loop traffic back into the proxy,
+// because it is exactly the shadowsocks server address. Other names of the
+// server are not resolved here; only the server knows what they reach.
+func (c *Client) Validate() error {
+	targetAddr, err := core.ParseAddress(c.TargetAddr)
+	if err != nil {
+		return err
+	}
+	if core.IsSelfTarget(targetAddr, c.ServerAddr) {
+		return fmt.Errorf("%w: target %s is the server itself", core.ErrSelfTarget, c.TargetAddr)
+	}
+	return nil
+}
+
+func (c *Client) Run(ctx context.Context) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	if c.ln == nil {
+		if err := c.Bind(); err != nil {
+			return err
+		}
+	}
+	ln := c.ln
 	defer ln.Close()
 	
 	go func() {
@@ -33,15 +113,34 @@ func (c *Client) Run(ctx context.Context) error {
 	
 	slog.Info("Tunnel inbound listening started", "addr", c.ListenAddr, "forwardTo", c.TargetAddr)
 	
+	var failures int
+	backoff := acceptBackoff
+	backoff.Jitter = c.BackoffJitter
 	for {
 		clientConn, err := ln.Accept()
 		if err != nil {
 			if errors.Is(err, net.ErrClosed) {
 				return nil
 			}
-			slog.Error("Tunnel inbound accept failed", "error", err)
+			
+			// Back off on repeated failures so a listener stuck in a bad
+			// state neither spins nor logs forever.
+			failures++
+			if failures >= maxAcceptFailures {
+				return fmt.Errorf("accept failed %d times in a row: %w", failures, err)
+			}
+			delay := backoff.Next()
+			slog.Error("Tunnel inbound accept failed", "error", err, "retryIn", delay)
+			
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(delay):
+			}
 			continue
 		}
+		failures = 0
+		backoff.Reset()
 		
 		go func() {
 			if err := c.handle(ctx, clientConn); err != nil {
@@ -51,28 +150,55 @@ func (c *Client) Run(ctx context.Context) error {
 	}
 }
 
-func (c *Client) handle(ctx context.Context, clientConn net.Conn) error {
+func (c *Client) handle(ctx context.Context, clientConn net.Conn) (err error) {
 	defer clientConn.Close()
+	accepted := time.Now()
 	
-	serverConn, err := net.DialTimeout("tcp", c.ServerAddr, time.Second*3)
-	if err != nil {
-		return err
+	if c.Relayer.QuotaExceeded() {
+		return core.ErrQuotaExceeded
 	}
-	defer serverConn.Close()
 	
 	targetAddr, err := core.ParseAddress(c.TargetAddr)
 	if err != nil {
 		return err
 	}
+	if core.IsSelfTarget(targetAddr, c.ServerAddr) {
+		return fmt.Errorf("%w: %v", core.ErrSelfTarget, targetAddr)
+	}
+	
+	ctx, span := c.Relayer.StartConnSpan(ctx, "tunnel", c.TargetAddr)
+	defer func() { span.End(err) }()
 	
-	slog.Debug("Tunnel connecting", "remote", clientConn.RemoteAddr(), "target", targetAddr)
+	sampled := c.Relayer.SampleConn()
+	if sampled {
+		slog.Debug("Tunnel connecting", "remote", clientConn.RemoteAddr(), c.Relayer.TargetAttr(targetAddr.String()))
+	}
 	
-	shadowConn, err := shadowsocks.NewConn(serverConn, c.Method, c.Key, targetAddr, nil)
+	dialer := &shadowsocks.Dialer{
+		ServerAddr:       c.ServerAddr,
+		Method:           c.Method,
+		Key:              c.Key,
+		NoPadding:        c.NoPadding,
+		ChunkSize:        c.ChunkSize,
+		DSCP:             c.DSCP,
+		CoalesceDelay:    c.CoalesceDelay,
+		ConnectTimeout:   c.ConnectTimeout,
+		HandshakeTimeout: c.HandshakeTimeout,
+		TargetLog:        c.Relayer.TargetLogMode(),
+		HandshakeDump:    c.HandshakeDump,
+		TapLimit:         c.TapLimit,
+	}
+	shadowConn, err := dialer.DialRetry(ctx, targetAddr, nil, c.EarlyRetries)
 	if err != nil {
 		return err
 	}
 	defer shadowConn.Close()
 	
-	core.TCPRelay(ctx, clientConn, shadowConn)
+	result := c.Relayer.Relay(ctx, clientConn, shadowConn)
+	ttfb := shadowConn.TimeToFirstByte(accepted)
+	span.SetAttributes(slog.Duration("ttfb", ttfb))
+	if sampled {
+		slog.Debug("Tunnel disconnected", "remote", clientConn.RemoteAddr(), c.Relayer.TargetAttr(targetAddr.String()), "ttfb", ttfb, "reason", result.Reason)
+	}
 	return nil
 }
@@ -0,0 +1,230 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kage/core"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		target string
+		want   error
+	}{
+		{"203.0.113.1:8388", core.ErrSelfTarget},
+		{"203.0.113.1:443", nil},
+		// Neither the listener nor other names of the server are compared.
+		{"127.0.0.1:1080", nil},
+		{"localhost:8388", nil},
+	}
+	for _, tt := range tests {
+		c := &Client{ListenAddr: "127.0.0.1:1080", ServerAddr: "203.0.113.1:8388", TargetAddr: tt.target}
+		if err := c.Validate(); !errors.Is(err, tt.want) {
+			t.Errorf("Validate with target %s = %v, want %v", tt.target, err, tt.want)
+		}
+	}
+}
+
+// failingListener fails the first failures calls to Accept, then blocks
+// until it is closed.
+type failingListener struct {
+	failures int
+	
+	mu      sync.Mutex
+	accepts int
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	l.accepts++
+	fail := l.accepts <= l.failures
+	l.mu.Unlock()
+	if fail {
+		return nil, errors.New("accept: too many open files")
+	}
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+func (l *failingListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *failingListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1080}
+}
+
+func (l *failingListener) acceptCalls() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.accepts
+}
+
+func TestRunAcceptFailures(t *testing.T) {
+	defer func(b core.Backoff) { acceptBackoff = b }(acceptBackoff)
+	acceptBackoff = core.Backoff{Min: time.Millisecond, Max: 4 * time.Millisecond}
+	
+	// The delays Run waits between the failures.
+	var wait time.Duration
+	b := acceptBackoff
+	for range maxAcceptFailures - 1 {
+		wait += b.Next()
+	}
+	
+	ln := &failingListener{failures: 1000, closed: make(chan struct{})}
+	c := &Client{ServerAddr: "203.0.113.1:8388", TargetAddr: "203.0.113.1:443"}
+	if err := c.SetListener(ln); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	err := c.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("accept failed %d times", maxAcceptFailures)) {
+		t.Fatalf("Run = %v, want to give up after %d failures", err, maxAcceptFailures)
+	}
+	if n := ln.acceptCalls(); n != maxAcceptFailures {
+		t.Errorf("Accept called %d times, want %d", n, maxAcceptFailures)
+	}
+	if elapsed := time.Since(start); elapsed < wait {
+		t.Errorf("Run gave up after %v, want at least %v of backoff", elapsed, wait)
+	}
+}
+
+func TestRunAcceptRecovers(t *testing.T) {
+	defer func(b core.Backoff) { acceptBackoff = b }(acceptBackoff)
+	acceptBackoff = core.Backoff{Min: time.Millisecond, Max: 4 * time.Millisecond}
+	
+	// Failures below the limit are retried and the loop keeps serving.
+	ln := &failingListener{failures: maxAcceptFailures - 1, closed: make(chan struct{})}
+	c := &Client{ServerAddr: "203.0.113.1:8388", TargetAddr: "203.0.113.1:443"}
+	if err := c.SetListener(ln); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+	
+	deadline := time.Now().Add(5 * time.Second)
+	for ln.acceptCalls() <= ln.failures {
+		if time.Now().After(deadline) {
+			t.Fatalf("Accept called %d times, want the loop to get past %d failures", ln.acceptCalls(), ln.failures)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("Run returned %v after recoverable failures", err)
+	default:
+	}
+	
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Run after cancellation = %v, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after cancellation")
+	}
+}
+
+// recordingTracer keeps the attributes and the error of the last span.
+type recordingTracer struct {
+	mu    sync.Mutex
+	attrs map[string]slog.Value
+	ended bool
+	err   error
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string) (context.Context, core.Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.attrs = map[string]slog.Value{}
+	t.ended, t.err = false, nil
+	return ctx, t
+}
+
+func (t *recordingTracer) SetAttributes(attrs ...slog.Attr) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, a := range attrs {
+		t.attrs[a.Key] = a.Value
+	}
+}
+
+func (t *recordingTracer) End(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ended, t.err = true, err
+}
+
+func TestHandleSpan(t *testing.T) {
+	tracer := &recordingTracer{}
+	c := &Client{
+		Method:     "2022-blake3-aes-128-gcm",
+		Key:        make([]byte, 16),
+		TargetAddr: "203.0.113.1:443",
+		Relayer:    &core.Relayer{Tracer: tracer},
+	}
+	handle := func() error {
+		client, peer := net.Pipe()
+		defer peer.Close()
+		go func() {
+			peer.Write([]byte("hello"))
+			peer.Close()
+		}()
+		return c.handle(context.Background(), client)
+	}
+	
+	// A failed dial ends the span with the error.
+	refused, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.ServerAddr = refused.Addr().String()
+	refused.Close()
+	err = handle()
+	if err == nil || !tracer.ended || tracer.err != err {
+		t.Fatalf("span ended %v with %v, want ended with the error of handle %v", tracer.ended, tracer.err, err)
+	}
+	if _, ok := tracer.attrs["ttfb"]; ok {
+		t.Errorf("ttfb set on a connection that never reached the server")
+	}
+	
+	// A relayed connection carries the time to first byte.
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	c.ServerAddr = server.Addr().String()
+	if err := handle(); err != nil {
+		t.Fatalf("handle: %v", err)
+	}
+	if !tracer.ended || tracer.err != nil {
+		t.Fatalf("span ended %v with %v, want ended without error", tracer.ended, tracer.err)
+	}
+	for _, key := range []string{"inbound", "target", "ttfb", "bytes_up", "bytes_down", "close_reason"} {
+		if _, ok := tracer.attrs[key]; !ok {
+			t.Errorf("span has no %s attribute: %v", key, tracer.attrs)
+		}
+	}
+}